@@ -5,6 +5,7 @@
 package alpenhorn
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/subtle"
@@ -12,6 +13,7 @@ import (
 	"encoding/hex"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
 	"golang.org/x/crypto/nacl/box"
@@ -37,12 +39,33 @@ type addFriendRoundState struct {
 	Config       *config.AddFriendConfig
 	ConfigParent *config.SignedConfig
 
-	mu               sync.Mutex
+	mu sync.Mutex
+
+	// PKGServers are the PKGs that took part in the round, which
+	// may be a subset of Config.PKGServers (see PKGThreshold).
+	PKGServers       []pkg.PublicServerConfig
 	ServerMasterKeys []*ibe.MasterPublicKey
 	PrivateKeys      []*ibe.IdentityPrivateKey
 	ServerBLSKeys    []*bls.PublicKey
 	IdentitySigs     []bls.Signature
 	ExtractSuccess   bool
+
+	// SyncTag is the tag of the sync intro this client sent in the
+	// round, if any, so the client can ignore its own sync intro.
+	SyncTag *[16]byte
+
+	// announced is closed once the round's config is known
+	// (see addFriendRoundState).
+	announced chan struct{}
+}
+
+func (st *addFriendRoundState) isAnnounced() bool {
+	select {
+	case <-st.announced:
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *Client) addFriendMux() typesocket.Mux {
@@ -60,24 +83,33 @@ func (c *Client) addFriendRoundError(conn typesocket.Conn, v coordinator.RoundEr
 }
 
 func (c *Client) newAddFriendRound(conn typesocket.Conn, v coordinator.NewRound) {
+	atomic.StoreUint32(&c.lastAddFriendRound, v.Round)
+	c.recordRound("AddFriend", v.Round)
+	c.expireFriendRequests(v.Round)
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	st, ok := c.addFriendRounds[v.Round]
-	if ok {
+	if ok && st.isAnnounced() {
 		if st.ConfigParent.Hash() != v.ConfigHash {
 			c.Handler.Error(errors.New("coordinator announced different configs round %d", v.Round))
 		}
 		return
 	}
+	if !ok {
+		st = &addFriendRoundState{
+			Round:     v.Round,
+			announced: make(chan struct{}),
+		}
+		c.addFriendRounds[v.Round] = st
+	}
 
 	// common case
 	if v.ConfigHash == c.addFriendConfigHash {
-		c.addFriendRounds[v.Round] = &addFriendRoundState{
-			Round:        v.Round,
-			Config:       c.addFriendConfig.Inner.(*config.AddFriendConfig),
-			ConfigParent: c.addFriendConfig,
-		}
+		st.Config = c.addFriendConfig.Inner.(*config.AddFriendConfig)
+		st.ConfigParent = c.addFriendConfig
+		close(st.announced)
 		return
 	}
 
@@ -91,14 +123,43 @@ func (c *Client) newAddFriendRound(conn typesocket.Conn, v coordinator.NewRound)
 	c.Handler.NewConfig(configs)
 
 	newConfig := configs[0]
-	addFriendConfig := c.loadAddFriendConfig(newConfig)
+	st.Config = c.loadAddFriendConfig(newConfig)
+	st.ConfigParent = newConfig
+	close(st.announced)
+}
 
-	c.addFriendRounds[v.Round] = &addFriendRoundState{
-		Round:        v.Round,
-		Config:       addFriendConfig,
-		ConfigParent: newConfig,
+// roundAnnounceTimeout is how long the handlers for a round's messages
+// wait for the round's "newround" message.
+const roundAnnounceTimeout = 20 * time.Second
+
+// addFriendRoundState returns the state for the given round once the
+// round's config is known. The coordinator's messages are handled
+// concurrently, and when the client reconnects in the middle of a round,
+// the replayed "pkg" and "mix" messages can be handled before the replayed
+// "newround" message (which may announce a new config), so this waits for
+// the "newround" message to be handled. It returns nil if the round is not
+// announced in time.
+func (c *Client) addFriendRoundState(round uint32) *addFriendRoundState {
+	c.mu.Lock()
+	st, ok := c.addFriendRounds[round]
+	if !ok {
+		st = &addFriendRoundState{
+			Round:     round,
+			announced: make(chan struct{}),
+		}
+		c.addFriendRounds[round] = st
 	}
+	c.mu.Unlock()
 
+	timer := time.NewTimer(roundAnnounceTimeout)
+	defer timer.Stop()
+	select {
+	case <-st.announced:
+		return st
+	case <-timer.C:
+		c.Handler.Error(errors.New("addfriend round %d was not announced", round))
+		return nil
+	}
 }
 
 // assumes c.mu is locked
@@ -139,11 +200,8 @@ func (c *Client) loadAddFriendConfig(newConfig *config.SignedConfig) *config.Add
 }
 
 func (c *Client) extractPKGKeys(conn typesocket.Conn, v coordinator.PKGRound) {
-	c.mu.Lock()
-	st, ok := c.addFriendRounds[v.Round]
-	c.mu.Unlock()
-	if !ok {
-		c.Handler.Error(errors.New("extractPKGKeys: round %d not configured", v.Round))
+	st := c.addFriendRoundState(v.Round)
+	if st == nil {
 		return
 	}
 
@@ -153,17 +211,22 @@ func (c *Client) extractPKGKeys(conn typesocket.Conn, v coordinator.PKGRound) {
 		return
 	}
 
-	numPKGs := len(st.Config.PKGServers)
-	pkgKeys := make([]ed25519.PublicKey, numPKGs)
+	pkgKeys := make([]ed25519.PublicKey, len(st.Config.PKGServers))
 	for i := range pkgKeys {
 		pkgKeys[i] = st.Config.PKGServers[i].Key
 	}
-	if !v.PKGSettings.Verify(v.Round, pkgKeys) {
+	if !v.PKGSettings.VerifyQuorum(v.Round, pkgKeys, st.Config.PKGQuorum()) {
 		err := errors.New("round %d: failed to verify PKG settings", v.Round)
 		c.Handler.Error(err)
+		c.recordExtract(v.Round, false, 0)
 		return
 	}
 
+	// Friend requests in this round are encrypted to the PKGs that took
+	// part in the round, so we need a private key from each of them.
+	st.PKGServers = v.PKGSettings.Quorum(st.Config.PKGServers)
+	numPKGs := len(st.PKGServers)
+
 	st.ServerMasterKeys = make([]*ibe.MasterPublicKey, numPKGs)
 	st.PrivateKeys = make([]*ibe.IdentityPrivateKey, numPKGs)
 	st.ServerBLSKeys = make([]*bls.PublicKey, numPKGs)
@@ -201,15 +264,16 @@ func (c *Client) extractPKGKeys(conn typesocket.Conn, v coordinator.PKGRound) {
 		return nil
 	}
 
+	start := time.Now()
 	errs := make(chan error, 1)
-	for i, pkgServer := range st.Config.PKGServers {
+	for i, pkgServer := range st.PKGServers {
 		go func(i int, srv pkg.PublicServerConfig) {
 			errs <- extractFn(i, srv)
 		}(i, pkgServer)
 	}
 
 	hasErr := false
-	for range st.Config.PKGServers {
+	for range st.PKGServers {
 		err := <-errs
 		if err != nil {
 			hasErr = true
@@ -219,16 +283,14 @@ func (c *Client) extractPKGKeys(conn typesocket.Conn, v coordinator.PKGRound) {
 	if !hasErr {
 		st.ExtractSuccess = true
 	}
+	c.recordExtract(v.Round, st.ExtractSuccess, time.Since(start))
 }
 
 func (c *Client) sendAddFriendOnion(conn typesocket.Conn, v coordinator.MixRound) {
 	round := v.MixSettings.Round
 
-	c.mu.Lock()
-	st, ok := c.addFriendRounds[round]
-	c.mu.Unlock()
-	if !ok {
-		c.Handler.Error(errors.New("sendAddFriendOnion: round %d not configured", round))
+	st := c.addFriendRoundState(round)
+	if st == nil {
 		return
 	}
 
@@ -259,10 +321,24 @@ func (c *Client) sendAddFriendOnion(conn typesocket.Conn, v coordinator.MixRound
 	}
 
 	outgoingReq := c.nextOutgoingFriendRequest()
-	intro, sentReq := c.genIntro(st, outgoingReq)
+	recipient := outgoingReq.Username
+
+	var intro *introduction
+	var sentReq *sentFriendRequest
+	if recipient == "" {
+		// Use idle rounds to tell the user's other devices
+		// about friend requests sent by this device.
+		if sync := c.nextDeviceSync(); sync != nil {
+			intro = c.genSyncIntro(st, sync)
+			recipient = c.Username
+		}
+	}
+	if intro == nil {
+		intro, sentReq = c.genIntro(st, outgoingReq)
+	}
 
 	var isReal int // 1 if real, 0 if cover
-	if sentReq.Username != "" {
+	if recipient != "" {
 		isReal = 1
 	} else {
 		isReal = 0
@@ -270,12 +346,12 @@ func (c *Client) sendAddFriendOnion(conn typesocket.Conn, v coordinator.MixRound
 
 	masterKey := new(ibe.MasterPublicKey).Aggregate(st.ServerMasterKeys...)
 	// Unsafe because "" is not a valid username, but this reduces timing leak:
-	id := pkg.ValidUsernameToIdentity(sentReq.Username)
+	id := pkg.ValidUsernameToIdentity(recipient)
 	encIntro := ibe.Encrypt(rand.Reader, masterKey, id[:], mustMarshal(intro))
 	encIntroBytes := mustMarshal(encIntro)
 
 	mixMessage := new(addfriend.MixMessage)
-	mixMessage.Mailbox = usernameToMailbox(sentReq.Username, serviceData.NumMailboxes)
+	mixMessage.Mailbox = usernameToMailbox(recipient, serviceData.NumMailboxes)
 	subtle.ConstantTimeCopy(isReal, mixMessage.EncryptedIntro[:], encIntroBytes)
 
 	onion, _ := onionbox.Seal(mustMarshal(mixMessage), mixnet.ForwardNonce(round), v.MixSettings.OnionKeys)
@@ -285,16 +361,29 @@ func (c *Client) sendAddFriendOnion(conn typesocket.Conn, v coordinator.MixRound
 		Onion: onion,
 	}
 	conn.Send("onion", omsg)
+	c.recordOnion("AddFriend", round, recipient != "")
 
-	if sentReq.Username != "" {
+	if sentReq != nil && sentReq.Username != "" {
 		c.Handler.SentFriendRequest(outgoingReq)
+		c.queueDeviceSync(sentReq)
 		inReq := c.matchToIncoming(sentReq)
-		if inReq != nil {
+		var changed *Friend
+		if inReq != nil && !sentReq.Confirmation {
+			// Confirmations are sent in response to approved
+			// requests, so the key change was already accepted.
+			changed = c.keyChanged(inReq, sentReq)
+		}
+		if inReq != nil && !unexpectedKey(inReq, sentReq) && changed == nil {
 			c.newFriend(inReq, sentReq)
 		} else {
 			c.mu.Lock()
 			c.sentFriendRequests = append(c.sentFriendRequests, sentReq)
 			c.mu.Unlock()
+			if inReq != nil && changed != nil {
+				c.friendKeyChanged(changed, inReq, outgoingReq)
+			} else if inReq != nil {
+				c.Handler.UnexpectedSigningKey(inReq, outgoingReq)
+			}
 		}
 	}
 
@@ -325,6 +414,10 @@ func (c *Client) nextOutgoingFriendRequest() *OutgoingFriendRequest {
 // The resulting introduction is the "public" part, and the
 // sentFriendRequest is the private part.
 func (c *Client) genIntro(st *addFriendRoundState, out *OutgoingFriendRequest) (*introduction, *sentFriendRequest) {
+	dialRound := out.DialRound
+	if !out.Confirmation {
+		dialRound = atomic.LoadUint32(&c.lastDialingRound)
+	}
 	dhPublic, dhPrivate, err := box.GenerateKey(rand.Reader)
 	if err != nil {
 		panic("box.GenerateKey: " + err.Error())
@@ -334,18 +427,15 @@ func (c *Client) genIntro(st *addFriendRoundState, out *OutgoingFriendRequest) (
 		Username:     out.Username,
 		ExpectedKey:  out.ExpectedKey,
 		Confirmation: out.Confirmation,
-		DialRound:    out.DialRound,
+		DialRound:    dialRound,
 
 		SentRound:    st.Round,
 		DHPublicKey:  dhPublic,
 		DHPrivateKey: dhPrivate,
+		Sent:         time.Now(),
 
 		client: c,
 	}
-	if !sent.Confirmation {
-		sent.DialRound = atomic.LoadUint32(&c.lastDialingRound)
-	}
-
 	intro := new(introduction)
 	id := pkg.ValidUsernameToIdentity(c.Username)
 	copy(intro.Username[:], id[:])
@@ -367,14 +457,16 @@ func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
 	c.mu.Lock()
 	st, ok := c.addFriendRounds[v.Round]
 	c.mu.Unlock()
-	if !ok {
+	if !ok || !st.isAnnounced() {
 		//err := errors.New("scanMailbox: round %d not found", v.Round)
 		//c.Handler.Error(err)
 		return
 	}
 
 	mailboxID := usernameToMailbox(c.Username, v.NumMailboxes)
+	start := time.Now()
 	mailbox, err := c.fetchMailbox(st.Config.CDNServer, v.URL, mailboxID)
+	c.recordFetch("AddFriend", v.Round, len(mailbox), time.Since(start), err)
 	if err != nil {
 		c.Handler.Error(errors.Wrap(err, "fetching mailbox"))
 		return
@@ -391,6 +483,7 @@ func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
 		return
 	}
 	privKey := new(ibe.IdentityPrivateKey).Aggregate(st.PrivateKeys...)
+	syncTag := st.SyncTag
 	st.mu.Unlock()
 
 	intros := concurrency.Spans(len(mailbox), addfriend.SizeEncryptedIntro)
@@ -410,7 +503,7 @@ func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
 				continue
 			}
 
-			c.decodeAddFriendMessage(msg, st.Config.PKGServers, st.ServerBLSKeys)
+			c.decodeAddFriendMessage(st.Round, msg, st.PKGServers, st.ServerBLSKeys, syncTag)
 		}
 	})
 
@@ -420,38 +513,109 @@ func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
 	}
 }
 
-func (c *Client) decodeAddFriendMessage(msg []byte, verifiers []pkg.PublicServerConfig, multisigKeys []*bls.PublicKey) {
+func (c *Client) decodeAddFriendMessage(round uint32, msg []byte, verifiers []pkg.PublicServerConfig, multisigKeys []*bls.PublicKey, syncTag *[16]byte) {
 	intro := new(introduction)
 	if err := intro.UnmarshalBinary(msg); err != nil {
 		return
 	}
 
+	username := pkg.IdentityToUsername(&intro.Username)
+	if username == c.Username {
+		// Intros from the user's own username are sent by linked devices.
+		if intro.VerifySync(c.LongTermPublicKey) {
+			c.handleDeviceSync(intro, round, syncTag)
+		}
+		return
+	}
+
 	if !intro.Verify(multisigKeys) {
 		log.Warnf("failed to verify intro: %s", intro.Username)
 		return
 	}
-
-	username := pkg.IdentityToUsername(&intro.Username)
 	req := &IncomingFriendRequest{
 		Username:    username,
 		LongTermKey: intro.LongTermKey[:],
 		DHPublicKey: &intro.DHPublicKey,
 		DialRound:   intro.DialingRound,
 		Verifiers:   verifiers,
-		client:      c,
+
+		Received:      time.Now(),
+		ReceivedRound: round,
+
+		client: c,
 	}
 
 	sentReq := c.matchToSent(req)
-	if sentReq != nil {
-		c.newFriend(req, sentReq)
-	} else {
+	if sentReq == nil {
+		sentReq = c.matchDeviceSync(req)
+	}
+	if sentReq != nil && unexpectedKey(req, sentReq) {
 		c.mu.Lock()
 		c.incomingFriendRequests = append(c.incomingFriendRequests, req)
 		c.mu.Unlock()
+		// Leave both requests pending until the application
+		// approves or rejects the incoming request.
+		c.Handler.UnexpectedSigningKey(req, sentReq.outgoing())
+		return
+	}
+
+	changed := c.keyChanged(req, sentReq)
+	if sentReq != nil && changed == nil {
+		c.newFriend(req, sentReq)
+		return
+	}
+
+	c.mu.Lock()
+	c.incomingFriendRequests = append(c.incomingFriendRequests, req)
+	c.mu.Unlock()
+	if changed != nil {
+		c.friendKeyChanged(changed, req, nil)
+	} else {
 		c.Handler.ReceivedFriendRequest(req)
 	}
 }
 
+// friendKeyChanged reports a friend's key change to the Handler. If the
+// Handler is not a FriendKeyChangeHandler, the incoming request is reported
+// like any other request: with UnexpectedSigningKey if the user sent the
+// outgoing request, and with ReceivedFriendRequest otherwise.
+func (c *Client) friendKeyChanged(friend *Friend, in *IncomingFriendRequest, out *OutgoingFriendRequest) {
+	if h, ok := c.Handler.(FriendKeyChangeHandler); ok {
+		h.FriendKeyChanged(friend, in)
+	} else if out != nil {
+		c.Handler.UnexpectedSigningKey(in, out)
+	} else {
+		c.Handler.ReceivedFriendRequest(in)
+	}
+}
+
+// keyChanged returns the existing friend for the incoming request if the
+// request is signed by a different key than the friend's pinned key, or nil
+// otherwise. A sent request that explicitly expects the new key counts as
+// accepting the change.
+func (c *Client) keyChanged(in *IncomingFriendRequest, sent *sentFriendRequest) *Friend {
+	if sent != nil && len(sent.ExpectedKey) > 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	friend := c.friends[in.Username]
+	c.mu.Unlock()
+	if friend == nil || bytes.Equal(friend.LongTermKey, in.LongTermKey) {
+		return nil
+	}
+	return friend
+}
+
+// unexpectedKey reports whether the incoming request is signed by a
+// different long-term key than the one expected by the sent request.
+func unexpectedKey(in *IncomingFriendRequest, sent *sentFriendRequest) bool {
+	if len(sent.ExpectedKey) == 0 {
+		return false
+	}
+	return !bytes.Equal(sent.ExpectedKey, in.LongTermKey)
+}
+
 func (c *Client) matchToIncoming(sentReq *sentFriendRequest) *IncomingFriendRequest {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -480,6 +644,7 @@ func (c *Client) newFriend(in *IncomingFriendRequest, sent *sentFriendRequest) {
 	sharedKey := new([32]byte)
 	box.Precompute(sharedKey, in.DHPublicKey, sent.DHPrivateKey)
 	c.wheel.Put(in.Username, in.DialRound, sharedKey)
+	*sent.DHPrivateKey = [32]byte{}
 
 	friend := &Friend{
 		Username:    in.Username,
@@ -489,6 +654,23 @@ func (c *Client) newFriend(in *IncomingFriendRequest, sent *sentFriendRequest) {
 	}
 
 	c.mu.Lock()
+	record := KeyRecord{Key: in.LongTermKey, Confirmed: time.Now()}
+	if old := c.friends[in.Username]; old != nil {
+		history := append([]KeyRecord(nil), old.keyHistory...)
+		if len(history) == 0 {
+			history = []KeyRecord{{Key: old.LongTermKey}}
+		}
+		if bytes.Equal(old.LongTermKey, in.LongTermKey) {
+			// Same key: keep the original confirmation time
+			// and verification status.
+			record = history[len(history)-1]
+			history = history[:len(history)-1]
+			friend.verified = old.verified
+		}
+		friend.keyHistory = append(history, record)
+	} else {
+		friend.keyHistory = []KeyRecord{record}
+	}
 	c.friends[in.Username] = friend
 
 	// delete the friend requests from the in/sent queues (slice tricks)
@@ -6,6 +6,7 @@ package alpenhorn
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"io/ioutil"
 	"net"
@@ -13,6 +14,8 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,52 +31,103 @@ import (
 	"vuvuzela.io/internal/mock"
 )
 
-type chanHandler struct {
-	errPrefix string
+// testEvents lets tests wait for a specific kind of event from a client's
+// EventStream. Events of other kinds are set aside for later.
+type testEvents struct {
+	name    string
+	stream  *EventStream
+	pending []Event
+}
+
+var (
+	clientEventsMu sync.Mutex
+	clientEvents   = make(map[*Client]*testEvents)
+)
+
+func watchEvents(c *Client, name string) {
+	clientEventsMu.Lock()
+	clientEvents[c] = &testEvents{
+		name:   name,
+		stream: c.Events(64),
+	}
+	clientEventsMu.Unlock()
+}
 
-	confirmedFriend       chan *Friend
-	sentFriendRequest     chan *OutgoingFriendRequest
-	receivedFriendRequest chan *IncomingFriendRequest
-	sentCall              chan *OutgoingCall
-	receivedCall          chan *IncomingCall
-	newConfig             chan []*config.SignedConfig
+func events(c *Client) *testEvents {
+	clientEventsMu.Lock()
+	e := clientEvents[c]
+	clientEventsMu.Unlock()
+	return e
 }
 
-func newChanHandler(errPrefix string) *chanHandler {
-	return &chanHandler{
-		errPrefix:             errPrefix,
-		confirmedFriend:       make(chan *Friend, 1),
-		sentFriendRequest:     make(chan *OutgoingFriendRequest, 1),
-		receivedFriendRequest: make(chan *IncomingFriendRequest, 1),
-		sentCall:              make(chan *OutgoingCall, 1),
-		receivedCall:          make(chan *IncomingCall, 1),
-		newConfig:             make(chan []*config.SignedConfig, 1),
+func (e *testEvents) next(match func(Event) bool) Event {
+	for i, ev := range e.pending {
+		if match(ev) {
+			e.pending = append(e.pending[:i], e.pending[i+1:]...)
+			return ev
+		}
 	}
+	for ev := range e.stream.C {
+		switch ev := ev.(type) {
+		case *ErrorEvent:
+			log.Errorf(e.name+": client error: %s", ev.Err)
+			continue
+		case *ConnectionStateEvent:
+			if ev.Err != nil {
+				log.Infof(e.name+": %s %s: %s", ev.Service, ev.State, ev.Err)
+			}
+			continue
+		case *OverflowEvent:
+			log.Fatalf("%s: dropped %d events", e.name, ev.Dropped)
+		case *FriendRequestExpiredEvent:
+			log.Fatalf("%s: unexpected friend request expiry", e.name)
+		}
+		if match(ev) {
+			return ev
+		}
+		e.pending = append(e.pending, ev)
+	}
+	panic("unreachable")
 }
 
-func (h *chanHandler) Error(err error) {
-	log.Errorf(h.errPrefix+": client error: %s", err)
+func nextConfirmedFriend(c *Client) *Friend {
+	ev := events(c).next(func(ev Event) bool { _, ok := ev.(*ConfirmedFriendEvent); return ok })
+	return ev.(*ConfirmedFriendEvent).Friend
 }
-func (h *chanHandler) ConfirmedFriend(f *Friend) {
-	h.confirmedFriend <- f
+
+func nextSentFriendRequest(c *Client) *OutgoingFriendRequest {
+	ev := events(c).next(func(ev Event) bool { _, ok := ev.(*SentFriendRequestEvent); return ok })
+	return ev.(*SentFriendRequestEvent).Request
 }
-func (h *chanHandler) SentFriendRequest(r *OutgoingFriendRequest) {
-	h.sentFriendRequest <- r
+
+func nextReceivedFriendRequest(c *Client) *IncomingFriendRequest {
+	ev := events(c).next(func(ev Event) bool { _, ok := ev.(*ReceivedFriendRequestEvent); return ok })
+	return ev.(*ReceivedFriendRequestEvent).Request
 }
-func (h *chanHandler) ReceivedFriendRequest(r *IncomingFriendRequest) {
-	h.receivedFriendRequest <- r
+
+func nextSentCall(c *Client) *OutgoingCall {
+	ev := events(c).next(func(ev Event) bool { _, ok := ev.(*SendingCallEvent); return ok })
+	return ev.(*SendingCallEvent).Call
 }
-func (h *chanHandler) SendingCall(call *OutgoingCall) {
-	h.sentCall <- call
+
+func nextReceivedCall(c *Client) *IncomingCall {
+	ev := events(c).next(func(ev Event) bool { _, ok := ev.(*ReceivedCallEvent); return ok })
+	return ev.(*ReceivedCallEvent).Call
 }
-func (h *chanHandler) ReceivedCall(call *IncomingCall) {
-	h.receivedCall <- call
+
+func nextNewConfig(c *Client) []*config.SignedConfig {
+	ev := events(c).next(func(ev Event) bool { _, ok := ev.(*NewConfigEvent); return ok })
+	return ev.(*NewConfigEvent).Chain
 }
-func (h *chanHandler) NewConfig(configs []*config.SignedConfig) {
-	h.newConfig <- configs
+
+func nextUnexpectedSigningKey(c *Client) *UnexpectedSigningKeyEvent {
+	ev := events(c).next(func(ev Event) bool { _, ok := ev.(*UnexpectedSigningKeyEvent); return ok })
+	return ev.(*UnexpectedSigningKeyEvent)
 }
-func (h *chanHandler) UnexpectedSigningKey(in *IncomingFriendRequest, out *OutgoingFriendRequest) {
-	log.Fatalf("unexpected signing key for %s", in.Username)
+
+func nextFriendKeyChanged(c *Client) *FriendKeyChangedEvent {
+	ev := events(c).next(func(ev Event) bool { _, ok := ev.(*FriendKeyChangedEvent); return ok })
+	return ev.(*FriendKeyChangedEvent)
 }
 
 func (u *universe) newUser(username string) *Client {
@@ -84,8 +138,6 @@ func (u *universe) newUser(username string) *Client {
 		pkgAddrs[i] = pkgServer.Address
 	}
 
-	h := newChanHandler(username)
-
 	userPub, userPriv, _ := ed25519.GenerateKey(rand.Reader)
 	client := &Client{
 		Username:           username,
@@ -94,9 +146,9 @@ func (u *universe) newUser(username string) *Client {
 		PKGLoginKey:        userPriv,
 
 		ConfigClient: u.ConfigClient,
-
-		Handler: h,
 	}
+	watchEvents(client, username)
+
 	err := client.Bootstrap(
 		u.CurrentConfig("AddFriend"),
 		u.CurrentConfig("Dialing"),
@@ -124,6 +176,7 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	}()
 
 	alice := u.newUser("alice@example.org")
+	alice.Store = new(MemoryStore)
 	bob := u.newUser("bob@example.org")
 	bob.ClientPersistPath = filepath.Join(u.Dir, "bob-client")
 	bob.KeywheelPersistPath = filepath.Join(u.Dir, "bob-keywheel")
@@ -156,10 +209,10 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	<-alice.Handler.(*chanHandler).sentFriendRequest
+	nextSentFriendRequest(alice)
 	log.Infof("Alice: sent friend request")
 
-	friendRequest := <-bob.Handler.(*chanHandler).receivedFriendRequest
+	friendRequest := nextReceivedFriendRequest(bob)
 	currentConfig := u.CurrentConfig("AddFriend").Inner.(*config.AddFriendConfig)
 	if !reflect.DeepEqual(currentConfig.PKGServers, friendRequest.Verifiers) {
 		t.Fatalf("unexpected verifiers list in friend request:\ngot:  %s\nwant: %s",
@@ -169,16 +222,16 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	<-bob.Handler.(*chanHandler).sentFriendRequest
+	nextSentFriendRequest(bob)
 	log.Infof("Bob: approved friend request")
 
-	aliceConfirmedFriend := <-alice.Handler.(*chanHandler).confirmedFriend
+	aliceConfirmedFriend := nextConfirmedFriend(alice)
 	if aliceConfirmedFriend.Username != bob.Username {
 		t.Fatalf("made friends with unexpected username: %s", aliceConfirmedFriend.Username)
 	}
 	log.Infof("Alice: confirmed friend")
 
-	bobConfirmedFriend := <-bob.Handler.(*chanHandler).confirmedFriend
+	bobConfirmedFriend := nextConfirmedFriend(bob)
 	if bobConfirmedFriend.Username != alice.Username {
 		t.Fatalf("made friends with unexpected username: %s", bobConfirmedFriend.Username)
 	}
@@ -190,10 +243,10 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	}
 
 	friend.Call(0)
-	outCall := <-alice.Handler.(*chanHandler).sentCall
+	outCall := nextSentCall(alice)
 	log.Infof("Alice: called Bob")
 
-	inCall := <-bob.Handler.(*chanHandler).receivedCall
+	inCall := nextReceivedCall(bob)
 	if inCall.Username != alice.Username {
 		t.Fatalf("received call from unexpected username: %s", inCall.Username)
 	}
@@ -218,27 +271,21 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 		t.Fatal(err)
 	}
 	bob2.ConfigClient = u.ConfigClient
-	bob2.Handler = newChanHandler("bob2")
+	watchEvents(bob2, "bob2")
 
-	_, err = bob2.ConnectAddFriend()
-	if err != nil {
+	if err := bob2.Connect(); err != nil {
 		t.Fatal(err)
 	}
-	defer bob2.CloseAddFriend()
-	_, err = bob2.ConnectDialing()
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer bob2.CloseDialing()
+	defer bob2.Close()
 
 	friend = bob2.GetFriend(alice.Username)
 	friend.Call(0)
-	outCall = <-bob2.Handler.(*chanHandler).sentCall
+	outCall = nextSentCall(bob2)
 	if outCall.Username != alice.Username {
 		t.Fatalf("bad username in call: got %q, want %q", outCall.Username, alice.Username)
 	}
 
-	inCall = <-alice.Handler.(*chanHandler).receivedCall
+	inCall = nextReceivedCall(alice)
 	if inCall.Username != bob2.Username {
 		t.Fatalf("received call from unexpected username: %s", inCall.Username)
 	}
@@ -276,11 +323,11 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	}
 	log.Infof("Uploaded new addfriend config")
 
-	confs := <-bob2.Handler.(*chanHandler).newConfig
+	confs := nextNewConfig(bob2)
 	if confs[0].Hash() != newAddFriendConfig.Hash() {
 		t.Fatalf("received unexpected config: %s", debug.Pretty(confs))
 	}
-	confs = <-alice.Handler.(*chanHandler).newConfig
+	confs = nextNewConfig(alice)
 	if confs[0].Hash() != newAddFriendConfig.Hash() {
 		t.Fatalf("received unexpected config: %s", debug.Pretty(confs))
 	}
@@ -296,9 +343,9 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	<-bob2.Handler.(*chanHandler).sentFriendRequest
+	nextSentFriendRequest(bob2)
 
-	friendRequest = <-alice.Handler.(*chanHandler).receivedFriendRequest
+	friendRequest = nextReceivedFriendRequest(alice)
 	// No guarantee that Verifiers will be in the same order but it works for now:
 	if !reflect.DeepEqual(friendRequest.Verifiers, newAddFriendConfig.Inner.(*config.AddFriendConfig).PKGServers) {
 		t.Fatalf("unexpected verifiers:\ngot:  %s\nwant: %s", debug.Pretty(friendRequest.Verifiers), debug.Pretty(newAddFriendConfig.Inner.(*config.AddFriendConfig).PKGServers))
@@ -309,18 +356,18 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	<-alice.Handler.(*chanHandler).sentFriendRequest
-	<-alice.Handler.(*chanHandler).confirmedFriend
+	nextSentFriendRequest(alice)
+	nextConfirmedFriend(alice)
 
-	friend = <-bob2.Handler.(*chanHandler).confirmedFriend
+	friend = nextConfirmedFriend(bob2)
 	friend.Call(1)
-	outCall = <-bob2.Handler.(*chanHandler).sentCall
+	outCall = nextSentCall(bob2)
 	if outCall.Intent() != 1 {
 		t.Fatalf("wrong intent: got %d, want %d", outCall.Intent(), 1)
 	}
 	log.Infof("Bob: confirmed friend; calling with intent 1")
 
-	inCall = <-alice.Handler.(*chanHandler).receivedCall
+	inCall = nextReceivedCall(alice)
 	if inCall.Intent != 1 {
 		t.Fatalf("wrong intent: got %d, want %d", inCall.Intent, 1)
 	}
@@ -352,11 +399,11 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	}
 	log.Infof("Uploaded new addfriend config")
 
-	confs = <-bob2.Handler.(*chanHandler).newConfig
+	confs = nextNewConfig(bob2)
 	if confs[0].Hash() != newAddFriendConfig.Hash() {
 		t.Fatalf("received unexpected config: %s", debug.Pretty(confs))
 	}
-	confs = <-alice.Handler.(*chanHandler).newConfig
+	confs = nextNewConfig(alice)
 	if confs[0].Hash() != newAddFriendConfig.Hash() {
 		t.Fatalf("received unexpected config: %s", debug.Pretty(confs))
 	}
@@ -365,20 +412,20 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	<-bob2.Handler.(*chanHandler).sentFriendRequest
+	nextSentFriendRequest(bob2)
 	log.Infof("Bob: sent friend request to Alice")
 
-	friendRequest = <-alice.Handler.(*chanHandler).receivedFriendRequest
+	friendRequest = nextReceivedFriendRequest(alice)
 	log.Infof("Alice: got friend request from %s", friendRequest.Username)
 
 	_, err = friendRequest.Approve()
 	if err != nil {
 		t.Fatal(err)
 	}
-	<-alice.Handler.(*chanHandler).sentFriendRequest
-	<-alice.Handler.(*chanHandler).confirmedFriend
+	nextSentFriendRequest(alice)
+	nextConfirmedFriend(alice)
 
-	friend = <-bob2.Handler.(*chanHandler).confirmedFriend
+	friend = nextConfirmedFriend(bob2)
 	log.Infof("Bob: confirmed friend")
 
 	// Add more servers to the dialing mixchain.
@@ -403,24 +450,24 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	}
 	log.Infof("Uploaded new dialing config")
 
-	confs = <-bob2.Handler.(*chanHandler).newConfig
+	confs = nextNewConfig(bob2)
 	if confs[0].Hash() != newDialingConfig.Hash() {
 		t.Fatalf("received unexpected config: %s", debug.Pretty(confs))
 	}
-	confs = <-alice.Handler.(*chanHandler).newConfig
+	confs = nextNewConfig(alice)
 	if confs[0].Hash() != newDialingConfig.Hash() {
 		t.Fatalf("received unexpected config: %s", debug.Pretty(confs))
 	}
 
 	friend = alice.GetFriend(bob2.Username)
 	friend.Call(2)
-	outCall = <-alice.Handler.(*chanHandler).sentCall
+	outCall = nextSentCall(alice)
 	if outCall.Intent() != 2 {
 		t.Fatalf("wrong intent: got %d, want %d", outCall.Intent(), 2)
 	}
 	log.Infof("Alice: calling Bob with intent 2")
 
-	inCall = <-bob2.Handler.(*chanHandler).receivedCall
+	inCall = nextReceivedCall(bob2)
 	if inCall.Intent != 2 {
 		t.Fatalf("wrong intent: got %d, want %d", inCall.Intent, 2)
 	}
@@ -429,6 +476,586 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	if !bytes.Equal(outCall.SessionKey()[:], inCall.SessionKey[:]) {
 		t.Fatal("Alice and Bob agreed on different keys!")
 	}
+
+	intents := []string{"voice", "video", "file", "callback"}
+	if err := alice.SetIntents(intents); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test persistence to a custom store.
+	alice2, err := LoadClientFromStore(alice.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(alice2.Intents(), intents) {
+		t.Fatalf("alice2 intents: got %v, want %v", alice2.Intents(), intents)
+	}
+	if alice2.GetFriend(bob2.Username) == nil {
+		t.Fatalf("alice2 lost friend %q", bob2.Username)
+	}
+	if alice2.dialingConfigHash != newDialingConfig.Hash() {
+		t.Fatalf("alice2 has stale dialing config")
+	}
+
+	// Intents past the default ones are detected once the callee
+	// supports them too.
+	if err := bob2.SetIntents(intents); err != nil {
+		t.Fatal(err)
+	}
+	friend.Call(3)
+	outCall = nextSentCall(alice)
+	if outCall.Intent() != 3 {
+		t.Fatalf("wrong intent: got %d, want %d", outCall.Intent(), 3)
+	}
+	log.Infof("Alice: calling Bob with intent 3 (%s)", alice.IntentName(3))
+
+	inCall = nextReceivedCall(bob2)
+	if inCall.Intent != 3 {
+		t.Fatalf("wrong intent: got %d, want %d", inCall.Intent, 3)
+	}
+	if name := bob2.IntentName(inCall.Intent); name != "callback" {
+		t.Fatalf("wrong intent name: got %q, want %q", name, "callback")
+	}
+	log.Infof("Bob: received call with intent 3")
+
+	if !bytes.Equal(outCall.SessionKey()[:], inCall.SessionKey[:]) {
+		t.Fatal("Alice and Bob agreed on different keys!")
+	}
+}
+
+func TestUnexpectedSigningKey(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+	chris := u.newUser("chris@example.org")
+	for _, c := range []*Client{alice, bob, chris} {
+		if err := c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	time.Sleep(2 * time.Second)
+
+	wrongKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	// Alice expects the wrong key for Bob and approves it anyway.
+	_, err := alice.SendFriendRequest(bob.Username, wrongKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(alice)
+
+	friendRequest := nextReceivedFriendRequest(bob)
+	if _, err := friendRequest.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(bob)
+	nextConfirmedFriend(bob)
+	log.Infof("Bob: approved friend request")
+
+	mismatch := nextUnexpectedSigningKey(alice)
+	if !bytes.Equal(mismatch.Incoming.LongTermKey, bob.LongTermPublicKey) {
+		t.Fatalf("unexpected long-term key: got %x, want %x", mismatch.Incoming.LongTermKey, bob.LongTermPublicKey)
+	}
+	if !bytes.Equal(mismatch.Outgoing.ExpectedKey, wrongKey) {
+		t.Fatalf("unexpected expected key: got %x, want %x", mismatch.Outgoing.ExpectedKey, wrongKey)
+	}
+	if alice.GetFriend(bob.Username) != nil {
+		t.Fatal("friend confirmed despite unexpected signing key")
+	}
+	if n := len(alice.GetIncomingFriendRequests()); n != 1 {
+		t.Fatalf("expected 1 pending incoming request, got %d", n)
+	}
+	if n := len(alice.GetSentFriendRequests()); n != 1 {
+		t.Fatalf("expected 1 pending sent request, got %d", n)
+	}
+	log.Infof("Alice: detected unexpected signing key")
+
+	if _, err := mismatch.Incoming.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	friend := nextConfirmedFriend(alice)
+	if !bytes.Equal(friend.LongTermKey, bob.LongTermPublicKey) {
+		t.Fatalf("friend has wrong long-term key")
+	}
+	if len(alice.GetIncomingFriendRequests()) != 0 || len(alice.GetSentFriendRequests()) != 0 {
+		t.Fatal("friend requests still pending after approval")
+	}
+
+	friend.Call(0)
+	outCall := nextSentCall(alice)
+	inCall := nextReceivedCall(bob)
+	if !bytes.Equal(outCall.SessionKey()[:], inCall.SessionKey[:]) {
+		t.Fatal("Alice and Bob agreed on different keys!")
+	}
+	log.Infof("Alice: accepted Bob's key and called Bob")
+
+	// Alice expects the wrong key for Chris and rejects the response.
+	_, err = alice.SendFriendRequest(chris.Username, wrongKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(alice)
+
+	friendRequest = nextReceivedFriendRequest(chris)
+	if _, err := friendRequest.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(chris)
+	nextConfirmedFriend(chris)
+
+	mismatch = nextUnexpectedSigningKey(alice)
+	if err := mismatch.Incoming.Reject(); err != nil {
+		t.Fatal(err)
+	}
+	if alice.GetFriend(chris.Username) != nil {
+		t.Fatal("friend confirmed after rejecting unexpected signing key")
+	}
+	if len(alice.GetIncomingFriendRequests()) != 0 || len(alice.GetSentFriendRequests()) != 0 {
+		t.Fatal("friend requests still pending after rejection")
+	}
+	log.Infof("Alice: rejected Chris's key")
+
+	// Alice expects the right key for Chris.
+	_, err = alice.SendFriendRequest(chris.Username, chris.LongTermPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(alice)
+
+	friendRequest = nextReceivedFriendRequest(chris)
+	if _, err := friendRequest.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(chris)
+	nextConfirmedFriend(chris)
+
+	friend = nextConfirmedFriend(alice)
+	if friend.Username != chris.Username {
+		t.Fatalf("made friends with unexpected username: %s", friend.Username)
+	}
+	log.Infof("Alice: confirmed friend with expected key")
+}
+
+func TestFriendKeyChanged(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+	if err := alice.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := bob.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+
+	_, err := alice.SendFriendRequest(bob.Username, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(alice)
+	friendRequest := nextReceivedFriendRequest(bob)
+	if _, err := friendRequest.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(bob)
+	nextConfirmedFriend(bob)
+	nextConfirmedFriend(alice)
+	log.Infof("Alice and Bob are friends")
+
+	aliceSN := alice.GetFriend(bob.Username).SafetyNumber()
+	bobSN := bob.GetFriend(alice.Username).SafetyNumber()
+	if aliceSN != bobSN {
+		t.Fatalf("safety numbers differ: %s != %s", aliceSN, bobSN)
+	}
+	if err := alice.GetFriend(bob.Username).SetVerified(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob reinstalls with a new long-term key.
+	if err := bob.Close(); err != nil {
+		t.Fatal(err)
+	}
+	newPub, newPriv, _ := ed25519.GenerateKey(rand.Reader)
+	bob2 := &Client{
+		Username:           bob.Username,
+		LongTermPublicKey:  newPub,
+		LongTermPrivateKey: newPriv,
+		PKGLoginKey:        bob.PKGLoginKey,
+
+		ConfigClient: u.ConfigClient,
+	}
+	watchEvents(bob2, "bob2")
+	err = bob2.Bootstrap(
+		u.CurrentConfig("AddFriend"),
+		u.CurrentConfig("Dialing"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob2.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer bob2.Close()
+	time.Sleep(2 * time.Second)
+
+	_, err = bob2.SendFriendRequest(alice.Username, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(bob2)
+
+	change := nextFriendKeyChanged(alice)
+	if !bytes.Equal(change.Friend.LongTermKey, bob.LongTermPublicKey) {
+		t.Fatalf("unexpected old key: got %x, want %x", change.Friend.LongTermKey, bob.LongTermPublicKey)
+	}
+	if !bytes.Equal(change.Request.LongTermKey, newPub) {
+		t.Fatalf("unexpected new key: got %x, want %x", change.Request.LongTermKey, newPub)
+	}
+	friend := alice.GetFriend(bob.Username)
+	if !bytes.Equal(friend.LongTermKey, bob.LongTermPublicKey) {
+		t.Fatal("friend key replaced before approval")
+	}
+	if !friend.Verified() {
+		t.Fatal("friend unverified before approval")
+	}
+	round := atomic.LoadUint32(&alice.lastDialingRound) + 10
+	aliceKey := alice.wheel.SessionKey(bob.Username, round)
+	bobKey := bob.wheel.SessionKey(alice.Username, round)
+	if !bytes.Equal(aliceKey[:], bobKey[:]) {
+		t.Fatal("keywheel entry replaced before approval")
+	}
+	log.Infof("Alice: detected Bob's key change")
+
+	if _, err := change.Request.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(alice)
+	friend = nextConfirmedFriend(alice)
+	nextConfirmedFriend(bob2)
+
+	if !bytes.Equal(friend.LongTermKey, newPub) {
+		t.Fatal("friend key not updated after approval")
+	}
+	if friend.Verified() {
+		t.Fatal("friend still verified after key change")
+	}
+	if friend.SafetyNumber() == aliceSN {
+		t.Fatal("safety number unchanged after key change")
+	}
+	history := friend.KeyHistory()
+	if len(history) != 2 {
+		t.Fatalf("expected 2 keys in history, got %d", len(history))
+	}
+	if !bytes.Equal(history[0].Key, bob.LongTermPublicKey) || !bytes.Equal(history[1].Key, newPub) {
+		t.Fatalf("unexpected key history: %s", debug.Pretty(history))
+	}
+
+	friend.Call(0)
+	outCall := nextSentCall(alice)
+	inCall := nextReceivedCall(bob2)
+	if !bytes.Equal(outCall.SessionKey()[:], inCall.SessionKey[:]) {
+		t.Fatal("Alice and Bob agreed on different keys!")
+	}
+	log.Infof("Alice: accepted Bob's new key and called Bob")
+}
+
+// TestReconnectConfigChange checks that a client that reconnects after
+// the config changed uses the new config for the replayed round, even if
+// the replayed "pkg" and "mix" messages are handled before "newround".
+func TestReconnectConfigChange(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+	if err := alice.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	time.Sleep(2 * time.Second)
+
+	if err := alice.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lastRound := atomic.LoadUint32(&alice.lastAddFriendRound)
+
+	newPKG, err := mock.LaunchPKG(u.CoordinatorKey, func(username string, token string) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevAddFriendConfig := u.CurrentConfig("AddFriend")
+	prevAddFriendInner := prevAddFriendConfig.Inner.(*config.AddFriendConfig)
+	newAddFriendConfig := &config.SignedConfig{
+		Version:        config.SignedConfigVersion,
+		Created:        time.Now(),
+		Expires:        time.Now().Add(24 * time.Hour),
+		PrevConfigHash: prevAddFriendConfig.Hash(),
+
+		Service: "AddFriend",
+		Inner: &config.AddFriendConfig{
+			Version:     config.AddFriendConfigVersion,
+			Coordinator: prevAddFriendInner.Coordinator,
+			MixServers:  prevAddFriendInner.MixServers,
+			PKGServers:  append(prevAddFriendInner.PKGServers, newPKG.PublicServerConfig),
+			CDNServer:   prevAddFriendInner.CDNServer,
+		},
+	}
+	if err := u.ConfigClient.SetCurrentConfig(newAddFriendConfig); err != nil {
+		t.Fatal(err)
+	}
+	log.Infof("Uploaded new addfriend config while Alice is offline")
+
+	confs := nextNewConfig(bob)
+	if confs[0].Hash() != newAddFriendConfig.Hash() {
+		t.Fatalf("received unexpected config: %s", debug.Pretty(confs))
+	}
+
+	if err := alice.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	confs = nextNewConfig(alice)
+	if confs[0].Hash() != newAddFriendConfig.Hash() {
+		t.Fatalf("received unexpected config: %s", debug.Pretty(confs))
+	}
+	log.Infof("Alice: reconnected with the new addfriend config")
+
+	if err := alice.Register(newPKG.PublicServerConfig, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Register(newPKG.PublicServerConfig, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = bob.SendFriendRequest(alice.Username, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(bob)
+	friendRequest := nextReceivedFriendRequest(alice)
+	if _, err := friendRequest.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(alice)
+	nextConfirmedFriend(alice)
+	nextConfirmedFriend(bob)
+
+	// Every round Alice has seen since reconnecting uses the new config.
+	alice.mu.Lock()
+	for round, st := range alice.addFriendRounds {
+		if round <= lastRound || !st.isAnnounced() {
+			continue
+		}
+		if st.ConfigParent.Hash() != newAddFriendConfig.Hash() {
+			t.Errorf("round %d uses a stale config", round)
+		}
+	}
+	alice.mu.Unlock()
+}
+
+// TestPKGDown checks that friend requests complete when a PKG is down,
+// as long as the remaining PKGs meet the config's PKGThreshold.
+func TestPKGDown(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+	if err := alice.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := bob.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// Add a PKG that is not running, and let rounds proceed without it.
+	downKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	downPKG := pkg.PublicServerConfig{
+		Key:     downKey,
+		Address: "localhost:1",
+	}
+	prevAddFriendConfig := u.CurrentConfig("AddFriend")
+	prevAddFriendInner := prevAddFriendConfig.Inner.(*config.AddFriendConfig)
+	livePKGs := prevAddFriendInner.PKGServers
+	newAddFriendConfig := &config.SignedConfig{
+		Version:        config.SignedConfigVersion,
+		Created:        time.Now(),
+		Expires:        time.Now().Add(24 * time.Hour),
+		PrevConfigHash: prevAddFriendConfig.Hash(),
+
+		Service: "AddFriend",
+		Inner: &config.AddFriendConfig{
+			Version:      config.AddFriendConfigVersion,
+			Coordinator:  prevAddFriendInner.Coordinator,
+			MixServers:   prevAddFriendInner.MixServers,
+			PKGServers:   append(append([]pkg.PublicServerConfig{}, livePKGs...), downPKG),
+			CDNServer:    prevAddFriendInner.CDNServer,
+			PKGThreshold: len(livePKGs),
+		},
+	}
+	if err := u.ConfigClient.SetCurrentConfig(newAddFriendConfig); err != nil {
+		t.Fatal(err)
+	}
+	log.Infof("Uploaded new addfriend config with a PKG that is down")
+
+	for _, c := range []*Client{alice, bob} {
+		confs := nextNewConfig(c)
+		if confs[0].Hash() != newAddFriendConfig.Hash() {
+			t.Fatalf("received unexpected config: %s", debug.Pretty(confs))
+		}
+	}
+
+	_, err := alice.SendFriendRequest(bob.Username, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(alice)
+	friendRequest := nextReceivedFriendRequest(bob)
+	// The request is attested by the PKGs that took part in the round.
+	if !reflect.DeepEqual(friendRequest.Verifiers, livePKGs) {
+		t.Fatalf("unexpected verifiers:\ngot:  %s\nwant: %s", debug.Pretty(friendRequest.Verifiers), debug.Pretty(livePKGs))
+	}
+	log.Infof("Bob: received friend request without the PKG that is down")
+
+	if _, err := friendRequest.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(bob)
+	nextConfirmedFriend(bob)
+	nextConfirmedFriend(alice)
+
+	alice.GetFriend(bob.Username).Call(0)
+	outCall := nextSentCall(alice)
+	inCall := nextReceivedCall(bob)
+	if !bytes.Equal(outCall.SessionKey()[:], inCall.SessionKey[:]) {
+		t.Fatal("Alice and Bob agreed on different keys!")
+	}
+}
+
+func TestLinkedDevices(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+	chris := u.newUser("chris@example.org")
+
+	bundle, code, err := alice.LinkDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LinkClient(bundle, "wrong code"); err == nil {
+		t.Fatal("expected error linking with the wrong code")
+	}
+	alice2, err := LinkClient(bundle, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice2.ConfigClient = u.ConfigClient
+	watchEvents(alice2, "alice2")
+	alice2.Store = new(MemoryStore)
+	if err := alice2.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*Client{alice, alice2, bob, chris} {
+		if err := c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	time.Sleep(2 * time.Second)
+
+	// Bob's request reaches both of Alice's devices. Alice approves it on
+	// her first device, and her second device learns about the approval.
+	_, err = bob.SendFriendRequest(alice.Username, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(bob)
+
+	friendRequest := nextReceivedFriendRequest(alice)
+	nextReceivedFriendRequest(alice2)
+	if _, err := friendRequest.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(alice)
+	nextConfirmedFriend(alice)
+	nextConfirmedFriend(bob)
+	log.Infof("Alice: approved Bob's request on her first device")
+
+	friend := nextConfirmedFriend(alice2)
+	if friend.Username != bob.Username {
+		t.Fatalf("alice2 made friends with unexpected username: %s", friend.Username)
+	}
+	log.Infof("Alice: second device confirmed Bob")
+
+	bob.GetFriend(alice.Username).Call(0)
+	outCall := nextSentCall(bob)
+	for _, c := range []*Client{alice, alice2} {
+		inCall := nextReceivedCall(c)
+		if !bytes.Equal(outCall.SessionKey()[:], inCall.SessionKey[:]) {
+			t.Fatalf("%s: Alice and Bob agreed on different keys!", events(c).name)
+		}
+	}
+	log.Infof("Alice: both devices received Bob's call")
+
+	// Alice sends a request from her second device, and her first
+	// device completes the friendship when Chris confirms.
+	_, err = alice2.SendFriendRequest(chris.Username, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(alice2)
+
+	friendRequest = nextReceivedFriendRequest(chris)
+	if _, err := friendRequest.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	nextSentFriendRequest(chris)
+	nextConfirmedFriend(chris)
+	nextConfirmedFriend(alice2)
+
+	friend = nextConfirmedFriend(alice)
+	if friend.Username != chris.Username {
+		t.Fatalf("alice made friends with unexpected username: %s", friend.Username)
+	}
+	log.Infof("Alice: first device confirmed Chris")
+
+	friend.Call(1)
+	outCall = nextSentCall(alice)
+	inCall := nextReceivedCall(chris)
+	if !bytes.Equal(outCall.SessionKey()[:], inCall.SessionKey[:]) {
+		t.Fatal("Alice and Chris agreed on different keys!")
+	}
 }
 
 var logger = &log.Logger{
@@ -459,6 +1086,10 @@ type universe struct {
 }
 
 func (u *universe) Destroy() error {
+	// Stop the round loops before removing their persist files.
+	u.addFriendServer.Close()
+	u.dialingServer.Close()
+
 	// TODO close everything else
 	return os.RemoveAll(u.Dir)
 }
@@ -568,7 +1199,7 @@ func createAlpenhornUniverse() *universe {
 	if err := u.addFriendServer.LoadPersistedState(); err != nil {
 		log.Panicf("error loading persisted state: %s", err)
 	}
-	if err := u.addFriendServer.Run(); err != nil {
+	if err := u.addFriendServer.Run(context.Background()); err != nil {
 		log.Panicf("starting addfriend loop: %s", err)
 	}
 
@@ -618,7 +1249,7 @@ func createAlpenhornUniverse() *universe {
 	if err := u.dialingServer.LoadPersistedState(); err != nil {
 		log.Panicf("error loading persisted state: %s", err)
 	}
-	if err := u.dialingServer.Run(); err != nil {
+	if err := u.dialingServer.Run(context.Background()); err != nil {
 		log.Panicf("starting dialing loop: %s", err)
 	}
 
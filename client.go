@@ -8,7 +8,9 @@ package alpenhorn
 import (
 	"crypto/ed25519"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"vuvuzela.io/alpenhorn/config"
 	"vuvuzela.io/alpenhorn/edhttp"
@@ -22,7 +24,9 @@ import (
 //go:generate easyjson -output_filename client_json.go .
 
 // An EventHandler specifies how an application should react to
-// events in the Alpenhorn client.
+// events in the Alpenhorn client. Methods are called from the client's
+// connection goroutines. Applications that prefer to handle events from
+// a single goroutine can use Client.Events instead.
 type EventHandler interface {
 	// Error is called when the Alpenhorn client experiences an error.
 	Error(error)
@@ -42,7 +46,9 @@ type EventHandler interface {
 
 	// UnexpectedSigningKey is called when an incoming friend request corresponds
 	// to a friend request the user sent but has a different long term key than
-	// what the user specified.
+	// what the user specified. The friend is not confirmed; both requests stay
+	// pending until the application calls .Approve() or .Reject() on the
+	// IncomingFriendRequest.
 	UnexpectedSigningKey(*IncomingFriendRequest, *OutgoingFriendRequest)
 
 	// SendingCall is called when an OutgoingCall is about to be sent to the
@@ -58,6 +64,43 @@ type EventHandler interface {
 	NewConfig(chain []*config.SignedConfig)
 }
 
+// The following interfaces are optional extensions of EventHandler. The
+// client calls their methods if the Handler implements them, so existing
+// EventHandler implementations keep working. EventStream implements all
+// of them.
+
+// A FriendKeyChangeHandler is notified when a friend's key changes.
+type FriendKeyChangeHandler interface {
+	// FriendKeyChanged is called when an existing friend sends a friend
+	// request signed by a different long-term key than the friend's pinned
+	// key. The friend and its keywheel entry are unchanged until the
+	// application calls .Approve() on the IncomingFriendRequest, which
+	// accepts the new key. The old key is kept in Friend.KeyHistory.
+	//
+	// If the Handler does not implement FriendKeyChangeHandler, the request
+	// is reported by ReceivedFriendRequest, or by UnexpectedSigningKey if
+	// the user also sent a friend request to the friend.
+	FriendKeyChanged(*Friend, *IncomingFriendRequest)
+}
+
+// A ConnectionStateHandler is notified when the client's coordinator
+// connections change state.
+type ConnectionStateHandler interface {
+	// ConnectionStateChanged is called when a connection made by Connect
+	// changes state. The service is either "AddFriend" or "Dialing". The
+	// error explains why the connection was lost and is nil otherwise.
+	ConnectionStateChanged(service string, state ConnectionState, err error)
+}
+
+// A FriendRequestExpiryHandler is notified when friend requests expire.
+type FriendRequestExpiryHandler interface {
+	// FriendRequestExpired is called when a friend request expires before
+	// the add-friend protocol completes (see Client.FriendRequestExpiry).
+	// Exactly one of the arguments is non-nil: the incoming request, or
+	// the outgoing request, which may have already been sent.
+	FriendRequestExpired(*IncomingFriendRequest, *OutgoingFriendRequest)
+}
+
 type Client struct {
 	Username           string
 	LongTermPublicKey  ed25519.PublicKey
@@ -68,6 +111,36 @@ type Client struct {
 
 	Handler EventHandler
 
+	// Store is where the client persists its state and keywheel. If nil,
+	// the client uses a FileStore with ClientPersistPath and
+	// KeywheelPersistPath.
+	Store ClientStore
+
+	// StateKey, if non-nil, encrypts the client state before it is
+	// persisted. The keywheel is persisted separately and is not encrypted.
+	StateKey *StateKey
+
+	// PersistSizeClasses are the sizes, in increasing order, that the
+	// persisted client state and keywheel are padded to so that their
+	// sizes don't reveal how many friends or friend requests the client
+	// has. If nil, DefaultPersistSizeClasses is used.
+	PersistSizeClasses []int
+
+	// FriendRequestExpiry is how long incoming, queued, and sent friend
+	// requests are kept before they expire. If zero, friend requests do
+	// not expire based on time.
+	FriendRequestExpiry time.Duration
+
+	// FriendRequestExpiryRounds is how many add-friend rounds friend
+	// requests are kept before they expire. If zero, friend requests
+	// do not expire based on rounds.
+	FriendRequestExpiryRounds uint32
+
+	// RoundHistorySize is how many rounds per protocol the client keeps
+	// in its round history (see RoundHistory). If zero,
+	// DefaultRoundHistorySize is used.
+	RoundHistorySize int
+
 	// ClientPersistPath is where the client writes its state when it changes.
 	// If empty, the client does not persist state.
 	ClientPersistPath string
@@ -89,7 +162,10 @@ type Client struct {
 	initOnce     sync.Once
 	edhttpClient *edhttp.Client
 
-	lastDialingRound uint32 // updated atomically
+	lastDialingRound   uint32 // updated atomically
+	lastAddFriendRound uint32 // updated atomically
+
+	history roundHistory
 
 	// mu protects everything up to the end of the struct.
 	mu sync.Mutex
@@ -101,15 +177,25 @@ type Client struct {
 	dialingRounds     map[uint32]*dialingRoundState
 	dialingConfigHash string
 	dialingConfig     *config.SignedConfig
+	wheelAdvanced     bool // reset for each dialing connection
 
 	friends                map[string]*Friend
 	incomingFriendRequests []*IncomingFriendRequest
 	outgoingFriendRequests []*OutgoingFriendRequest
 	sentFriendRequests     []*sentFriendRequest
 	outgoingCalls          []*OutgoingCall
+	intents                []string
+
+	// deviceKey is shared by all of the user's linked devices (see LinkDevice).
+	deviceKey       *[32]byte
+	deviceSyncQueue []*deviceSync
+	deviceSyncTags  []*deviceSync
 
 	addFriendConn typesocket.Conn
 	dialingConn   typesocket.Conn
+
+	addFriendSupervisor *connSupervisor
+	dialingSupervisor   *connSupervisor
 }
 
 func (c *Client) init() {
@@ -143,6 +229,47 @@ func (c *Client) Register(server pkg.PublicServerConfig, token string) error {
 	return err
 }
 
+// Deregister removes the username from every PKG in the client's current
+// add-friend config. PKGs where the username is not registered are skipped.
+// Deregister tries every PKG even if some fail and returns an error that
+// lists the failures. After deregistering, the client can no longer
+// receive friend requests.
+//
+// Deregister leaves the client's local state untouched: friends, pending
+// friend requests, and the keywheel are kept, so the client can still
+// call its friends. To register again, call Register with a new token.
+func (c *Client) Deregister() error {
+	c.init()
+
+	pkgc := &pkg.Client{
+		Username:        c.Username,
+		LoginKey:        c.PKGLoginKey,
+		UserLongTermKey: c.LongTermPublicKey,
+		HTTPClient:      c.edhttpClient,
+	}
+	c.mu.Lock()
+	conf := c.addFriendConfig
+	c.mu.Unlock()
+	if conf == nil {
+		return errors.New("no addfriend config")
+	}
+
+	var failures []string
+	for _, pkgServer := range conf.Inner.(*config.AddFriendConfig).PKGServers {
+		err := pkgc.Deregister(pkgServer)
+		if pkgErr, ok := err.(pkg.Error); ok && pkgErr.Code == pkg.ErrNotRegistered {
+			continue
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", pkgServer.Address, err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New("failed to deregister from %d PKGs: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
 type PKGStatus struct {
 	Server pkg.PublicServerConfig
 	Error  error
@@ -185,14 +312,7 @@ func (c *Client) ConnectAddFriend() (chan error, error) {
 	c.mu.Unlock()
 
 	// Fetch the current config to get the coordinator's key and address.
-	addFriendConfig, err := c.ConfigClient.CurrentConfig("AddFriend")
-	if err != nil {
-		return nil, errors.Wrap(err, "fetching addfriend config")
-	}
-	addFriendInner := addFriendConfig.Inner.(*config.AddFriendConfig)
-
-	afwsAddr := fmt.Sprintf("wss://%s/addfriend/ws", addFriendInner.Coordinator.Address)
-	addFriendConn, err := typesocket.Dial(afwsAddr, addFriendInner.Coordinator.Key)
+	addFriendConn, err := c.dialCoordinator("AddFriend")
 	if err != nil {
 		return nil, err
 	}
@@ -223,20 +343,14 @@ func (c *Client) ConnectDialing() (chan error, error) {
 	}
 	c.mu.Unlock()
 
-	dialingConfig, err := c.ConfigClient.CurrentConfig("Dialing")
-	if err != nil {
-		return nil, errors.Wrap(err, "fetching dialing config")
-	}
-	dialingInner := dialingConfig.Inner.(*config.DialingConfig)
-
-	dwsAddr := fmt.Sprintf("wss://%s/dialing/ws", dialingInner.Coordinator.Address)
-	dialingConn, err := typesocket.Dial(dwsAddr, dialingInner.Coordinator.Key)
+	dialingConn, err := c.dialCoordinator("Dialing")
 	if err != nil {
 		return nil, err
 	}
 
 	c.mu.Lock()
 	c.dialingConn = dialingConn
+	c.wheelAdvanced = false
 	c.mu.Unlock()
 
 	disconnect := make(chan error, 1)
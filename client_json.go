@@ -81,6 +81,10 @@ func easyjsonDecodeSentFriendRequestC2eed687(in *jlexer.Lexer, out *sentFriendRe
 					copy((*out.DHPrivateKey)[:], in.BytesReadable())
 				}
 			}
+		case "Sent":
+			if data := in.Raw(); in.Ok() {
+				in.AddError((out.Sent).UnmarshalJSON(data))
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -145,6 +149,12 @@ func easyjsonEncodeSentFriendRequestC2eed687(out *jwriter.Writer, in sentFriendR
 	} else {
 		out.Base32Bytes((*in.DHPrivateKey)[:])
 	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Sent\":")
+	out.Raw((in.Sent).MarshalJSON())
 	out.RawByte('}')
 }
 
@@ -358,6 +368,105 @@ func easyjsonDecodePersistedStateC2eed687(in *jlexer.Lexer, out *persistedState)
 				}
 				in.Delim('}')
 			}
+		case "Intents":
+			if in.IsNull() {
+				in.Skip()
+				out.Intents = nil
+			} else {
+				in.Delim('[')
+				if out.Intents == nil {
+					if !in.IsDelim(']') {
+						out.Intents = make([]string, 0, 4)
+					} else {
+						out.Intents = []string{}
+					}
+				} else {
+					out.Intents = (out.Intents)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v15 string
+					v15 = string(in.String())
+					out.Intents = append(out.Intents, v15)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "DeviceKey":
+			if in.IsNull() {
+				in.Skip()
+				out.DeviceKey = nil
+			} else {
+				if out.DeviceKey == nil {
+					out.DeviceKey = new([32]uint8)
+				}
+				if in.IsNull() {
+					in.Skip()
+				} else {
+					copy((*out.DeviceKey)[:], in.BytesReadable())
+				}
+			}
+		case "DeviceSyncQueue":
+			if in.IsNull() {
+				in.Skip()
+				out.DeviceSyncQueue = nil
+			} else {
+				in.Delim('[')
+				if out.DeviceSyncQueue == nil {
+					if !in.IsDelim(']') {
+						out.DeviceSyncQueue = make([]*deviceSync, 0, 8)
+					} else {
+						out.DeviceSyncQueue = []*deviceSync{}
+					}
+				} else {
+					out.DeviceSyncQueue = (out.DeviceSyncQueue)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v17 *deviceSync
+					if in.IsNull() {
+						in.Skip()
+						v17 = nil
+					} else {
+						if v17 == nil {
+							v17 = new(deviceSync)
+						}
+						(*v17).UnmarshalEasyJSON(in)
+					}
+					out.DeviceSyncQueue = append(out.DeviceSyncQueue, v17)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "DeviceSyncTags":
+			if in.IsNull() {
+				in.Skip()
+				out.DeviceSyncTags = nil
+			} else {
+				in.Delim('[')
+				if out.DeviceSyncTags == nil {
+					if !in.IsDelim(']') {
+						out.DeviceSyncTags = make([]*deviceSync, 0, 8)
+					} else {
+						out.DeviceSyncTags = []*deviceSync{}
+					}
+				} else {
+					out.DeviceSyncTags = (out.DeviceSyncTags)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v18 *deviceSync
+					if in.IsNull() {
+						in.Skip()
+						v18 = nil
+					} else {
+						if v18 == nil {
+							v18 = new(deviceSync)
+						}
+						(*v18).UnmarshalEasyJSON(in)
+					}
+					out.DeviceSyncTags = append(out.DeviceSyncTags, v18)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -425,14 +534,14 @@ func easyjsonEncodePersistedStateC2eed687(out *jwriter.Writer, in persistedState
 		out.RawString("null")
 	} else {
 		out.RawByte('[')
-		for v21, v22 := range in.IncomingFriendRequests {
-			if v21 > 0 {
+		for v25, v26 := range in.IncomingFriendRequests {
+			if v25 > 0 {
 				out.RawByte(',')
 			}
-			if v22 == nil {
+			if v26 == nil {
 				out.RawString("null")
 			} else {
-				(*v22).MarshalEasyJSON(out)
+				(*v26).MarshalEasyJSON(out)
 			}
 		}
 		out.RawByte(']')
@@ -446,14 +555,14 @@ func easyjsonEncodePersistedStateC2eed687(out *jwriter.Writer, in persistedState
 		out.RawString("null")
 	} else {
 		out.RawByte('[')
-		for v23, v24 := range in.OutgoingFriendRequests {
-			if v23 > 0 {
+		for v27, v28 := range in.OutgoingFriendRequests {
+			if v27 > 0 {
 				out.RawByte(',')
 			}
-			if v24 == nil {
+			if v28 == nil {
 				out.RawString("null")
 			} else {
-				(*v24).MarshalEasyJSON(out)
+				(*v28).MarshalEasyJSON(out)
 			}
 		}
 		out.RawByte(']')
@@ -467,14 +576,14 @@ func easyjsonEncodePersistedStateC2eed687(out *jwriter.Writer, in persistedState
 		out.RawString("null")
 	} else {
 		out.RawByte('[')
-		for v25, v26 := range in.SentFriendRequests {
-			if v25 > 0 {
+		for v29, v30 := range in.SentFriendRequests {
+			if v29 > 0 {
 				out.RawByte(',')
 			}
-			if v26 == nil {
+			if v30 == nil {
 				out.RawString("null")
 			} else {
-				(*v26).MarshalEasyJSON(out)
+				(*v30).MarshalEasyJSON(out)
 			}
 		}
 		out.RawByte(']')
@@ -488,22 +597,91 @@ func easyjsonEncodePersistedStateC2eed687(out *jwriter.Writer, in persistedState
 		out.RawString(`null`)
 	} else {
 		out.RawByte('{')
-		v27First := true
-		for v27Name, v27Value := range in.Friends {
-			if !v27First {
+		v31First := true
+		for v31Name, v31Value := range in.Friends {
+			if !v31First {
 				out.RawByte(',')
 			}
-			v27First = false
-			out.String(string(v27Name))
+			v31First = false
+			out.String(string(v31Name))
 			out.RawByte(':')
-			if v27Value == nil {
+			if v31Value == nil {
 				out.RawString("null")
 			} else {
-				(*v27Value).MarshalEasyJSON(out)
+				(*v31Value).MarshalEasyJSON(out)
 			}
 		}
 		out.RawByte('}')
 	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Intents\":")
+	if in.Intents == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v32, v33 := range in.Intents {
+			if v32 > 0 {
+				out.RawByte(',')
+			}
+			out.String(string(v33))
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"DeviceKey\":")
+	if in.DeviceKey == nil {
+		out.RawString("null")
+	} else {
+		out.Base32Bytes((*in.DeviceKey)[:])
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"DeviceSyncQueue\":")
+	if in.DeviceSyncQueue == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v35, v36 := range in.DeviceSyncQueue {
+			if v35 > 0 {
+				out.RawByte(',')
+			}
+			if v36 == nil {
+				out.RawString("null")
+			} else {
+				(*v36).MarshalEasyJSON(out)
+			}
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"DeviceSyncTags\":")
+	if in.DeviceSyncTags == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v37, v38 := range in.DeviceSyncTags {
+			if v37 > 0 {
+				out.RawByte(',')
+			}
+			if v38 == nil {
+				out.RawString("null")
+			} else {
+				(*v38).MarshalEasyJSON(out)
+			}
+		}
+		out.RawByte(']')
+	}
 	out.RawByte('}')
 }
 
@@ -565,6 +743,31 @@ func easyjsonDecodePersistedFriendC2eed687(in *jlexer.Lexer, out *persistedFrien
 			} else {
 				out.ExtraData = in.BytesReadable()
 			}
+		case "KeyHistory":
+			if in.IsNull() {
+				in.Skip()
+				out.KeyHistory = nil
+			} else {
+				in.Delim('[')
+				if out.KeyHistory == nil {
+					if !in.IsDelim(']') {
+						out.KeyHistory = make([]KeyRecord, 0, 1)
+					} else {
+						out.KeyHistory = []KeyRecord{}
+					}
+				} else {
+					out.KeyHistory = (out.KeyHistory)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v41 KeyRecord
+					(v41).UnmarshalEasyJSON(in)
+					out.KeyHistory = append(out.KeyHistory, v41)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "Verified":
+			out.Verified = bool(in.Bool())
 		default:
 			in.SkipRecursive()
 		}
@@ -597,6 +800,29 @@ func easyjsonEncodePersistedFriendC2eed687(out *jwriter.Writer, in persistedFrie
 	first = false
 	out.RawString("\"ExtraData\":")
 	out.Base32Bytes(in.ExtraData)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"KeyHistory\":")
+	if in.KeyHistory == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v46, v47 := range in.KeyHistory {
+			if v46 > 0 {
+				out.RawByte(',')
+			}
+			(v47).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Verified\":")
+	out.Bool(bool(in.Verified))
 	out.RawByte('}')
 }
 
@@ -623,6 +849,129 @@ func (v *persistedFriend) UnmarshalJSON(data []byte) error {
 func (v *persistedFriend) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjsonDecodePersistedFriendC2eed687(l, v)
 }
+func easyjsonDecodeDeviceSyncC2eed687(in *jlexer.Lexer, out *deviceSync) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Tag":
+			if in.IsNull() {
+				in.Skip()
+				out.Tag = nil
+			} else {
+				if out.Tag == nil {
+					out.Tag = new([16]uint8)
+				}
+				if in.IsNull() {
+					in.Skip()
+				} else {
+					copy((*out.Tag)[:], in.BytesReadable())
+				}
+			}
+		case "DialRound":
+			out.DialRound = uint32(in.Uint32())
+		case "DHPrivateKey":
+			if in.IsNull() {
+				in.Skip()
+				out.DHPrivateKey = nil
+			} else {
+				if out.DHPrivateKey == nil {
+					out.DHPrivateKey = new([32]uint8)
+				}
+				if in.IsNull() {
+					in.Skip()
+				} else {
+					copy((*out.DHPrivateKey)[:], in.BytesReadable())
+				}
+			}
+		case "Round":
+			out.Round = uint32(in.Uint32())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeDeviceSyncC2eed687(out *jwriter.Writer, in deviceSync) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Tag\":")
+	if in.Tag == nil {
+		out.RawString("null")
+	} else {
+		out.Base32Bytes((*in.Tag)[:])
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"DialRound\":")
+	out.Uint32(uint32(in.DialRound))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"DHPrivateKey\":")
+	if in.DHPrivateKey == nil {
+		out.RawString("null")
+	} else {
+		out.Base32Bytes((*in.DHPrivateKey)[:])
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Round\":")
+	out.Uint32(uint32(in.Round))
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v deviceSync) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeDeviceSyncC2eed687(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v deviceSync) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeDeviceSyncC2eed687(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *deviceSync) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeDeviceSyncC2eed687(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *deviceSync) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeDeviceSyncC2eed687(l, v)
+}
 func easyjsonDecodeOutgoingFriendRequestC2eed687(in *jlexer.Lexer, out *OutgoingFriendRequest) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
@@ -655,6 +1004,12 @@ func easyjsonDecodeOutgoingFriendRequestC2eed687(in *jlexer.Lexer, out *Outgoing
 			out.Confirmation = bool(in.Bool())
 		case "DialRound":
 			out.DialRound = uint32(in.Uint32())
+		case "Created":
+			if data := in.Raw(); in.Ok() {
+				in.AddError((out.Created).UnmarshalJSON(data))
+			}
+		case "CreatedRound":
+			out.CreatedRound = uint32(in.Uint32())
 		default:
 			in.SkipRecursive()
 		}
@@ -693,6 +1048,18 @@ func easyjsonEncodeOutgoingFriendRequestC2eed687(out *jwriter.Writer, in Outgoin
 	first = false
 	out.RawString("\"DialRound\":")
 	out.Uint32(uint32(in.DialRound))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Created\":")
+	out.Raw((in.Created).MarshalJSON())
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CreatedRound\":")
+	out.Uint32(uint32(in.CreatedRound))
 	out.RawByte('}')
 }
 
@@ -719,6 +1086,88 @@ func (v *OutgoingFriendRequest) UnmarshalJSON(data []byte) error {
 func (v *OutgoingFriendRequest) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjsonDecodeOutgoingFriendRequestC2eed687(l, v)
 }
+func easyjsonDecodeKeyRecordC2eed687(in *jlexer.Lexer, out *KeyRecord) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Key":
+			if in.IsNull() {
+				in.Skip()
+				out.Key = nil
+			} else {
+				out.Key = in.BytesReadable()
+			}
+		case "Confirmed":
+			if data := in.Raw(); in.Ok() {
+				in.AddError((out.Confirmed).UnmarshalJSON(data))
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeKeyRecordC2eed687(out *jwriter.Writer, in KeyRecord) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Key\":")
+	out.Base32Bytes(in.Key)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Confirmed\":")
+	out.Raw((in.Confirmed).MarshalJSON())
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v KeyRecord) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeKeyRecordC2eed687(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v KeyRecord) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeKeyRecordC2eed687(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *KeyRecord) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeKeyRecordC2eed687(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *KeyRecord) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeKeyRecordC2eed687(l, v)
+}
 func easyjsonDecodeIncomingFriendRequestC2eed687(in *jlexer.Lexer, out *IncomingFriendRequest) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
@@ -779,13 +1228,19 @@ func easyjsonDecodeIncomingFriendRequestC2eed687(in *jlexer.Lexer, out *Incoming
 					out.Verifiers = (out.Verifiers)[:0]
 				}
 				for !in.IsDelim(']') {
-					var v39 pkg.PublicServerConfig
-					(v39).UnmarshalEasyJSON(in)
-					out.Verifiers = append(out.Verifiers, v39)
+					var v60 pkg.PublicServerConfig
+					(v60).UnmarshalEasyJSON(in)
+					out.Verifiers = append(out.Verifiers, v60)
 					in.WantComma()
 				}
 				in.Delim(']')
 			}
+		case "Received":
+			if data := in.Raw(); in.Ok() {
+				in.AddError((out.Received).UnmarshalJSON(data))
+			}
+		case "ReceivedRound":
+			out.ReceivedRound = uint32(in.Uint32())
 		default:
 			in.SkipRecursive()
 		}
@@ -837,14 +1292,26 @@ func easyjsonEncodeIncomingFriendRequestC2eed687(out *jwriter.Writer, in Incomin
 		out.RawString("null")
 	} else {
 		out.RawByte('[')
-		for v43, v44 := range in.Verifiers {
-			if v43 > 0 {
+		for v64, v65 := range in.Verifiers {
+			if v64 > 0 {
 				out.RawByte(',')
 			}
-			(v44).MarshalEasyJSON(out)
+			(v65).MarshalEasyJSON(out)
 		}
 		out.RawByte(']')
 	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Received\":")
+	out.Raw((in.Received).MarshalJSON())
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"ReceivedRound\":")
+	out.Uint32(uint32(in.ReceivedRound))
 	out.RawByte('}')
 }
 
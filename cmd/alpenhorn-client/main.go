@@ -0,0 +1,102 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Command alpenhorn-client runs an Alpenhorn client as a daemon and exposes
+// it to local applications over a JSON-RPC API on a Unix socket. See rpc.go
+// for the protocol.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"vuvuzela.io/alpenhorn/cmd/cmdutil"
+	"vuvuzela.io/alpenhorn/internal/clientcmd"
+	"vuvuzela.io/alpenhorn/log"
+)
+
+var (
+	doinit      = flag.Bool("init", false, "create a new account")
+	username    = flag.String("username", "", "username for the new account (with -init)")
+	socketPath  = flag.String("socket", "", "path of the control socket (default: <persist>/alpenhorn.sock)")
+	eventBuffer = flag.Int("eventBuffer", 1024, "number of events to buffer for slow subscribers")
+
+	account = new(clientcmd.Account)
+)
+
+func main() {
+	account.RegisterFlags()
+	flag.Parse()
+
+	if *doinit {
+		if cmdutil.Overwrite(account.Store().ClientPath) {
+			if _, err := account.Create(*username); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("created account %q in %s\n", *username, account.PersistPath)
+			fmt.Printf("start the daemon and call the \"Register\" method with a registration token\n")
+		}
+		return
+	}
+
+	client, err := account.Load()
+	if err != nil {
+		log.Fatalf("error loading client (run with -init to create an account): %s", err)
+	}
+	events := client.Events(*eventBuffer)
+
+	sockPath := *socketPath
+	if sockPath == "" {
+		sockPath = filepath.Join(account.PersistPath, "alpenhorn.sock")
+	}
+	// Remove the socket left behind by a previous run.
+	if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	listener, err := listenUnix(sockPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := newServer(client)
+	go srv.dispatchEvents(events)
+
+	if err := client.Connect(); err != nil {
+		log.Fatalf("client.Connect: %s", err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		log.Infof("Shutting down...")
+		listener.Close()
+	}()
+
+	log.Infof("Running as %q; listening on %s", client.Username, sockPath)
+	err = srv.Serve(listener)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Errorf("serve: %s", err)
+	}
+
+	if err := client.Close(); err != nil {
+		log.Infof("client closed with error: %s", err)
+	}
+	os.Remove(sockPath)
+}
+
+// listenUnix creates the control socket with mode 0600. The umask is set
+// before the socket is created, so other users can never connect to it.
+// This runs before the client starts any goroutines that create files.
+func listenUnix(path string) (net.Listener, error) {
+	mask := syscall.Umask(0177)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,659 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/clientcmd"
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// Protocol
+//
+// Applications connect to the control socket and exchange newline-delimited
+// JSON messages with the daemon. A request looks like
+//
+//	{"ID": 1, "Method": "AddFriend", "Params": {"Username": "bob@example.org"}}
+//
+// and the daemon replies with {"ID": 1, "Result": ...} on success or
+// {"ID": 1, "Error": "..."} on failure. Keys are base32-encoded.
+//
+// After a "Subscribe" request, the daemon also writes events to the
+// connection as they happen:
+//
+//	{"Event": "ReceivedCall", "Time": "...", "Round": 42, "Data": {...}}
+//
+// Events are buffered per connection. If an application does not keep
+// up, its connection is closed.
+
+type request struct {
+	ID     uint64
+	Method string
+	Params json.RawMessage
+}
+
+type response struct {
+	ID     uint64
+	Result interface{} `json:",omitempty"`
+	Error  string      `json:",omitempty"`
+}
+
+type eventMsg struct {
+	Event string
+	Time  time.Time
+	Round uint32 `json:",omitempty"`
+	Data  interface{}
+}
+
+// subscriberBuffer is the number of events buffered per subscribed connection.
+const subscriberBuffer = 256
+
+type server struct {
+	client *alpenhorn.Client
+
+	mu   sync.Mutex
+	subs map[*conn]bool
+}
+
+type conn struct {
+	nc net.Conn
+
+	writeMu sync.Mutex
+	w       *bufio.Writer
+
+	events chan *eventMsg
+	once   sync.Once
+}
+
+func newServer(client *alpenhorn.Client) *server {
+	return &server{
+		client: client,
+		subs:   make(map[*conn]bool),
+	}
+}
+
+func (s *server) Serve(l net.Listener) error {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(nc)
+	}
+}
+
+func (s *server) handle(nc net.Conn) {
+	c := &conn{
+		nc: nc,
+		w:  bufio.NewWriter(nc),
+	}
+	defer func() {
+		s.mu.Lock()
+		s.unsubscribeLocked(c)
+		s.mu.Unlock()
+		c.close()
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(nc))
+	for {
+		req := new(request)
+		if err := dec.Decode(req); err != nil {
+			return
+		}
+
+		resp := &response{ID: req.ID}
+		if req.Method == "Subscribe" {
+			s.subscribe(c)
+			resp.Result = true
+		} else if method, ok := methods[req.Method]; !ok {
+			resp.Error = "unknown method: " + req.Method
+		} else {
+			result, err := method(s.client, req.Params)
+			if err != nil {
+				resp.Error = err.Error()
+			} else {
+				resp.Result = result
+			}
+		}
+
+		if err := c.write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *server) subscribe(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subs[c] {
+		return
+	}
+	s.subs[c] = true
+	c.events = make(chan *eventMsg, subscriberBuffer)
+	go func() {
+		for e := range c.events {
+			if err := c.write(e); err != nil {
+				c.close()
+				return
+			}
+		}
+	}()
+}
+
+// unsubscribeLocked stops sending events to c, assuming s.mu is locked.
+func (s *server) unsubscribeLocked(c *conn) {
+	if s.subs[c] {
+		delete(s.subs, c)
+		close(c.events)
+	}
+}
+
+func (c *conn) write(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.w.Write(data)
+	c.w.WriteByte('\n')
+	return c.w.Flush()
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		c.nc.Close()
+	})
+}
+
+// dispatchEvents forwards events from the client to subscribed connections.
+func (s *server) dispatchEvents(stream *alpenhorn.EventStream) {
+	for e := range stream.C {
+		msg := eventMessage(e)
+		if msg == nil {
+			continue
+		}
+
+		s.mu.Lock()
+		for c := range s.subs {
+			select {
+			case c.events <- msg:
+			default:
+				log.Warnf("closing slow subscriber")
+				s.unsubscribeLocked(c)
+				c.close()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Methods
+
+type method func(client *alpenhorn.Client, params json.RawMessage) (interface{}, error)
+
+var methods = map[string]method{
+	"Status":               statusMethod,
+	"Register":             registerMethod,
+	"Deregister":           deregisterMethod,
+	"AddFriend":            addFriendMethod,
+	"CancelFriendRequest":  cancelFriendRequestMethod,
+	"FriendRequests":       friendRequestsMethod,
+	"ApproveFriendRequest": approveFriendRequestMethod,
+	"RejectFriendRequest":  rejectFriendRequestMethod,
+	"Friends":              friendsMethod,
+	"RemoveFriend":         removeFriendMethod,
+	"SetFriendVerified":    setFriendVerifiedMethod,
+	"Call":                 callMethod,
+	"Intents":              intentsMethod,
+	"RoundHistory":         roundHistoryMethod,
+	"SafetyNumber":         safetyNumberMethod,
+}
+
+type usernameParams struct {
+	Username string
+}
+
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return errors.New("missing params")
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return errors.Wrap(err, "invalid params")
+	}
+	return nil
+}
+
+type pkgStatus struct {
+	Address string
+	Error   string `json:",omitempty"`
+}
+
+func pkgStatuses(statuses []alpenhorn.PKGStatus) []pkgStatus {
+	result := make([]pkgStatus, len(statuses))
+	for i, st := range statuses {
+		result[i].Address = st.Server.Address
+		if st.Error != nil {
+			result[i].Error = st.Error.Error()
+		}
+	}
+	return result
+}
+
+func statusMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	return struct {
+		Username    string
+		LongTermKey string
+		PKGs        []pkgStatus
+	}{
+		Username:    client.Username,
+		LongTermKey: encodeKey(client.LongTermPublicKey),
+		PKGs:        pkgStatuses(client.PKGStatus()),
+	}, nil
+}
+
+func registerMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Token string
+	}
+	if err := decodeParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	return pkgStatuses(clientcmd.Register(client, args.Token)), nil
+}
+
+func deregisterMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	return true, client.Deregister()
+}
+
+func addFriendMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Username string
+		Key      string
+	}
+	if err := decodeParams(params, &args); err != nil {
+		return nil, err
+	}
+	var key ed25519.PublicKey
+	if args.Key != "" {
+		var err error
+		key, err = decodeKey(args.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := client.SendFriendRequest(args.Username, key)
+	if err != nil {
+		return nil, err
+	}
+	return outgoingRequest(req), nil
+}
+
+func cancelFriendRequestMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	var args usernameParams
+	if err := decodeParams(params, &args); err != nil {
+		return nil, err
+	}
+	for _, req := range client.GetOutgoingFriendRequests() {
+		if req.Username == args.Username {
+			return true, req.Cancel()
+		}
+	}
+	return nil, errors.New("no queued friend request for %q", args.Username)
+}
+
+func friendRequestsMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	result := struct {
+		Incoming []*incomingRequestView
+		Outgoing []*outgoingRequestView
+		Sent     []*outgoingRequestView
+	}{
+		Incoming: []*incomingRequestView{},
+		Outgoing: []*outgoingRequestView{},
+		Sent:     []*outgoingRequestView{},
+	}
+	for _, req := range client.GetIncomingFriendRequests() {
+		result.Incoming = append(result.Incoming, incomingRequest(req))
+	}
+	for _, req := range client.GetOutgoingFriendRequests() {
+		result.Outgoing = append(result.Outgoing, outgoingRequest(req))
+	}
+	for _, req := range client.GetSentFriendRequests() {
+		result.Sent = append(result.Sent, outgoingRequest(req))
+	}
+	return result, nil
+}
+
+func findIncomingRequest(client *alpenhorn.Client, params json.RawMessage) (*alpenhorn.IncomingFriendRequest, error) {
+	var args usernameParams
+	if err := decodeParams(params, &args); err != nil {
+		return nil, err
+	}
+	for _, req := range client.GetIncomingFriendRequests() {
+		if req.Username == args.Username {
+			return req, nil
+		}
+	}
+	return nil, errors.New("no incoming friend request from %q", args.Username)
+}
+
+func approveFriendRequestMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	req, err := findIncomingRequest(client, params)
+	if err != nil {
+		return nil, err
+	}
+	out, err := req.Approve()
+	if err != nil {
+		return nil, err
+	}
+	return outgoingRequest(out), nil
+}
+
+func rejectFriendRequestMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	req, err := findIncomingRequest(client, params)
+	if err != nil {
+		return nil, err
+	}
+	return true, req.Reject()
+}
+
+func findFriend(client *alpenhorn.Client, username string) (*alpenhorn.Friend, error) {
+	friend := client.GetFriend(username)
+	if friend == nil {
+		return nil, errors.New("%q is not a friend", username)
+	}
+	return friend, nil
+}
+
+func friendsMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	friends := client.GetFriends()
+	result := make([]*friendView, len(friends))
+	for i, f := range friends {
+		result[i] = friendInfo(f)
+	}
+	return result, nil
+}
+
+func removeFriendMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	var args usernameParams
+	if err := decodeParams(params, &args); err != nil {
+		return nil, err
+	}
+	friend, err := findFriend(client, args.Username)
+	if err != nil {
+		return nil, err
+	}
+	return true, friend.Remove()
+}
+
+func setFriendVerifiedMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Username string
+		Verified bool
+	}
+	if err := decodeParams(params, &args); err != nil {
+		return nil, err
+	}
+	friend, err := findFriend(client, args.Username)
+	if err != nil {
+		return nil, err
+	}
+	if err := friend.SetVerified(args.Verified); err != nil {
+		return nil, err
+	}
+	return friendInfo(friend), nil
+}
+
+func safetyNumberMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	var args usernameParams
+	if err := decodeParams(params, &args); err != nil {
+		return nil, err
+	}
+	friend, err := findFriend(client, args.Username)
+	if err != nil {
+		return nil, err
+	}
+	sn := friend.SafetyNumber()
+	return struct {
+		Digits string
+		Bytes  string
+	}{
+		Digits: sn.Digits(),
+		Bytes:  base32.EncodeToString(sn.Bytes()),
+	}, nil
+}
+
+func callMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Username string
+		Intent   int
+	}
+	if err := decodeParams(params, &args); err != nil {
+		return nil, err
+	}
+	if args.Intent < 0 || args.Intent >= client.NumIntents() {
+		return nil, errors.New("invalid intent: %d", args.Intent)
+	}
+	friend, err := findFriend(client, args.Username)
+	if err != nil {
+		return nil, err
+	}
+	call := friend.Call(args.Intent)
+	if call == nil {
+		return nil, errors.New("no keywheel entry for %q", args.Username)
+	}
+	return struct {
+		Username string
+		Intent   int
+	}{
+		Username: call.Username,
+		Intent:   call.Intent(),
+	}, nil
+}
+
+func intentsMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	return client.Intents(), nil
+}
+
+func roundHistoryMethod(client *alpenhorn.Client, params json.RawMessage) (interface{}, error) {
+	var args struct {
+		Service string
+	}
+	if len(params) > 0 {
+		if err := decodeParams(params, &args); err != nil {
+			return nil, err
+		}
+	}
+	return client.RoundHistory(args.Service), nil
+}
+
+// Views
+
+type friendView struct {
+	Username     string
+	LongTermKey  string
+	Verified     bool
+	SafetyNumber string
+}
+
+func friendInfo(f *alpenhorn.Friend) *friendView {
+	return &friendView{
+		Username:     f.Username,
+		LongTermKey:  encodeKey(f.LongTermKey),
+		Verified:     f.Verified(),
+		SafetyNumber: f.SafetyNumber().Digits(),
+	}
+}
+
+type incomingRequestView struct {
+	Username    string
+	LongTermKey string
+	DialRound   uint32
+	Received    time.Time
+}
+
+func incomingRequest(r *alpenhorn.IncomingFriendRequest) *incomingRequestView {
+	return &incomingRequestView{
+		Username:    r.Username,
+		LongTermKey: encodeKey(r.LongTermKey),
+		DialRound:   r.DialRound,
+		Received:    r.Received,
+	}
+}
+
+type outgoingRequestView struct {
+	Username     string
+	ExpectedKey  string `json:",omitempty"`
+	Confirmation bool
+}
+
+func outgoingRequest(r *alpenhorn.OutgoingFriendRequest) *outgoingRequestView {
+	return &outgoingRequestView{
+		Username:     r.Username,
+		ExpectedKey:  encodeKey(r.ExpectedKey),
+		Confirmation: r.Confirmation,
+	}
+}
+
+type callView struct {
+	Username   string
+	Intent     int
+	SessionKey string
+}
+
+func encodeKey(key []byte) string {
+	if key == nil {
+		return ""
+	}
+	return base32.EncodeToString(key)
+}
+
+func encodeSessionKey(key *[32]byte) string {
+	if key == nil {
+		return ""
+	}
+	return base32.EncodeToString(key[:])
+}
+
+func decodeKey(s string) (ed25519.PublicKey, error) {
+	key, err := base32.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding key")
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid key length: got %d bytes, want %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Events
+
+// eventMessage converts a client event to the message sent to subscribers.
+func eventMessage(e alpenhorn.Event) *eventMsg {
+	h := e.Header()
+	msg := &eventMsg{
+		Time:  h.Time,
+		Round: h.Round,
+	}
+
+	switch e := e.(type) {
+	case *alpenhorn.ErrorEvent:
+		msg.Event = "Error"
+		msg.Data = struct{ Error string }{e.Err.Error()}
+	case *alpenhorn.ConfirmedFriendEvent:
+		msg.Event = "ConfirmedFriend"
+		msg.Data = friendInfo(e.Friend)
+	case *alpenhorn.SentFriendRequestEvent:
+		msg.Event = "SentFriendRequest"
+		msg.Data = outgoingRequest(e.Request)
+	case *alpenhorn.ReceivedFriendRequestEvent:
+		msg.Event = "ReceivedFriendRequest"
+		msg.Data = incomingRequest(e.Request)
+	case *alpenhorn.UnexpectedSigningKeyEvent:
+		msg.Event = "UnexpectedSigningKey"
+		msg.Data = struct {
+			Incoming *incomingRequestView
+			Outgoing *outgoingRequestView
+		}{incomingRequest(e.Incoming), outgoingRequest(e.Outgoing)}
+	case *alpenhorn.FriendKeyChangedEvent:
+		msg.Event = "FriendKeyChanged"
+		msg.Data = struct {
+			Friend  *friendView
+			Request *incomingRequestView
+		}{friendInfo(e.Friend), incomingRequest(e.Request)}
+	case *alpenhorn.FriendRequestExpiredEvent:
+		msg.Event = "FriendRequestExpired"
+		data := struct {
+			Incoming *incomingRequestView `json:",omitempty"`
+			Outgoing *outgoingRequestView `json:",omitempty"`
+		}{}
+		if e.Incoming != nil {
+			data.Incoming = incomingRequest(e.Incoming)
+		}
+		if e.Outgoing != nil {
+			data.Outgoing = outgoingRequest(e.Outgoing)
+		}
+		msg.Data = data
+	case *alpenhorn.SendingCallEvent:
+		msg.Event = "SendingCall"
+		msg.Data = &callView{
+			Username:   e.Call.Username,
+			Intent:     e.Call.Intent(),
+			SessionKey: encodeSessionKey(e.Call.SessionKey()),
+		}
+	case *alpenhorn.ReceivedCallEvent:
+		msg.Event = "ReceivedCall"
+		msg.Data = &callView{
+			Username:   e.Call.Username,
+			Intent:     e.Call.Intent,
+			SessionKey: encodeSessionKey(e.Call.SessionKey),
+		}
+	case *alpenhorn.NewConfigEvent:
+		msg.Event = "NewConfig"
+		data := struct {
+			Service string
+			Hash    string
+		}{}
+		if len(e.Chain) > 0 {
+			data.Service = e.Chain[0].Service
+			data.Hash = e.Chain[0].Hash()
+		}
+		msg.Data = data
+	case *alpenhorn.ConnectionStateEvent:
+		msg.Event = "ConnectionState"
+		data := struct {
+			Service string
+			State   string
+			Error   string `json:",omitempty"`
+		}{
+			Service: e.Service,
+			State:   e.State.String(),
+		}
+		if e.Err != nil {
+			data.Error = e.Err.Error()
+		}
+		msg.Data = data
+	case *alpenhorn.OverflowEvent:
+		msg.Event = "Overflow"
+		msg.Data = struct{ Dropped int }{e.Dropped}
+	default:
+		return nil
+	}
+	return msg
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"flag"
@@ -227,14 +228,14 @@ func main() {
 	}
 
 	if addFriendServer != nil {
-		err := addFriendServer.Run()
+		err := addFriendServer.Run(context.Background())
 		if err != nil {
 			log.Fatalf("error starting addfriend loop: %s", err)
 		}
 	}
 
 	if dialingServer != nil {
-		err := dialingServer.Run()
+		err := dialingServer.Run(context.Background())
 		if err != nil {
 			log.Fatalf("error starting dialing loop: %s", err)
 		}
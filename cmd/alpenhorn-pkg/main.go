@@ -10,6 +10,7 @@ import (
 	"crypto/ed25519"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	golog "log"
 	"net/http"
@@ -22,6 +23,7 @@ import (
 
 	"vuvuzela.io/alpenhorn/cmd/cmdutil"
 	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/edhttp"
 	"vuvuzela.io/alpenhorn/edtls"
 	"vuvuzela.io/alpenhorn/encoding/toml"
 	"vuvuzela.io/alpenhorn/errors"
@@ -34,6 +36,9 @@ import (
 var (
 	doinit      = flag.Bool("init", false, "create config file")
 	persistPath = flag.String("persist", "persist_pkg", "persistent data directory")
+	purgeUser   = flag.String("purge", "", "delete all records of the given username and exit (the PKG must not be running)")
+	issueToken  = flag.String("issueToken", "", "print an hmac registration token for the given username and exit")
+	tokenTTL    = flag.Duration("tokenTTL", 7*24*time.Hour, "lifetime of tokens created with -issueToken")
 )
 
 type Config struct {
@@ -41,6 +46,12 @@ type Config struct {
 	PrivateKey ed25519.PrivateKey
 
 	ListenAddr string
+
+	// Verifier selects how registration tokens are verified:
+	// "registrar" (the default), "fcfs", "allowlist", or "hmac".
+	Verifier      string
+	AllowListPath string
+	TokenKey      []byte
 }
 
 var funcMap = template.FuncMap{
@@ -53,6 +64,15 @@ publicKey  = {{.PublicKey | base32 | printf "%q"}}
 privateKey = {{.PrivateKey | base32 | printf "%q"}}
 
 listenAddr = {{.ListenAddr | printf "%q"}}
+
+# How registrations are verified: "registrar" asks the registrar in the
+# addfriend config, "fcfs" lets anyone register any username, "allowlist"
+# only allows the usernames in allowListPath, and "hmac" accepts expiring
+# tokens signed with tokenKey. Login key resets are only allowed with
+# "registrar" and "hmac", since the other modes don't prove ownership.
+verifier = "registrar"
+#allowListPath = "allowlist.txt"
+tokenKey = {{.TokenKey | base32 | printf "%q"}}
 `
 
 func writeNewConfig(path string) {
@@ -61,11 +81,17 @@ func writeNewConfig(path string) {
 		panic(err)
 	}
 
+	tokenKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, tokenKey); err != nil {
+		panic(err)
+	}
+
 	conf := &Config{
 		PublicKey:  publicKey,
 		PrivateKey: privateKey,
 
 		ListenAddr: "0.0.0.0:80",
+		TokenKey:   tokenKey,
 	}
 
 	tmpl := template.Must(template.New("config").Funcs(funcMap).Parse(confTemplate))
@@ -114,6 +140,18 @@ func main() {
 		log.Fatalf("invalid config: %s", err)
 	}
 
+	if *issueToken != "" {
+		if err := pkg.ValidateUsername(*issueToken); err != nil {
+			log.Fatal(err)
+		}
+		if len(conf.TokenKey) == 0 {
+			log.Fatalf("no tokenKey in %s", confPath)
+		}
+		v := &pkg.HMACVerifier{Key: conf.TokenKey}
+		fmt.Println(v.NewToken(*issueToken, time.Now().Add(*tokenTTL)))
+		return
+	}
+
 	logsDir := filepath.Join(*persistPath, "logs")
 	logHandler, err := alplog.NewProductionOutput(logsDir)
 	if err != nil {
@@ -125,8 +163,9 @@ func main() {
 		log.Fatal(err)
 	}
 	addFriendConfig := signedConfig.Inner.(*config.AddFriendConfig)
-	if addFriendConfig.Registrar.Address == "" {
-		log.Fatal("no Registrar Address defined in current addfriend config!")
+	verifier, err := newVerifier(conf, addFriendConfig)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	dbPath := filepath.Join(*persistPath, "db")
@@ -146,7 +185,7 @@ func main() {
 			EntryHandler: logHandler,
 		},
 
-		RegTokenHandler: pkg.ExternalVerifier(fmt.Sprintf("https://%s/verify", addFriendConfig.Registrar.Address)),
+		Verifier: verifier,
 	}
 	pkgServer, err := pkg.NewServer(pkgConfig)
 	if err != nil {
@@ -159,6 +198,15 @@ func main() {
 		}
 	}()
 
+	if *purgeUser != "" {
+		if err := pkgServer.PurgeUser(*purgeUser); err != nil {
+			log.Errorf("purge: %s", err)
+			return
+		}
+		fmt.Printf("purged %q\n", *purgeUser)
+		return
+	}
+
 	errorLogPath := filepath.Join(*persistPath, "http_errors.log")
 	errorFile, err := os.OpenFile(errorLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
 	if err != nil {
@@ -223,3 +271,38 @@ func checkConfig(conf *Config) error {
 	}
 	return nil
 }
+
+func newVerifier(conf *Config, addFriendConfig *config.AddFriendConfig) (pkg.RegistrationVerifier, error) {
+	switch conf.Verifier {
+	case "", "registrar":
+		if addFriendConfig.Registrar.Address == "" {
+			return nil, errors.New("no Registrar Address defined in current addfriend config")
+		}
+		if len(addFriendConfig.Registrar.Key) != ed25519.PublicKeySize {
+			return nil, errors.New("no Registrar Key defined in current addfriend config")
+		}
+		return &pkg.RegistrarVerifier{
+			Address: addFriendConfig.Registrar.Address,
+			Key:     addFriendConfig.Registrar.Key,
+			Client: &edhttp.Client{
+				Key: conf.PrivateKey,
+			},
+		}, nil
+	case "fcfs":
+		log.Warn("Using first-come-first-serve registration: anyone can register any username")
+		return pkg.FirstComeFirstServe(), nil
+	case "allowlist":
+		path := conf.AllowListPath
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(*persistPath, path)
+		}
+		return pkg.LoadAllowList(path)
+	case "hmac":
+		if len(conf.TokenKey) < 16 {
+			return nil, errors.New("tokenKey must be at least 16 bytes")
+		}
+		return &pkg.HMACVerifier{Key: conf.TokenKey}, nil
+	default:
+		return nil, errors.New("unknown verifier: %q", conf.Verifier)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	golog "log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"text/template"
+	"time"
+
+	"vuvuzela.io/alpenhorn/cmd/cmdutil"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/edtls"
+	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/alplog"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/registrar"
+	"vuvuzela.io/crypto/rand"
+)
+
+var (
+	doinit      = flag.Bool("init", false, "create config file")
+	persistPath = flag.String("persist", "persist_registrar", "persistent data directory")
+)
+
+type Config struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	TokenKey   []byte
+
+	ListenAddr string
+
+	// TokenTTL is a duration string such as "24h".
+	TokenTTL string
+
+	// Tokens are written to SpoolDir if SMTPAddr is empty.
+	SpoolDir string
+
+	SMTPAddr string
+	SMTPFrom string
+}
+
+var funcMap = template.FuncMap{
+	"base32": toml.EncodeBytes,
+}
+
+const confTemplate = `# Alpenhorn registrar config
+
+publicKey  = {{.PublicKey | base32 | printf "%q"}}
+privateKey = {{.PrivateKey | base32 | printf "%q"}}
+tokenKey   = {{.TokenKey | base32 | printf "%q"}}
+
+listenAddr = {{.ListenAddr | printf "%q"}}
+tokenTTL   = {{.TokenTTL | printf "%q"}}
+
+# Registration tokens are mailed through smtpAddr if it is set,
+# otherwise they are written to files in spoolDir.
+spoolDir = {{.SpoolDir | printf "%q"}}
+#smtpAddr = "localhost:25"
+#smtpFrom = "registrar@example.org"
+`
+
+func writeNewConfig(path string) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tokenKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, tokenKey); err != nil {
+		panic(err)
+	}
+
+	conf := &Config{
+		PublicKey:  publicKey,
+		PrivateKey: privateKey,
+		TokenKey:   tokenKey,
+
+		ListenAddr: "0.0.0.0:443",
+		TokenTTL:   registrar.DefaultTokenTTL.String(),
+		SpoolDir:   "spool",
+	}
+
+	tmpl := template.Must(template.New("config").Funcs(funcMap).Parse(confTemplate))
+
+	buf := new(bytes.Buffer)
+	err = tmpl.Execute(buf, conf)
+	if err != nil {
+		log.Fatalf("template error: %s", err)
+	}
+	data := buf.Bytes()
+
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("wrote %s\n", path)
+}
+
+func main() {
+	flag.Parse()
+
+	if err := os.MkdirAll(*persistPath, 0700); err != nil {
+		log.Fatal(err)
+	}
+	confPath := filepath.Join(*persistPath, "registrar.conf")
+
+	if *doinit {
+		if cmdutil.Overwrite(confPath) {
+			writeNewConfig(confPath)
+		}
+		return
+	}
+
+	data, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf := new(Config)
+	err = toml.Unmarshal(data, conf)
+	if err != nil {
+		log.Fatalf("error parsing config %q: %s", confPath, err)
+	}
+	err = checkConfig(conf)
+	if err != nil {
+		log.Fatalf("invalid config: %s", err)
+	}
+	tokenTTL, err := time.ParseDuration(conf.TokenTTL)
+	if err != nil {
+		log.Fatalf("invalid tokenTTL: %s", err)
+	}
+
+	var mailer registrar.Mailer
+	if conf.SMTPAddr != "" {
+		mailer = &registrar.SMTPMailer{
+			Addr: conf.SMTPAddr,
+			From: conf.SMTPFrom,
+		}
+	} else {
+		spoolDir := conf.SpoolDir
+		if !filepath.IsAbs(spoolDir) {
+			spoolDir = filepath.Join(*persistPath, spoolDir)
+		}
+		mailer = &registrar.SpoolMailer{Dir: spoolDir}
+		log.Infof("Writing registration tokens to %s", spoolDir)
+	}
+
+	signedConfig, err := config.StdClient.CurrentConfig("AddFriend")
+	if err != nil {
+		log.Fatal(err)
+	}
+	addFriendConfig := signedConfig.Inner.(*config.AddFriendConfig)
+	if !bytes.Equal(addFriendConfig.Registrar.Key, conf.PublicKey) {
+		log.Warnf("Registrar key in current addfriend config does not match %s; PKGs will not trust this registrar", confPath)
+	}
+
+	logsDir := filepath.Join(*persistPath, "logs")
+	logHandler, err := alplog.NewProductionOutput(logsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	regConfig := &registrar.Config{
+		SigningKey: conf.PrivateKey,
+		TokenKey:   conf.TokenKey,
+		TokenTTL:   tokenTTL,
+		Mailer:     mailer,
+		PKGServers: addFriendConfig.PKGServers,
+
+		Logger: &log.Logger{
+			Level:        log.InfoLevel,
+			EntryHandler: logHandler,
+		},
+	}
+	regServer, err := registrar.New(regConfig)
+	if err != nil {
+		log.Fatalf("registrar.New: %s", err)
+	}
+	defer regServer.Close()
+
+	errorLogPath := filepath.Join(*persistPath, "http_errors.log")
+	errorFile, err := os.OpenFile(errorLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer errorFile.Close()
+	errorLog := golog.New(errorFile, "", golog.LstdFlags|golog.LUTC|golog.Lshortfile)
+
+	httpServer := &http.Server{
+		Handler:  regServer,
+		ErrorLog: errorLog,
+
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
+	go func() {
+		<-sigChan
+		log.Infof("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := httpServer.Shutdown(ctx)
+		if err != nil {
+			log.Infof("HTTP server shutdown with error: %s", err)
+		}
+		close(shutdownDone)
+	}()
+
+	listener, err := edtls.Listen("tcp", conf.ListenAddr, conf.PrivateKey)
+	if err != nil {
+		log.Fatalf("edtls.Listen: %s", err)
+	}
+
+	log.Infof("Listening on %q; logging to %s", conf.ListenAddr, logHandler.Name())
+	regConfig.Logger.Infof("Listening on %q", conf.ListenAddr)
+
+	err = httpServer.Serve(listener)
+	if err != http.ErrServerClosed {
+		log.Errorf("http listen: %s", err)
+	}
+
+	<-shutdownDone
+}
+
+func checkConfig(conf *Config) error {
+	if conf.ListenAddr == "" {
+		return errors.New("no listen address specified")
+	}
+	if len(conf.PrivateKey) != ed25519.PrivateKeySize {
+		return errors.New("invalid private key")
+	}
+	expectedPub := conf.PrivateKey.Public().(ed25519.PublicKey)
+	if !bytes.Equal(expectedPub, conf.PublicKey) {
+		return errors.New("public key does not correspond to private key")
+	}
+	if len(conf.TokenKey) < 16 {
+		return errors.New("tokenKey must be at least 16 bytes")
+	}
+	if conf.SMTPAddr == "" && conf.SpoolDir == "" {
+		return errors.New("no smtpAddr or spoolDir specified")
+	}
+	return nil
+}
@@ -0,0 +1,530 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Command alpenhorn-term is an interactive terminal client for Alpenhorn.
+// It is meant for exercising a deployment: registering with the PKGs,
+// adding friends, placing calls, and watching rounds as they happen.
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn"
+	"vuvuzela.io/alpenhorn/cmd/cmdutil"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/clientcmd"
+	"vuvuzela.io/alpenhorn/log"
+)
+
+var (
+	doinit   = flag.Bool("init", false, "create a new account")
+	username = flag.String("username", "", "username for the new account (with -init)")
+	intents  = flag.String("intents", "", "comma-separated intent names for calls")
+
+	account = new(clientcmd.Account)
+)
+
+type term struct {
+	client *alpenhorn.Client
+
+	mu        sync.Mutex
+	watch     bool
+	lastRound map[string]uint32
+}
+
+// printf prints a line without interleaving it with output from events.
+func (t *term) printf(format string, args ...interface{}) {
+	t.mu.Lock()
+	fmt.Printf(format+"\n", args...)
+	t.mu.Unlock()
+}
+
+type command struct {
+	args string
+	help string
+	run  func(t *term, args []string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"help":       {"", "show this help", (*term).help},
+		"status":     {"", "show the account and PKG registration status", (*term).status},
+		"register":   {"<token>", "register with every PKG", (*term).register},
+		"deregister": {"", "delete the account from every PKG", (*term).deregister},
+		"add":        {"<username> [key]", "send a friend request", (*term).add},
+		"cancel":     {"<username>", "cancel a queued friend request", (*term).cancel},
+		"requests":   {"", "show incoming, queued, and sent friend requests", (*term).requests},
+		"approve":    {"<username>", "approve an incoming friend request", (*term).approve},
+		"reject":     {"<username>", "reject an incoming friend request", (*term).reject},
+		"friends":    {"", "list friends", (*term).friends},
+		"remove":     {"<username>", "remove a friend", (*term).remove},
+		"verify":     {"<username> [on|off]", "show the safety number or mark a friend as verified", (*term).verify},
+		"intents":    {"", "list call intents", (*term).intents},
+		"call":       {"<username> [intent]", "call a friend", (*term).call},
+		"rounds":     {"[AddFriend|Dialing]", "show recent rounds", (*term).rounds},
+		"watch":      {"[on|off]", "print rounds as they happen", (*term).setWatch},
+	}
+}
+
+func main() {
+	account.RegisterFlags()
+	flag.Parse()
+
+	var client *alpenhorn.Client
+	var err error
+	if *doinit {
+		if !cmdutil.Overwrite(account.Store().ClientPath) {
+			return
+		}
+		client, err = account.Create(*username)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("created account %q in %s\n", *username, account.PersistPath)
+		fmt.Printf("use \"register <token>\" to register with the PKGs\n")
+	} else {
+		client, err = account.Load()
+		if err != nil {
+			log.Fatalf("error loading client (run with -init -username <username> to create an account): %s", err)
+		}
+	}
+	if *intents != "" {
+		if err := client.SetIntents(strings.Split(*intents, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	t := &term{
+		client:    client,
+		lastRound: make(map[string]uint32),
+	}
+	events := client.Events(1024)
+	go t.printEvents(events)
+	go t.watchRounds()
+
+	if err := client.Connect(); err != nil {
+		log.Fatalf("client.Connect: %s", err)
+	}
+	defer client.Close()
+
+	t.printf("Alpenhorn terminal client for %s. Type \"help\" for commands.", client.Username)
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			break
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			break
+		}
+		cmd, ok := commands[fields[0]]
+		if !ok {
+			t.printf("unknown command %q (try \"help\")", fields[0])
+			continue
+		}
+		if err := cmd.run(t, fields[1:]); err != nil {
+			t.printf("error: %s", err)
+		}
+	}
+}
+
+func (t *term) help(args []string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		t.printf("  %-32s %s", name+" "+cmd.args, cmd.help)
+	}
+	t.printf("  %-32s %s", "quit", "exit the client")
+	return nil
+}
+
+func usage(name string) error {
+	return errors.New("usage: %s %s", name, commands[name].args)
+}
+
+func (t *term) status(args []string) error {
+	t.printf("username: %s", t.client.Username)
+	t.printf("key:      %s", base32.EncodeToString(t.client.LongTermPublicKey))
+	for _, st := range t.client.PKGStatus() {
+		if st.Error != nil {
+			t.printf("PKG %s: %s", st.Server.Address, st.Error)
+		} else {
+			t.printf("PKG %s: registered", st.Server.Address)
+		}
+	}
+	return nil
+}
+
+func (t *term) register(args []string) error {
+	if len(args) != 1 {
+		return usage("register")
+	}
+	for _, st := range clientcmd.Register(t.client, args[0]) {
+		if st.Error != nil {
+			t.printf("PKG %s: %s", st.Server.Address, st.Error)
+		} else {
+			t.printf("PKG %s: registered", st.Server.Address)
+		}
+	}
+	return nil
+}
+
+func (t *term) deregister(args []string) error {
+	if err := t.client.Deregister(); err != nil {
+		return err
+	}
+	t.printf("deregistered %s", t.client.Username)
+	return nil
+}
+
+func (t *term) add(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return usage("add")
+	}
+	var key []byte
+	if len(args) == 2 {
+		var err error
+		key, err = base32.DecodeString(args[1])
+		if err != nil {
+			return errors.Wrap(err, "decoding key")
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return errors.New("invalid key length: got %d bytes, want %d", len(key), ed25519.PublicKeySize)
+		}
+	}
+	_, err := t.client.SendFriendRequest(args[0], key)
+	if err != nil {
+		return err
+	}
+	t.printf("queued friend request to %s", args[0])
+	return nil
+}
+
+func (t *term) cancel(args []string) error {
+	if len(args) != 1 {
+		return usage("cancel")
+	}
+	for _, req := range t.client.GetOutgoingFriendRequests() {
+		if req.Username == args[0] {
+			return req.Cancel()
+		}
+	}
+	return errors.New("no queued friend request to %s", args[0])
+}
+
+func (t *term) requests(args []string) error {
+	t.printf("incoming:")
+	for _, req := range t.client.GetIncomingFriendRequests() {
+		t.printf("  %s  key=%s  received=%s", req.Username, base32.EncodeToString(req.LongTermKey), req.Received.Format(time.Stamp))
+	}
+	t.printf("queued:")
+	for _, req := range t.client.GetOutgoingFriendRequests() {
+		t.printf("  %s%s", req.Username, requestFlags(req))
+	}
+	t.printf("sent:")
+	for _, req := range t.client.GetSentFriendRequests() {
+		t.printf("  %s%s", req.Username, requestFlags(req))
+	}
+	return nil
+}
+
+func requestFlags(req *alpenhorn.OutgoingFriendRequest) string {
+	var s string
+	if req.ExpectedKey != nil {
+		s += "  key=" + base32.EncodeToString(req.ExpectedKey)
+	}
+	if req.Confirmation {
+		s += "  (confirmation)"
+	}
+	return s
+}
+
+func (t *term) incomingRequest(username string) (*alpenhorn.IncomingFriendRequest, error) {
+	for _, req := range t.client.GetIncomingFriendRequests() {
+		if req.Username == username {
+			return req, nil
+		}
+	}
+	return nil, errors.New("no incoming friend request from %s", username)
+}
+
+func (t *term) approve(args []string) error {
+	if len(args) != 1 {
+		return usage("approve")
+	}
+	req, err := t.incomingRequest(args[0])
+	if err != nil {
+		return err
+	}
+	_, err = req.Approve()
+	return err
+}
+
+func (t *term) reject(args []string) error {
+	if len(args) != 1 {
+		return usage("reject")
+	}
+	req, err := t.incomingRequest(args[0])
+	if err != nil {
+		return err
+	}
+	return req.Reject()
+}
+
+func (t *term) friend(username string) (*alpenhorn.Friend, error) {
+	friend := t.client.GetFriend(username)
+	if friend == nil {
+		return nil, errors.New("%s is not a friend", username)
+	}
+	return friend, nil
+}
+
+func (t *term) friends(args []string) error {
+	friends := t.client.GetFriends()
+	sort.Slice(friends, func(i, j int) bool {
+		return friends[i].Username < friends[j].Username
+	})
+	for _, f := range friends {
+		verified := ""
+		if f.Verified() {
+			verified = "  (verified)"
+		}
+		t.printf("  %s  key=%s%s", f.Username, base32.EncodeToString(f.LongTermKey), verified)
+	}
+	return nil
+}
+
+func (t *term) remove(args []string) error {
+	if len(args) != 1 {
+		return usage("remove")
+	}
+	friend, err := t.friend(args[0])
+	if err != nil {
+		return err
+	}
+	return friend.Remove()
+}
+
+func (t *term) verify(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return usage("verify")
+	}
+	friend, err := t.friend(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		switch args[1] {
+		case "on":
+			return friend.SetVerified(true)
+		case "off":
+			return friend.SetVerified(false)
+		default:
+			return usage("verify")
+		}
+	}
+	t.printf("safety number: %s", friend.SafetyNumber().Digits())
+	t.printf("verified:      %t", friend.Verified())
+	return nil
+}
+
+func (t *term) intents(args []string) error {
+	for i, name := range t.client.Intents() {
+		t.printf("  %d  %s", i, name)
+	}
+	return nil
+}
+
+func (t *term) call(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return usage("call")
+	}
+	intent := 0
+	if len(args) == 2 {
+		var err error
+		intent, err = t.parseIntent(args[1])
+		if err != nil {
+			return err
+		}
+	}
+	friend, err := t.friend(args[0])
+	if err != nil {
+		return err
+	}
+	if friend.Call(intent) == nil {
+		return errors.New("no keywheel entry for %s", args[0])
+	}
+	t.printf("queued call to %s (intent %s)", args[0], t.intentLabel(intent))
+	return nil
+}
+
+// parseIntent parses an intent given by number or by name.
+func (t *term) parseIntent(s string) (int, error) {
+	if i, err := strconv.Atoi(s); err == nil {
+		if i < 0 || i >= t.client.NumIntents() {
+			return 0, errors.New("invalid intent: %d", i)
+		}
+		return i, nil
+	}
+	for i, name := range t.client.Intents() {
+		if name == s {
+			return i, nil
+		}
+	}
+	return 0, errors.New("unknown intent: %q", s)
+}
+
+func (t *term) intentLabel(intent int) string {
+	if name := t.client.IntentName(intent); name != "" {
+		return name
+	}
+	return strconv.Itoa(intent)
+}
+
+func (t *term) rounds(args []string) error {
+	if len(args) > 1 {
+		return usage("rounds")
+	}
+	service := ""
+	if len(args) == 1 {
+		service = args[0]
+	}
+	history := t.client.RoundHistory(service)
+	if n := len(history); n > 20 {
+		history = history[n-20:]
+	}
+	for _, st := range history {
+		t.printf("  %s", formatRound(st))
+	}
+	return nil
+}
+
+func formatRound(st alpenhorn.RoundStats) string {
+	s := fmt.Sprintf("%-9s round %-6d %s", st.Service, st.Round, st.Started.Format(time.Stamp))
+	if st.OnionSent {
+		s += "  sent"
+	}
+	if st.Service == "AddFriend" && st.ExtractLatency > 0 {
+		if st.ExtractSuccess {
+			s += fmt.Sprintf("  extract=%s", st.ExtractLatency)
+		} else {
+			s += "  extract=failed"
+		}
+	}
+	if st.FetchLatency > 0 {
+		size := st.MailboxSize
+		if st.Service == "Dialing" {
+			size = st.BloomFilterSize
+		}
+		s += fmt.Sprintf("  fetch=%s (%d bytes)", st.FetchLatency, size)
+	}
+	return s
+}
+
+func (t *term) setWatch(args []string) error {
+	if len(args) > 1 {
+		return usage("watch")
+	}
+	t.mu.Lock()
+	if len(args) == 0 {
+		t.watch = !t.watch
+	} else {
+		t.watch = args[0] == "on"
+	}
+	watch := t.watch
+	t.mu.Unlock()
+	t.printf("watching rounds: %t", watch)
+	return nil
+}
+
+// watchRounds prints new rounds when watching is enabled.
+func (t *term) watchRounds() {
+	for range time.Tick(500 * time.Millisecond) {
+		t.mu.Lock()
+		watch := t.watch
+		t.mu.Unlock()
+
+		for _, st := range t.client.RoundHistory("") {
+			t.mu.Lock()
+			isNew := st.Round > t.lastRound[st.Service]
+			if isNew {
+				t.lastRound[st.Service] = st.Round
+			}
+			t.mu.Unlock()
+			if isNew && watch {
+				t.printf("[%s round %d]", st.Service, st.Round)
+			}
+		}
+	}
+}
+
+func (t *term) printEvents(events *alpenhorn.EventStream) {
+	for e := range events.C {
+		h := e.Header()
+		prefix := "*"
+		if h.Round != 0 {
+			prefix = fmt.Sprintf("* [round %d]", h.Round)
+		}
+
+		switch e := e.(type) {
+		case *alpenhorn.ErrorEvent:
+			t.printf("%s error: %s", prefix, e.Err)
+		case *alpenhorn.ConfirmedFriendEvent:
+			t.printf("%s %s is now a friend", prefix, e.Friend.Username)
+		case *alpenhorn.SentFriendRequestEvent:
+			t.printf("%s sent friend request to %s", prefix, e.Request.Username)
+		case *alpenhorn.ReceivedFriendRequestEvent:
+			t.printf("%s friend request from %s (key %s); use \"approve %s\" or \"reject %s\"",
+				prefix, e.Request.Username, base32.EncodeToString(e.Request.LongTermKey),
+				e.Request.Username, e.Request.Username)
+		case *alpenhorn.UnexpectedSigningKeyEvent:
+			t.printf("%s %s responded with an unexpected key %s",
+				prefix, e.Incoming.Username, base32.EncodeToString(e.Incoming.LongTermKey))
+		case *alpenhorn.FriendKeyChangedEvent:
+			t.printf("%s %s changed their key to %s; use \"approve %s\" to accept it",
+				prefix, e.Friend.Username, base32.EncodeToString(e.Request.LongTermKey), e.Friend.Username)
+		case *alpenhorn.FriendRequestExpiredEvent:
+			if e.Incoming != nil {
+				t.printf("%s friend request from %s expired", prefix, e.Incoming.Username)
+			} else {
+				t.printf("%s friend request to %s expired", prefix, e.Outgoing.Username)
+			}
+		case *alpenhorn.SendingCallEvent:
+			t.printf("%s calling %s (intent %s)", prefix, e.Call.Username, t.intentLabel(e.Call.Intent()))
+		case *alpenhorn.ReceivedCallEvent:
+			t.printf("%s call from %s (intent %s)", prefix, e.Call.Username, t.intentLabel(e.Call.Intent))
+		case *alpenhorn.NewConfigEvent:
+			t.printf("%s new %s config", prefix, e.Chain[0].Service)
+		case *alpenhorn.ConnectionStateEvent:
+			if e.Err != nil {
+				t.printf("* %s %s: %s", e.Service, e.State, e.Err)
+			} else {
+				t.printf("* %s %s", e.Service, e.State)
+			}
+		case *alpenhorn.OverflowEvent:
+			t.printf("* dropped %d events", e.Dropped)
+		}
+	}
+}
@@ -282,7 +282,7 @@ func init() {
 	RegisterService("Dialing", &DialingConfig{})
 }
 
-const AddFriendConfigVersion = 2
+const AddFriendConfigVersion = 3
 
 type AddFriendConfig struct {
 	Version     int
@@ -291,12 +291,28 @@ type AddFriendConfig struct {
 	MixServers  []mixnet.PublicServerConfig
 	CDNServer   CDNServerConfig
 	Registrar   RegistrarConfig
+
+	// PKGThreshold is the minimum number of PKGs that must take part
+	// in a round. Rounds proceed without PKGs that are down, as long as
+	// the threshold is met. Friend requests are only secret if at least
+	// one PKG in the round is honest, so the threshold should be larger
+	// than the number of PKGs that might collude. If zero, every PKG
+	// must take part in every round.
+	PKGThreshold int
 }
 
 func (c *AddFriendConfig) UseLatestVersion() {
 	c.Version = AddFriendConfigVersion
 }
 
+// PKGQuorum returns the number of PKGs that must take part in a round.
+func (c *AddFriendConfig) PKGQuorum() int {
+	if c.PKGThreshold == 0 {
+		return len(c.PKGServers)
+	}
+	return c.PKGThreshold
+}
+
 //easyjson:readable
 type RegistrarConfig struct {
 	Key     ed25519.PublicKey
@@ -335,6 +351,17 @@ type addFriendV2 struct {
 	Registrar   keyAddr
 }
 
+//easyjson:readable
+type addFriendV3 struct {
+	Version      int
+	Coordinator  keyAddr
+	PKGServers   []keyAddr
+	MixServers   []keyAddr
+	CDNServer    keyAddr
+	Registrar    keyAddr
+	PKGThreshold int
+}
+
 //easyjson:readable
 type keyAddr struct {
 	Key     ed25519.PublicKey
@@ -377,6 +404,25 @@ func (c *AddFriendConfig) v2() (*addFriendV2, error) {
 	return c2, nil
 }
 
+func (c *AddFriendConfig) v3() (*addFriendV3, error) {
+	c3 := &addFriendV3{
+		Version:      3,
+		Coordinator:  keyAddr{c.Coordinator.Key, c.Coordinator.Address},
+		PKGServers:   make([]keyAddr, len(c.PKGServers)),
+		MixServers:   make([]keyAddr, len(c.MixServers)),
+		CDNServer:    keyAddr{c.CDNServer.Key, c.CDNServer.Address},
+		Registrar:    keyAddr{c.Registrar.Key, c.Registrar.Address},
+		PKGThreshold: c.PKGThreshold,
+	}
+	for i, srv := range c.PKGServers {
+		c3.PKGServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	for i, srv := range c.MixServers {
+		c3.MixServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	return c3, nil
+}
+
 func (c *AddFriendConfig) fromV1(c1 *addFriendV1) error {
 	c.Version = 1
 	c.Coordinator = CoordinatorConfig{c1.Coordinator.Key, c1.Coordinator.Address}
@@ -409,6 +455,23 @@ func (c *AddFriendConfig) fromV2(c2 *addFriendV2) error {
 	return nil
 }
 
+func (c *AddFriendConfig) fromV3(c3 *addFriendV3) error {
+	c.Version = 3
+	c.Coordinator = CoordinatorConfig{c3.Coordinator.Key, c3.Coordinator.Address}
+	c.PKGServers = make([]pkg.PublicServerConfig, len(c3.PKGServers))
+	c.MixServers = make([]mixnet.PublicServerConfig, len(c3.MixServers))
+	c.CDNServer = CDNServerConfig{c3.CDNServer.Key, c3.CDNServer.Address}
+	for i, srv := range c3.PKGServers {
+		c.PKGServers[i] = pkg.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	for i, srv := range c3.MixServers {
+		c.MixServers[i] = mixnet.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	c.Registrar = RegistrarConfig{c3.Registrar.Key, c3.Registrar.Address}
+	c.PKGThreshold = c3.PKGThreshold
+	return nil
+}
+
 func (c *AddFriendConfig) Validate() error {
 	if c.Version <= 0 {
 		return errors.New("invalid version number: %d", c.Version)
@@ -444,6 +507,12 @@ func (c *AddFriendConfig) Validate() error {
 			return errors.New("empty address for pkg %d", i)
 		}
 	}
+	if c.PKGThreshold < 0 || c.PKGThreshold > len(c.PKGServers) {
+		return errors.New("invalid pkg threshold %d for %d pkgs", c.PKGThreshold, len(c.PKGServers))
+	}
+	if c.PKGThreshold != 0 && c.Version < 3 {
+		return errors.New("pkg threshold requires version 3 or later")
+	}
 
 	return nil
 }
@@ -462,6 +531,12 @@ func (c *AddFriendConfig) MarshalJSON() ([]byte, error) {
 			return nil, err
 		}
 		return json.Marshal(c2)
+	case 3:
+		c3, err := c.v3()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(c3)
 	default:
 		return nil, errors.New("unknown AddFriendConfig version: %d", c.Version)
 	}
@@ -487,6 +562,13 @@ func (c *AddFriendConfig) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		return c.fromV2(c2)
+	case 3:
+		c3 := new(addFriendV3)
+		err := json.Unmarshal(data, c3)
+		if err != nil {
+			return err
+		}
+		return c.fromV3(c3)
 	default:
 		return errors.New("unknown AddFriendConfig version: %d", version)
 	}
@@ -164,6 +164,7 @@ func TestMarshalAddFriendConfig(t *testing.T) {
 				Key:     guardianPub,
 				Address: "vuvuzela.io",
 			},
+			PKGThreshold: 1,
 		},
 	}
 	sig := ed25519.Sign(guardianPriv, conf.SigningMessage())
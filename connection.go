@@ -0,0 +1,223 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"time"
+
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/typesocket"
+)
+
+// ConnectionState is the state of the client's connection to the
+// add-friend or dialing coordinator.
+type ConnectionState int
+
+const (
+	Disconnected ConnectionState = iota
+	Connecting
+	Connected
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(s))
+	}
+}
+
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 2 * time.Minute
+)
+
+// A connSupervisor keeps a connection to a coordinator alive.
+type connSupervisor struct {
+	service string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Connect connects the client to the add-friend and dialing coordinators
+// and keeps the connections alive until Close is called. When a connection
+// drops, the client reconnects with jittered exponential backoff and resumes
+// in the coordinator's current round. Connection state changes are reported
+// to the Handler if it is a ConnectionStateHandler.
+func (c *Client) Connect() error {
+	c.init()
+
+	if c.ConfigClient == nil {
+		return errors.New("no config client")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.addFriendConfig == nil {
+		return errors.New("no addfriend config")
+	}
+	if c.dialingConfig == nil {
+		return errors.New("no dialing config")
+	}
+	if c.addFriendSupervisor != nil || c.dialingSupervisor != nil {
+		return errors.New("already connected")
+	}
+
+	c.addFriendSupervisor = c.supervise("AddFriend", c.addFriendMux())
+	c.dialingSupervisor = c.supervise("Dialing", c.dialingMux())
+
+	return nil
+}
+
+// Close closes the connections opened by Connect and waits
+// for the client to stop reconnecting.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	sups := []*connSupervisor{c.addFriendSupervisor, c.dialingSupervisor}
+	c.addFriendSupervisor = nil
+	c.dialingSupervisor = nil
+	c.mu.Unlock()
+
+	for _, sup := range sups {
+		if sup != nil {
+			close(sup.stop)
+		}
+	}
+
+	err := c.CloseAddFriend()
+	if e := c.CloseDialing(); err == nil {
+		err = e
+	}
+
+	for _, sup := range sups {
+		if sup != nil {
+			<-sup.done
+		}
+	}
+	return err
+}
+
+// supervise starts a goroutine that keeps a connection to the
+// coordinator for the given service alive. Assumes c.mu is locked.
+func (c *Client) supervise(service string, mux typesocket.Mux) *connSupervisor {
+	sup := &connSupervisor{
+		service: service,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.superviseLoop(sup, mux)
+	return sup
+}
+
+func (c *Client) connectionStateChanged(service string, state ConnectionState, err error) {
+	if h, ok := c.Handler.(ConnectionStateHandler); ok {
+		h.ConnectionStateChanged(service, state, err)
+	}
+}
+
+func (c *Client) superviseLoop(sup *connSupervisor, mux typesocket.Mux) {
+	defer close(sup.done)
+
+	delay := minReconnectDelay
+	for {
+		c.connectionStateChanged(sup.service, Connecting, nil)
+
+		conn, err := c.dialCoordinator(sup.service)
+		if err == nil {
+			if !c.setConn(sup, conn) {
+				conn.Close()
+				c.connectionStateChanged(sup.service, Disconnected, nil)
+				return
+			}
+			c.connectionStateChanged(sup.service, Connected, nil)
+			delay = minReconnectDelay
+
+			err = conn.Serve(mux)
+		}
+
+		select {
+		case <-sup.stop:
+			c.connectionStateChanged(sup.service, Disconnected, nil)
+			return
+		default:
+		}
+		c.connectionStateChanged(sup.service, Disconnected, err)
+
+		timer := time.NewTimer(jitter(delay))
+		select {
+		case <-sup.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// setConn records conn as the client's connection for the supervised
+// service, returning false if the supervisor has been stopped.
+func (c *Client) setConn(sup *connSupervisor, conn typesocket.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-sup.stop:
+		return false
+	default:
+	}
+
+	switch sup.service {
+	case "AddFriend":
+		c.addFriendConn = conn
+	case "Dialing":
+		c.dialingConn = conn
+		c.wheelAdvanced = false
+	}
+	return true
+}
+
+// dialCoordinator fetches the current config for the service and
+// connects to the coordinator named in that config.
+func (c *Client) dialCoordinator(service string) (*typesocket.ClientConn, error) {
+	currentConfig, err := c.ConfigClient.CurrentConfig(service)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching %s config", service)
+	}
+
+	var coordinator config.CoordinatorConfig
+	var path string
+	switch inner := currentConfig.Inner.(type) {
+	case *config.AddFriendConfig:
+		coordinator = inner.Coordinator
+		path = "addfriend"
+	case *config.DialingConfig:
+		coordinator = inner.Coordinator
+		path = "dialing"
+	default:
+		return nil, errors.New("unexpected inner config type: %T", inner)
+	}
+
+	addr := fmt.Sprintf("wss://%s/%s/ws", coordinator.Address, path)
+	return typesocket.Dial(addr, coordinator.Key)
+}
+
+// jitter returns a random duration in [d/2, d).
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(mrand.Int63n(int64(half)))
+}
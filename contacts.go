@@ -0,0 +1,219 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Contact bundles start with this magic string, followed by
+// the bundle encrypted with a StateKey.
+var contactsMagic = []byte("alpenhorn-contacts-v1\n")
+
+// contactsSigningContext is prepended to the bundle before signing so that
+// the signature can't be confused with other long-term key signatures.
+var contactsSigningContext = []byte("alpenhorn contacts bundle v1\n")
+
+var ErrContactsSigner = errors.New("contacts bundle is not signed by this user")
+
+type contactBundle struct {
+	Username    string
+	LongTermKey ed25519.PublicKey
+	Created     time.Time
+	Friends     []*exportedFriend
+}
+
+type exportedFriend struct {
+	Username    string
+	LongTermKey ed25519.PublicKey
+	ExtraData   []byte
+	KeyHistory  []KeyRecord
+	Verified    bool
+
+	// Round and Secret are the friend's keywheel entry.
+	Round  uint32
+	Secret []byte
+}
+
+// ExportContacts returns the user's friends and their keywheel entries as a
+// bundle that is signed by the user's long-term key and encrypted with the
+// given key. The bundle lets the user move their address book to another
+// client (e.g., a new phone) that has the same username and long-term key,
+// without redoing the add-friend protocol with every friend.
+//
+// The bundle contains keywheel secrets, so the exporting client should stop
+// being used once the bundle is imported elsewhere.
+func (c *Client) ExportContacts(key *StateKey) ([]byte, error) {
+	c.init()
+
+	bundle := &contactBundle{
+		Username:    c.Username,
+		LongTermKey: c.LongTermPublicKey,
+		Created:     time.Now(),
+	}
+
+	c.mu.Lock()
+	for _, friend := range c.friends {
+		round, secret := c.wheel.UnsafeGet(friend.Username)
+		if secret == nil {
+			continue
+		}
+		bundle.Friends = append(bundle.Friends, &exportedFriend{
+			Username:    friend.Username,
+			LongTermKey: friend.LongTermKey,
+			ExtraData:   friend.extraData,
+			KeyHistory:  friend.keyHistory,
+			Verified:    friend.verified,
+			Round:       round,
+			Secret:      secret[:],
+		})
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(bundle)
+	for _, f := range bundle.Friends {
+		zero(f.Secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sig := ed25519.Sign(c.LongTermPrivateKey, contactsSigningMessage(data))
+	signed := append(data, sig...)
+	ctxt, err := key.seal(signed)
+	zero(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte(nil), contactsMagic...), ctxt...), nil
+}
+
+// A ContactConflict is a friend in an imported bundle whose long-term key
+// differs from the key the client has pinned for that friend.
+type ContactConflict struct {
+	Username    string
+	ExistingKey ed25519.PublicKey
+	ImportedKey ed25519.PublicKey
+}
+
+// ImportResult describes the outcome of ImportContacts.
+type ImportResult struct {
+	// Imported are the usernames of the friends added to the client.
+	Imported []string
+
+	// Unchanged are the usernames of friends the client already had
+	// with the same long-term key. They are left as is.
+	Unchanged []string
+
+	// Conflicts are friends that were not imported because the client
+	// already has them with a different long-term key.
+	Conflicts []ContactConflict
+}
+
+// ImportContacts merges a bundle created by ExportContacts into the client.
+// The bundle must be signed by the client's own long-term key. Existing
+// friends are never overwritten: friends with a different long-term key
+// are reported as conflicts so the application can resolve them (e.g.,
+// by removing the friend and importing again).
+func (c *Client) ImportContacts(data []byte, key *StateKey) (*ImportResult, error) {
+	c.init()
+
+	if !bytes.HasPrefix(data, contactsMagic) {
+		return nil, errors.New("not a contacts bundle")
+	}
+	signed, err := key.open(data[len(contactsMagic):])
+	if err != nil {
+		return nil, err
+	}
+	defer zero(signed)
+
+	if len(signed) < ed25519.SignatureSize {
+		return nil, errors.New("short contacts bundle")
+	}
+	msg := signed[:len(signed)-ed25519.SignatureSize]
+	sig := signed[len(signed)-ed25519.SignatureSize:]
+	if !ed25519.Verify(c.LongTermPublicKey, contactsSigningMessage(msg), sig) {
+		return nil, ErrContactsSigner
+	}
+
+	bundle := new(contactBundle)
+	if err := json.Unmarshal(msg, bundle); err != nil {
+		return nil, errors.Wrap(err, "decoding contacts bundle")
+	}
+	if bundle.Username != c.Username || !bytes.Equal(bundle.LongTermKey, c.LongTermPublicKey) {
+		return nil, ErrContactsSigner
+	}
+
+	result := new(ImportResult)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, f := range bundle.Friends {
+		if len(f.Secret) != 32 || len(f.LongTermKey) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid contact in bundle: %q", f.Username)
+		}
+		if len(f.ExtraData) > MaxExtraDataSize {
+			return nil, errors.New("invalid contact in bundle: %q: extra data too large: %d bytes > %d bytes", f.Username, len(f.ExtraData), MaxExtraDataSize)
+		}
+	}
+
+	for _, f := range bundle.Friends {
+		if existing := c.friends[f.Username]; existing != nil {
+			if bytes.Equal(existing.LongTermKey, f.LongTermKey) {
+				result.Unchanged = append(result.Unchanged, f.Username)
+			} else {
+				result.Conflicts = append(result.Conflicts, ContactConflict{
+					Username:    f.Username,
+					ExistingKey: existing.LongTermKey,
+					ImportedKey: f.LongTermKey,
+				})
+			}
+			zero(f.Secret)
+			continue
+		}
+
+		c.friends[f.Username] = &Friend{
+			Username:    f.Username,
+			LongTermKey: f.LongTermKey,
+			extraData:   f.ExtraData,
+			keyHistory:  f.KeyHistory,
+			verified:    f.Verified,
+			client:      c,
+		}
+		secret := new([32]byte)
+		copy(secret[:], f.Secret)
+		zero(f.Secret)
+		c.wheel.Put(f.Username, f.Round, secret)
+		*secret = [32]byte{}
+
+		result.Imported = append(result.Imported, f.Username)
+	}
+
+	if len(result.Imported) > 0 {
+		if err := c.persistLocked(); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func contactsSigningMessage(data []byte) []byte {
+	msg := make([]byte, 0, len(contactsSigningContext)+len(data))
+	msg = append(msg, contactsSigningContext...)
+	return append(msg, data...)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
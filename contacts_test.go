@@ -0,0 +1,120 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+func newContactsTestClient(pub ed25519.PublicKey, priv ed25519.PrivateKey) *Client {
+	return &Client{
+		Username:           "alice@example.org",
+		LongTermPublicKey:  pub,
+		LongTermPrivateKey: priv,
+		Store:              new(MemoryStore),
+	}
+}
+
+func TestContacts(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	bobKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	chrisKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	old := newContactsTestClient(pub, priv)
+	old.init()
+	for _, f := range []*Friend{
+		{Username: "bob@example.org", LongTermKey: bobKey, extraData: []byte("bob"), verified: true},
+		{Username: "chris@example.org", LongTermKey: chrisKey},
+	} {
+		f.client = old
+		old.friends[f.Username] = f
+		secret := new([32]byte)
+		rand.Read(secret[:])
+		old.wheel.Put(f.Username, 100, secret)
+	}
+
+	var k [32]byte
+	rand.Read(k[:])
+	key := RawStateKey(&k)
+	bundle, err := old.ExportContacts(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new client already has Chris, but with a different key.
+	chrisKey2, _, _ := ed25519.GenerateKey(rand.Reader)
+	c := newContactsTestClient(pub, priv)
+	c.init()
+	c.friends["chris@example.org"] = &Friend{Username: "chris@example.org", LongTermKey: chrisKey2, client: c}
+
+	result, err := c.ImportContacts(bundle, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Imported) != 1 || result.Imported[0] != "bob@example.org" {
+		t.Fatalf("unexpected imported friends: %v", result.Imported)
+	}
+	if len(result.Conflicts) != 1 || result.Conflicts[0].Username != "chris@example.org" {
+		t.Fatalf("unexpected conflicts: %v", result.Conflicts)
+	}
+	if !bytes.Equal(result.Conflicts[0].ImportedKey, chrisKey) || !bytes.Equal(result.Conflicts[0].ExistingKey, chrisKey2) {
+		t.Fatalf("unexpected keys in conflict")
+	}
+	if !bytes.Equal(c.GetFriend("chris@example.org").LongTermKey, chrisKey2) {
+		t.Fatalf("import overwrote existing friend")
+	}
+
+	bob := c.GetFriend("bob@example.org")
+	if bob == nil {
+		t.Fatal("imported friend not found")
+	}
+	if !bytes.Equal(bob.ExtraData(), []byte("bob")) || !bob.Verified() {
+		t.Fatalf("imported friend lost its data")
+	}
+	k1 := old.wheel.SessionKey("bob@example.org", 105)
+	k2 := c.wheel.SessionKey("bob@example.org", 105)
+	if !bytes.Equal(k1[:], k2[:]) {
+		t.Fatalf("imported keywheel differs")
+	}
+
+	// Importing again is a no-op.
+	result, err = c.ImportContacts(bundle, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Imported) != 0 || len(result.Unchanged) != 1 {
+		t.Fatalf("unexpected result on re-import: %+v", result)
+	}
+
+	var wrongKey [32]byte
+	if _, err := c.ImportContacts(bundle, RawStateKey(&wrongKey)); err != ErrWrongStateKey {
+		t.Fatalf("expected ErrWrongStateKey, got %v", err)
+	}
+
+	otherPub, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	other := newContactsTestClient(otherPub, otherPriv)
+	if _, err := other.ImportContacts(bundle, key); err != ErrContactsSigner {
+		t.Fatalf("expected ErrContactsSigner, got %v", err)
+	}
+
+	// Bundles can't bypass the extra data limit.
+	old.friends["bob@example.org"].extraData = make([]byte, MaxExtraDataSize+1)
+	bundle, err = old.ExportContacts(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newContactsTestClient(pub, priv)
+	c.init()
+	if _, err := c.ImportContacts(bundle, key); err == nil {
+		t.Fatal("imported a friend with too much extra data")
+	}
+	if len(c.friends) != 0 {
+		t.Fatalf("failed import added friends: %v", c.friends)
+	}
+}
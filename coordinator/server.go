@@ -7,6 +7,7 @@ package coordinator
 
 import (
 	"crypto/ed25519"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -50,12 +51,17 @@ type Server struct {
 	round          uint32
 	onions         [][]byte
 	closed         bool
-	shutdown       chan struct{}
+	cancel         context.CancelFunc
+	done           chan struct{}
+	latestNewRound *NewRound
 	latestMixRound *MixRound
 	latestPKGRound *PKGRound
 
 	hub *typesocket.Hub
 
+	// mixing tracks runRound goroutines so Close can wait for them.
+	mixing sync.WaitGroup
+
 	mixnetClient *mixnet.Client
 	pkgClient    *pkg.CoordinatorClient
 	cdnClient    *edhttp.Client
@@ -66,7 +72,10 @@ type Server struct {
 
 var ErrServerClosed = errors.New("coordinator: server closed")
 
-func (srv *Server) Run() error {
+// Run starts the server's round loop in the background. The loop stops
+// when ctx is canceled or when Close is called, and any rounds that are
+// in progress are abandoned.
+func (srv *Server) Run(ctx context.Context) error {
 	if srv.Service != "AddFriend" && srv.Service != "Dialing" {
 		return errors.New("unexpected service type: %q", srv.Service)
 	}
@@ -78,7 +87,8 @@ func (srv *Server) Run() error {
 		"onion": srv.incomingOnion,
 	})
 	srv.hub = &typesocket.Hub{
-		Mux: mux,
+		Mux:       mux,
+		OnConnect: srv.onConnect,
 	}
 
 	if srv.Service == "AddFriend" {
@@ -95,29 +105,40 @@ func (srv *Server) Run() error {
 		Key: srv.PrivateKey,
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
 	srv.mu.Lock()
 	srv.onions = make([][]byte, 0, 128)
 	srv.closed = false
-	srv.shutdown = make(chan struct{})
+	srv.cancel = cancel
+	srv.done = done
 	srv.mu.Unlock()
 
-	go srv.loop()
+	go func() {
+		srv.loop(ctx)
+		srv.mixing.Wait()
+		close(done)
+	}()
 	return nil
 }
 
+// Close cancels any rounds in progress and waits for the
+// round loop to exit.
 func (srv *Server) Close() error {
 	srv.mu.Lock()
-	defer srv.mu.Unlock()
-
-	// This could be better if we had Contexts everywhere,
-	// but only tests should need to close the server.
-	if !srv.closed {
-		close(srv.shutdown)
-		srv.closed = true
-		return nil
-	} else {
+	if srv.closed || srv.cancel == nil {
+		srv.mu.Unlock()
 		return ErrServerClosed
 	}
+	srv.closed = true
+	cancel := srv.cancel
+	done := srv.done
+	srv.mu.Unlock()
+
+	cancel()
+	<-done
+	return nil
 }
 
 func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -161,21 +182,30 @@ type MailboxURL struct {
 	NumMailboxes uint32
 }
 
+// onConnect replays the announcements for the current round so that
+// clients that (re)connect in the middle of a round can participate.
 func (srv *Server) onConnect(c typesocket.Conn) error {
 	srv.mu.Lock()
+	newRound := srv.latestNewRound
 	mixRound := srv.latestMixRound
 	pkgRound := srv.latestPKGRound
 	srv.mu.Unlock()
 
-	if mixRound != nil {
-		err := c.Send("mix", mixRound)
-		if err != nil {
+	if newRound == nil {
+		return nil
+	}
+	if err := c.Send("newround", newRound); err != nil {
+		return err
+	}
+
+	if pkgRound != nil && pkgRound.Round == newRound.Round {
+		if err := c.Send("pkg", pkgRound); err != nil {
 			return err
 		}
 	}
 
-	if pkgRound != nil {
-		return c.Send("pkg", pkgRound)
+	if mixRound != nil && mixRound.MixSettings.Round == newRound.Round {
+		return c.Send("mix", mixRound)
 	}
 
 	return nil
@@ -197,14 +227,18 @@ func (srv *Server) incomingOnion(c typesocket.Conn, o OnionMsg) {
 	}
 }
 
-func (srv *Server) prepCDN(cdnServer config.CDNServerConfig, lastMixer mixnet.PublicServerConfig, service string, round uint32) error {
+func (srv *Server) prepCDN(ctx context.Context, cdnServer config.CDNServerConfig, lastMixer mixnet.PublicServerConfig, service string, round uint32) error {
 	url := fmt.Sprintf("https://%s/newbucket?bucket=%s/%d&uploader=%s",
 		cdnServer.Address,
 		service,
 		round,
 		base32.EncodeToString(lastMixer.Key),
 	)
-	resp, err := srv.cdnClient.Post(cdnServer.Key, url, "", nil)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := srv.cdnClient.Do(cdnServer.Key, req.WithContext(ctx))
 	if err != nil {
 		return errors.Wrap(err, "POST error")
 	}
@@ -216,12 +250,12 @@ func (srv *Server) prepCDN(cdnServer config.CDNServerConfig, lastMixer mixnet.Pu
 	return nil
 }
 
-func (srv *Server) loop() {
+func (srv *Server) loop(ctx context.Context) {
 	for {
 		currentConfig, err := srv.ConfigClient.CurrentConfig(srv.Service)
 		if err != nil {
 			log.Errorf("failed to fetch current config: %s", err)
-			if !srv.sleep(10 * time.Second) {
+			if !sleep(ctx, 10*time.Second) {
 				break
 			}
 			continue
@@ -232,12 +266,14 @@ func (srv *Server) loop() {
 		var mixServers []mixnet.PublicServerConfig
 		var cdnServer config.CDNServerConfig
 		var pkgServers []pkg.PublicServerConfig
+		var pkgThreshold int
 		switch srv.Service {
 		case "AddFriend":
 			conf := currentConfig.Inner.(*config.AddFriendConfig)
 			mixServers = conf.MixServers
 			cdnServer = conf.CDNServer
 			pkgServers = conf.PKGServers
+			pkgThreshold = conf.PKGQuorum()
 			rawServiceData = addfriend.ServiceData{
 				CDNKey:       cdnServer.Key,
 				CDNAddress:   cdnServer.Address,
@@ -271,26 +307,46 @@ func (srv *Server) loop() {
 
 		logger.Info("Starting new round")
 
-		srv.hub.Broadcast("newround", NewRound{
+		newRound := &NewRound{
 			Round:      round,
 			ConfigHash: configHash,
-		})
+		}
+		srv.mu.Lock()
+		srv.latestNewRound = newRound
+		srv.mu.Unlock()
 
-		time.Sleep(500 * time.Millisecond)
+		srv.hub.Broadcast("newround", newRound)
 
-		// TODO perhaps pkg.NewRound, mixnet.NewRound, hub.Broadcast, etc
-		// should take a Context for better cancelation.
+		if !sleep(ctx, 500*time.Millisecond) {
+			break
+		}
 
 		if srv.Service == "AddFriend" {
-			logger.WithFields(log.Fields{"numPKG": len(pkgServers)}).Info("Requesting PKG keys")
-			pkgSettings, err := srv.pkgClient.NewRound(pkgServers, round)
+			logger.WithFields(log.Fields{"numPKG": len(pkgServers), "threshold": pkgThreshold}).Info("Requesting PKG keys")
+			pkgSettings, err := srv.pkgClient.NewQuorumRound(ctx, pkgServers, pkgThreshold, round)
 			if err != nil {
-				logger.WithFields(log.Fields{"call": "pkg.NewRound"}).Errorf("pkg.NewRound failed: %s", err)
-				if !srv.sleep(10 * time.Second) {
+				if roundErr, ok := err.(*pkg.RoundError); ok {
+					for _, e := range roundErr.Errors {
+						logger.WithFields(log.Fields{
+							"pkg":      e.Server.Address,
+							"phase":    e.Phase,
+							"attempts": e.Attempts,
+						}).Errorf("PKG failed: %s", e.Err)
+					}
+				}
+				logger.WithFields(log.Fields{"call": "pkg.NewQuorumRound"}).Errorf("pkg.NewQuorumRound failed: %s", err)
+				if !sleep(ctx, 10*time.Second) {
 					break
 				}
 				continue
 			}
+			if len(pkgSettings) < len(pkgServers) {
+				for _, pkgServer := range pkgServers {
+					if _, ok := pkgSettings[hex.EncodeToString(pkgServer.Key)]; !ok {
+						logger.WithFields(log.Fields{"pkg": pkgServer.Address}).Warn("PKG left out of round")
+					}
+				}
+			}
 
 			pkgRound := &PKGRound{
 				Round:       round,
@@ -302,12 +358,12 @@ func (srv *Server) loop() {
 
 			srv.hub.Broadcast("pkg", pkgRound)
 
-			if !srv.sleep(srv.PKGWait) {
+			if !sleep(ctx, srv.PKGWait) {
 				break
 			}
 		}
 
-		err = srv.prepCDN(cdnServer, mixServers[len(mixServers)-1], srv.Service, round)
+		err = srv.prepCDN(ctx, cdnServer, mixServers[len(mixServers)-1], srv.Service, round)
 		if err != nil {
 			logger.Errorf("error preparing CDN for round: %s", err)
 			break
@@ -318,10 +374,10 @@ func (srv *Server) loop() {
 			Round:          round,
 			RawServiceData: rawServiceData,
 		}
-		mixSigs, err := srv.mixnetClient.NewRound(context.Background(), mixServers, &mixSettings)
+		mixSigs, err := srv.mixnetClient.NewRound(ctx, mixServers, &mixSettings)
 		if err != nil {
 			logger.WithFields(log.Fields{"call": "mixnet.NewRound"}).Errorf("mixnet.NewRound failed: %s", err)
-			if !srv.sleep(10 * time.Second) {
+			if !sleep(ctx, 10*time.Second) {
 				break
 			}
 			continue
@@ -340,16 +396,22 @@ func (srv *Server) loop() {
 		logger.WithFields(log.Fields{"wait": srv.MixWait}).Info("Announcing mixnet settings")
 		srv.hub.Broadcast("mix", mixRound)
 
-		if !srv.sleep(srv.MixWait) {
+		if !sleep(ctx, srv.MixWait) {
 			break
 		}
 
 		srv.mu.Lock()
-		go srv.runRound(context.Background(), mixServers[0], round, srv.onions)
+		onions := srv.onions
 		srv.onions = make([][]byte, 0, len(srv.onions))
 		srv.mu.Unlock()
 
-		if !srv.sleep(srv.RoundWait) {
+		srv.mixing.Add(1)
+		go func() {
+			srv.runRound(ctx, mixServers[0], round, onions)
+			srv.mixing.Done()
+		}()
+
+		if !sleep(ctx, srv.RoundWait) {
 			break
 		}
 	}
@@ -357,10 +419,12 @@ func (srv *Server) loop() {
 	srv.Log.Error("Shutting down")
 }
 
-func (srv *Server) sleep(d time.Duration) bool {
+// sleep waits for the duration d, returning false if
+// ctx is canceled before then.
+func sleep(ctx context.Context, d time.Duration) bool {
 	timer := time.NewTimer(d)
 	select {
-	case <-srv.shutdown:
+	case <-ctx.Done():
 		timer.Stop()
 		return false
 	case <-timer.C:
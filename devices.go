@@ -0,0 +1,398 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+// Multi-device support
+//
+// Linked devices share the user's username, long-term key, and PKG login
+// key, so every device extracts the same IBE keys, scans the same add-friend
+// mailbox, and computes the same dial tokens. The keywheel is a hash chain,
+// so devices that start with the same keywheel entry for a friend stay in
+// sync without communicating.
+//
+// The only state that devices must exchange is the outcome of the add-friend
+// protocol. To that end, linked devices share a device key. DH keys in friend
+// requests are random, as usual. After sending a friend request, the device
+// sends an introduction to its own username (using an otherwise idle
+// add-friend round) carrying a tag for the request and the request's DH
+// private key, encrypted with the device key. A sibling device that sees the
+// tag completes the friendship when the friend's intro arrives, or
+// immediately if it already has the friend's intro, and then erases the DH
+// key. DH keys are never derived from the device key, so a device key that
+// leaks later does not reveal keywheel secrets by itself.
+
+// maxDeviceSyncTags bounds the number of unmatched sync tags a client keeps.
+const maxDeviceSyncTags = 256
+
+// deviceSync is a tag for a friend request sent by one of the user's
+// devices. The tag is an HMAC of the friend's username and DialRound,
+// so only linked devices can recognize it.
+//
+//easyjson:readable
+type deviceSync struct {
+	Tag       *[16]byte
+	DialRound uint32
+
+	// DHPrivateKey is the request's DH private key. The sending device
+	// erases its copy once the sync intro is sent, and sibling devices
+	// erase theirs once the friendship is completed or the tag expires.
+	DHPrivateKey *[32]byte
+
+	// Round is the add-friend round the tag was received in.
+	Round uint32
+}
+
+func (s *deviceSync) erase() {
+	if s.DHPrivateKey != nil {
+		*s.DHPrivateKey = [32]byte{}
+		s.DHPrivateKey = nil
+	}
+}
+
+func deviceSyncTag(key *[32]byte, username string, dialRound uint32) *[16]byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write([]byte("alpenhorn device sync tag"))
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], dialRound)
+	h.Write(buf[:])
+	h.Write([]byte(username))
+
+	tag := new([16]byte)
+	copy(tag[:], h.Sum(nil))
+	return tag
+}
+
+// syncKeyPad returns the pad used to encrypt the DH private key in a sync
+// intro. The nonce is chosen at random for each sync intro.
+func syncKeyPad(key *[32]byte, tag *[16]byte, nonce []byte) []byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write([]byte("alpenhorn device sync key"))
+	h.Write(tag[:])
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+// queueDeviceSync queues a sync intro for the sent request if the user
+// has linked devices.
+func (c *Client) queueDeviceSync(sent *sentFriendRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.deviceKey == nil {
+		return
+	}
+	dhPrivate := new([32]byte)
+	*dhPrivate = *sent.DHPrivateKey
+	c.deviceSyncQueue = append(c.deviceSyncQueue, &deviceSync{
+		Tag:          deviceSyncTag(c.deviceKey, sent.Username, sent.DialRound),
+		DialRound:    sent.DialRound,
+		DHPrivateKey: dhPrivate,
+	})
+}
+
+func (c *Client) nextDeviceSync() *deviceSync {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.deviceSyncQueue) == 0 {
+		return nil
+	}
+	sync := c.deviceSyncQueue[0]
+	c.deviceSyncQueue = c.deviceSyncQueue[1:]
+	return sync
+}
+
+// genSyncIntro generates an introduction addressed to the user's own
+// username that carries a sync tag and a random nonce in place of the DH
+// public key, and the encrypted DH private key in place of the server
+// multisignature (see introduction.SignSync). The sync's copy of the DH
+// private key is erased.
+func (c *Client) genSyncIntro(st *addFriendRoundState, sync *deviceSync) *introduction {
+	defer sync.erase()
+
+	c.mu.Lock()
+	key := c.deviceKey
+	c.mu.Unlock()
+
+	intro := new(introduction)
+	id := pkg.ValidUsernameToIdentity(c.Username)
+	copy(intro.Username[:], id[:])
+
+	copy(intro.DHPublicKey[:16], sync.Tag[:])
+	if _, err := io.ReadFull(rand.Reader, intro.DHPublicKey[16:]); err != nil {
+		panic("rand.Reader: " + err.Error())
+	}
+	copy(intro.LongTermKey[:], c.LongTermPublicKey[:])
+
+	intro.DialingRound = sync.DialRound
+
+	pad := syncKeyPad(key, sync.Tag, intro.DHPublicKey[16:])
+	for i := range intro.ServerMultisig {
+		intro.ServerMultisig[i] = sync.DHPrivateKey[i] ^ pad[i]
+	}
+	zero(pad)
+
+	intro.SignSync(c.LongTermPrivateKey)
+
+	st.SyncTag = sync.Tag
+
+	return intro
+}
+
+// handleDeviceSync handles a sync intro from one of the user's devices.
+// If the client already has the friend's intro, the friendship is
+// completed right away. Otherwise, the tag and DH key are kept until
+// the friend's intro arrives (see matchDeviceSync). Sync intros sent
+// by this device (ownTag) are ignored.
+func (c *Client) handleDeviceSync(intro *introduction, round uint32, ownTag *[16]byte) {
+	tag := new([16]byte)
+	copy(tag[:], intro.DHPublicKey[:16])
+	if ownTag != nil && *ownTag == *tag {
+		return
+	}
+	dialRound := intro.DialingRound
+
+	c.mu.Lock()
+	key := c.deviceKey
+	if key == nil {
+		c.mu.Unlock()
+		return
+	}
+
+	dhPrivate := new([32]byte)
+	pad := syncKeyPad(key, tag, intro.DHPublicKey[16:])
+	for i := range dhPrivate {
+		dhPrivate[i] = intro.ServerMultisig[i] ^ pad[i]
+	}
+	zero(pad)
+	sync := &deviceSync{
+		Tag:          tag,
+		DialRound:    dialRound,
+		DHPrivateKey: dhPrivate,
+		Round:        round,
+	}
+
+	var in *IncomingFriendRequest
+	for _, req := range c.incomingFriendRequests {
+		if req.DialRound == dialRound && hmac.Equal(deviceSyncTag(key, req.Username, dialRound)[:], tag[:]) {
+			in = req
+			break
+		}
+	}
+	if in == nil {
+		for _, s := range c.deviceSyncTags {
+			if s.DialRound == dialRound && *s.Tag == *tag {
+				c.mu.Unlock()
+				sync.erase()
+				return
+			}
+		}
+		c.deviceSyncTags = append(c.deviceSyncTags, sync)
+		if n := len(c.deviceSyncTags); n > maxDeviceSyncTags {
+			for _, s := range c.deviceSyncTags[:n-maxDeviceSyncTags] {
+				s.erase()
+			}
+			c.deviceSyncTags = c.deviceSyncTags[n-maxDeviceSyncTags:]
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	c.newFriend(in, siblingSentRequest(sync, in))
+}
+
+// matchDeviceSync returns the friend request that one of the user's other
+// devices sent and that the incoming request responds to, or nil.
+func (c *Client) matchDeviceSync(in *IncomingFriendRequest) *sentFriendRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.deviceKey == nil || len(c.deviceSyncTags) == 0 {
+		return nil
+	}
+	tag := deviceSyncTag(c.deviceKey, in.Username, in.DialRound)
+	for i, s := range c.deviceSyncTags {
+		if s.DialRound == in.DialRound && hmac.Equal(s.Tag[:], tag[:]) {
+			c.deviceSyncTags = append(c.deviceSyncTags[:i], c.deviceSyncTags[i+1:]...)
+			return siblingSentRequest(s, in)
+		}
+	}
+	return nil
+}
+
+// siblingSentRequest reconstructs the request that a linked device sent
+// in response to (or that was answered by) the incoming request. The
+// returned request takes ownership of the sync's DH private key, which
+// is erased when the friendship is completed.
+func siblingSentRequest(sync *deviceSync, in *IncomingFriendRequest) *sentFriendRequest {
+	dhPrivate := sync.DHPrivateKey
+	sync.DHPrivateKey = nil
+	return &sentFriendRequest{
+		Username: in.Username,
+		// Only the sending device can enforce its ExpectedKey and
+		// report key changes; linked devices accept its decision.
+		ExpectedKey:  in.LongTermKey,
+		DialRound:    in.DialRound,
+		DHPrivateKey: dhPrivate,
+		client:       in.client,
+	}
+}
+
+// expireDeviceSyncTagsLocked erases the sync tags that have expired as of
+// the given add-friend round and reports whether any did. The caller must
+// hold c.mu.
+func (c *Client) expireDeviceSyncTagsLocked(now time.Time, round uint32) bool {
+	tags := c.deviceSyncTags[:0]
+	for _, s := range c.deviceSyncTags {
+		if c.expired(time.Time{}, s.Round, now, round) {
+			s.erase()
+		} else {
+			tags = append(tags, s)
+		}
+	}
+	expired := len(tags) < len(c.deviceSyncTags)
+	c.deviceSyncTags = tags
+	return expired
+}
+
+// Device linking
+
+var linkMagic = []byte("alpenhorn-link-v1\n")
+
+type linkBundle struct {
+	State    []byte
+	Keywheel []byte
+}
+
+// LinkDevice prepares a bundle for linking a new device to the user's
+// account. The bundle contains the user's long-term keys, friends, and
+// keywheel, encrypted with a random key that is returned as a short code.
+// The application should transfer the bundle and code to the new device
+// over separate channels (e.g., the bundle over the network and the code
+// as a QR code) and pass them to LinkClient on the new device.
+//
+// After linking, both devices send and receive friend requests and calls,
+// and friendships confirmed on one device are picked up by the other.
+func (c *Client) LinkDevice() (bundle []byte, code string, err error) {
+	c.init()
+
+	c.mu.Lock()
+	if c.deviceKey == nil {
+		key := new([32]byte)
+		if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+			c.mu.Unlock()
+			return nil, "", err
+		}
+		c.deviceKey = key
+		if err := c.persistLocked(); err != nil {
+			c.mu.Unlock()
+			return nil, "", err
+		}
+	}
+	st := c.persistedStateLocked()
+	// Queued requests are sent by this device only.
+	st.OutgoingFriendRequests = nil
+	st.DeviceSyncQueue = nil
+	state, err := json.Marshal(st)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, "", err
+	}
+	keywheel, err := c.wheel.MarshalBinary()
+	c.mu.Unlock()
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err := json.Marshal(&linkBundle{
+		State:    state,
+		Keywheel: keywheel,
+	})
+	zero(state)
+	zero(keywheel)
+	if err != nil {
+		return nil, "", err
+	}
+
+	linkKey := new([32]byte)
+	if _, err := io.ReadFull(rand.Reader, linkKey[:]); err != nil {
+		return nil, "", err
+	}
+	ctxt, err := RawStateKey(linkKey).seal(data)
+	zero(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bundle = append(append([]byte(nil), linkMagic...), ctxt...)
+	return bundle, base32.EncodeToString(linkKey[:]), nil
+}
+
+// LinkClient creates a client for a new device from a bundle and code
+// created by LinkDevice. The application must set the returned client's
+// Handler, ConfigClient, and Store (or persist paths), and call Persist,
+// before connecting.
+func LinkClient(bundle []byte, code string) (*Client, error) {
+	if !bytes.HasPrefix(bundle, linkMagic) {
+		return nil, errors.New("not a device link bundle")
+	}
+	keyBytes, err := base32.DecodeString(strings.TrimSpace(code))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding link code")
+	}
+	if len(keyBytes) != 32 {
+		return nil, errors.New("invalid link code length: got %d bytes, want 32", len(keyBytes))
+	}
+	linkKey := new([32]byte)
+	copy(linkKey[:], keyBytes)
+
+	data, err := RawStateKey(linkKey).open(bundle[len(linkMagic):])
+	if err != nil {
+		return nil, err
+	}
+	defer zero(data)
+
+	lb := new(linkBundle)
+	if err := json.Unmarshal(data, lb); err != nil {
+		return nil, errors.Wrap(err, "decoding link bundle")
+	}
+	defer zero(lb.State)
+	defer zero(lb.Keywheel)
+
+	st := new(persistedState)
+	if err := json.Unmarshal(lb.State, st); err != nil {
+		return nil, errors.Wrap(err, "decoding link bundle state")
+	}
+	if st.DeviceKey == nil {
+		return nil, errors.New("link bundle has no device key")
+	}
+
+	c := new(Client)
+	if err := c.wheel.UnmarshalBinary(lb.Keywheel); err != nil {
+		return nil, errors.Wrap(err, "decoding link bundle keywheel")
+	}
+	c.mu.Lock()
+	c.loadStateLocked(st)
+	c.mu.Unlock()
+	return c, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestDeviceSyncIntro(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	deviceKey := new([32]byte)
+	rand.Read(deviceKey[:])
+
+	newDevice := func() *Client {
+		return &Client{
+			Username:           "alice@example.org",
+			LongTermPublicKey:  publicKey,
+			LongTermPrivateKey: privateKey,
+			deviceKey:          deviceKey,
+		}
+	}
+	alice1 := newDevice()
+	alice2 := newDevice()
+
+	_, dhPrivate, _ := box.GenerateKey(rand.Reader)
+	sent := &sentFriendRequest{
+		Username:     "bob@example.org",
+		DialRound:    42,
+		DHPrivateKey: dhPrivate,
+	}
+	alice1.queueDeviceSync(sent)
+	sync := alice1.nextDeviceSync()
+	if sync == nil {
+		t.Fatal("no device sync queued")
+	}
+	if sync.DHPrivateKey == sent.DHPrivateKey {
+		t.Fatal("device sync shares the sent request's DH key")
+	}
+
+	st := &addFriendRoundState{Round: 7}
+	intro := alice1.genSyncIntro(st, sync)
+	if sync.DHPrivateKey != nil {
+		t.Fatal("DH key not erased after sending sync intro")
+	}
+	if *st.SyncTag != *deviceSyncTag(deviceKey, "bob@example.org", 42) {
+		t.Fatal("round state has the wrong sync tag")
+	}
+
+	msg := mustMarshal(intro)
+	recv := new(introduction)
+	if err := recv.UnmarshalBinary(msg); err != nil {
+		t.Fatal(err)
+	}
+	if !recv.VerifySync(publicKey) {
+		t.Fatal("failed to verify sync intro")
+	}
+	tampered := *recv
+	tampered.ServerMultisig[0] ^= 1
+	if tampered.VerifySync(publicKey) {
+		t.Fatal("verified tampered sync intro")
+	}
+
+	// The sending device ignores its own sync intro.
+	alice1.handleDeviceSync(recv, st.Round, st.SyncTag)
+	if len(alice1.deviceSyncTags) != 0 {
+		t.Fatal("sending device kept its own sync tag")
+	}
+
+	alice2.handleDeviceSync(recv, st.Round, nil)
+	if len(alice2.deviceSyncTags) != 1 {
+		t.Fatalf("expected 1 sync tag, got %d", len(alice2.deviceSyncTags))
+	}
+
+	in := &IncomingFriendRequest{
+		Username:  "bob@example.org",
+		DialRound: 42,
+		client:    alice2,
+	}
+	sibling := alice2.matchDeviceSync(in)
+	if sibling == nil {
+		t.Fatal("no matching device sync")
+	}
+	if *sibling.DHPrivateKey != *dhPrivate {
+		t.Fatal("sibling device recovered the wrong DH key")
+	}
+	if len(alice2.deviceSyncTags) != 0 {
+		t.Fatal("matched sync tag was not removed")
+	}
+}
@@ -7,6 +7,7 @@ package alpenhorn
 import (
 	"crypto/ed25519"
 	"sync/atomic"
+	"time"
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
 
@@ -26,6 +27,19 @@ type dialingRoundState struct {
 	Round        uint32
 	Config       *config.DialingConfig
 	ConfigParent *config.SignedConfig
+
+	// announced is closed once the round's config is known
+	// (see addFriendRoundState).
+	announced chan struct{}
+}
+
+func (st *dialingRoundState) isAnnounced() bool {
+	select {
+	case <-st.announced:
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *Client) dialingMux() typesocket.Mux {
@@ -42,24 +56,46 @@ func (c *Client) dialingRoundError(conn typesocket.Conn, v coordinator.RoundErro
 }
 
 func (c *Client) newDialingRound(conn typesocket.Conn, v coordinator.NewRound) {
+	c.recordRound("Dialing", v.Round)
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	// Catch up the keywheel the first time we learn the current round
+	// on a new connection, since the client may have been offline for
+	// a long time. Keys for the previous round are kept because its
+	// mailbox may not have been scanned yet.
+	if !c.wheelAdvanced && v.Round > 1 {
+		c.wheelAdvanced = true
+		go func(round uint32) {
+			c.wheel.Advance(round)
+			// Persist the keywheel so the erased keys are gone from disk.
+			if err := c.persistKeywheel(); err != nil {
+				panic(err)
+			}
+		}(v.Round - 1)
+	}
+
 	st, ok := c.dialingRounds[v.Round]
-	if ok {
+	if ok && st.isAnnounced() {
 		if st.ConfigParent.Hash() != v.ConfigHash {
 			c.Handler.Error(errors.New("coordinator announced different configs round %d", v.Round))
 		}
 		return
 	}
+	if !ok {
+		st = &dialingRoundState{
+			Round:     v.Round,
+			announced: make(chan struct{}),
+		}
+		c.dialingRounds[v.Round] = st
+	}
 
 	// common case
 	if v.ConfigHash == c.dialingConfigHash {
-		c.dialingRounds[v.Round] = &dialingRoundState{
-			Round:        v.Round,
-			Config:       c.dialingConfig.Inner.(*config.DialingConfig),
-			ConfigParent: c.dialingConfig,
-		}
+		st.Config = c.dialingConfig.Inner.(*config.DialingConfig)
+		st.ConfigParent = c.dialingConfig
+		close(st.announced)
 		return
 	}
 
@@ -79,21 +115,42 @@ func (c *Client) newDialingRound(conn typesocket.Conn, v coordinator.NewRound) {
 		panic("failed to persist state: " + err.Error())
 	}
 
-	c.dialingRounds[v.Round] = &dialingRoundState{
-		Round:        v.Round,
-		Config:       newConfig.Inner.(*config.DialingConfig),
-		ConfigParent: newConfig,
+	st.Config = newConfig.Inner.(*config.DialingConfig)
+	st.ConfigParent = newConfig
+	close(st.announced)
+}
+
+// dialingRoundState returns the state for the given round once the
+// round's config is known (see addFriendRoundState), or nil if the
+// round is not announced in time.
+func (c *Client) dialingRoundState(round uint32) *dialingRoundState {
+	c.mu.Lock()
+	st, ok := c.dialingRounds[round]
+	if !ok {
+		st = &dialingRoundState{
+			Round:     round,
+			announced: make(chan struct{}),
+		}
+		c.dialingRounds[round] = st
+	}
+	c.mu.Unlock()
+
+	timer := time.NewTimer(roundAnnounceTimeout)
+	defer timer.Stop()
+	select {
+	case <-st.announced:
+		return st
+	case <-timer.C:
+		c.Handler.Error(errors.New("dialing round %d was not announced", round))
+		return nil
 	}
 }
 
 func (c *Client) sendDialingOnion(conn typesocket.Conn, v coordinator.MixRound) {
 	round := v.MixSettings.Round
 
-	c.mu.Lock()
-	st, ok := c.dialingRounds[round]
-	c.mu.Unlock()
-	if !ok {
-		c.Handler.Error(errors.New("sendDialingOnion: round %d not configured", round))
+	st := c.dialingRoundState(round)
+	if st == nil {
 		return
 	}
 
@@ -144,6 +201,7 @@ func (c *Client) sendDialingOnion(conn typesocket.Conn, v coordinator.MixRound)
 		Onion: onion,
 	}
 	conn.Send("onion", omsg)
+	c.recordOnion("Dialing", round, call != nil)
 }
 
 func (c *Client) nextOutgoingCall(round uint32) *OutgoingCall {
@@ -163,12 +221,14 @@ func (c *Client) scanBloomFilter(conn typesocket.Conn, v coordinator.MailboxURL)
 	c.mu.Lock()
 	st, ok := c.dialingRounds[v.Round]
 	c.mu.Unlock()
-	if !ok {
+	if !ok || !st.isAnnounced() {
 		return
 	}
 
 	mailboxID := usernameToMailbox(c.Username, v.NumMailboxes)
+	start := time.Now()
 	mailbox, err := c.fetchMailbox(st.Config.CDNServer, v.URL, mailboxID)
+	c.recordFetch("Dialing", v.Round, len(mailbox), time.Since(start), err)
 	if err != nil {
 		c.Handler.Error(errors.Wrap(err, "fetching mailbox"))
 		return
@@ -179,7 +239,7 @@ func (c *Client) scanBloomFilter(conn typesocket.Conn, v coordinator.MailboxURL)
 		c.Handler.Error(errors.Wrap(err, "decoding bloom filter"))
 	}
 
-	allTokens := c.wheel.IncomingDialTokens(c.Username, v.Round, IntentMax)
+	allTokens := c.wheel.IncomingDialTokens(c.Username, v.Round, c.NumIntents())
 	for _, user := range allTokens {
 		for intent, token := range user.Tokens {
 			if filter.Test(token[:]) {
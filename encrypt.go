@@ -0,0 +1,204 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Encrypted client state starts with this magic string, which
+// can't be confused with the plaintext (JSON) format.
+var encryptedStateMagic = []byte("alpenhorn-state-v1\n")
+
+// Key derivation methods for encrypted client state.
+const (
+	kdfNone   byte = 0
+	kdfScrypt byte = 1
+)
+
+const scryptSaltSize = 16
+
+var ErrEncryptedState = errors.New("client state is encrypted")
+var ErrWrongStateKey = errors.New("wrong key for encrypted client state")
+
+// A StateKey encrypts the client state at rest. The key is either derived
+// from a passphrase using scrypt or given directly (e.g., from a key file).
+type StateKey struct {
+	passphrase []byte
+
+	mu   sync.Mutex
+	salt []byte
+	key  *[32]byte
+}
+
+// PassphraseStateKey returns a StateKey that derives the
+// encryption key from the given passphrase.
+func PassphraseStateKey(passphrase []byte) *StateKey {
+	return &StateKey{
+		passphrase: append([]byte(nil), passphrase...),
+	}
+}
+
+// RawStateKey returns a StateKey that uses the given key directly.
+func RawStateKey(key *[32]byte) *StateKey {
+	k := new([32]byte)
+	*k = *key
+	return &StateKey{
+		key: k,
+	}
+}
+
+// ReadStateKeyFile reads a base32-encoded 32-byte key from the file at path.
+func ReadStateKeyFile(path string) (*StateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := base32.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding key file %s", path)
+	}
+	if len(bs) != 32 {
+		return nil, errors.New("unexpected key length in %s: got %d bytes, want 32", path, len(bs))
+	}
+	key := new([32]byte)
+	copy(key[:], bs)
+	return RawStateKey(key), nil
+}
+
+// boxKey returns the secretbox key for the given salt. The derived key
+// is cached so that persisting the client doesn't run scrypt every time.
+func (k *StateKey) boxKey(salt []byte) (*[32]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.passphrase == nil {
+		return k.key, nil
+	}
+	if k.key != nil && bytes.Equal(k.salt, salt) {
+		return k.key, nil
+	}
+
+	dk, err := scrypt.Key(k.passphrase, salt, 2<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	k.salt = append([]byte(nil), salt...)
+	k.key = new([32]byte)
+	copy(k.key[:], dk)
+	return k.key, nil
+}
+
+// currentSalt returns the salt to use when sealing new state.
+func (k *StateKey) currentSalt() ([]byte, error) {
+	k.mu.Lock()
+	salt := k.salt
+	k.mu.Unlock()
+	if salt != nil {
+		return salt, nil
+	}
+
+	salt = make([]byte, scryptSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func isEncryptedState(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedStateMagic)
+}
+
+// seal encrypts the client state. The format is:
+//
+//	magic || kdf || salt (scrypt only) || nonce || secretbox(state)
+func (k *StateKey) seal(state []byte) ([]byte, error) {
+	out := append([]byte(nil), encryptedStateMagic...)
+
+	var salt []byte
+	if k.passphrase == nil {
+		out = append(out, kdfNone)
+	} else {
+		var err error
+		salt, err = k.currentSalt()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, kdfScrypt)
+		out = append(out, salt...)
+	}
+
+	key, err := k.boxKey(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce[:]...)
+
+	return secretbox.Seal(out, state, &nonce, key), nil
+}
+
+func (k *StateKey) open(data []byte) ([]byte, error) {
+	if !isEncryptedState(data) {
+		return nil, errors.New("client state is not encrypted")
+	}
+	data = data[len(encryptedStateMagic):]
+	if len(data) < 1 {
+		return nil, errors.New("short encrypted state")
+	}
+
+	kdf := data[0]
+	data = data[1:]
+
+	var salt []byte
+	switch kdf {
+	case kdfNone:
+		if k.passphrase != nil {
+			return nil, errors.New("client state is encrypted with a key file, not a passphrase")
+		}
+	case kdfScrypt:
+		if k.passphrase == nil {
+			return nil, errors.New("client state is encrypted with a passphrase, not a key file")
+		}
+		if len(data) < scryptSaltSize {
+			return nil, errors.New("short encrypted state")
+		}
+		salt = data[:scryptSaltSize]
+		data = data[scryptSaltSize:]
+	default:
+		return nil, errors.New("unknown key derivation method: %d", kdf)
+	}
+
+	if len(data) < 24+secretbox.Overhead {
+		return nil, errors.New("short encrypted state")
+	}
+	var nonce [24]byte
+	copy(nonce[:], data[:24])
+
+	key, err := k.boxKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	state, ok := secretbox.Open(nil, data[24:], &nonce, key)
+	if !ok {
+		return nil, ErrWrongStateKey
+	}
+	return state, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/crypto/rand"
+)
+
+func TestStateKeySealOpen(t *testing.T) {
+	state := []byte(`{"Username": "alice@example.org"}`)
+
+	rawKey := new([32]byte)
+	rawKey[0] = 42
+	keys := []*StateKey{
+		PassphraseStateKey([]byte("correct horse battery staple")),
+		RawStateKey(rawKey),
+	}
+
+	for _, key := range keys {
+		ctxt, err := key.seal(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isEncryptedState(ctxt) {
+			t.Fatalf("sealed state is not marked as encrypted")
+		}
+		if bytes.Contains(ctxt, []byte("alice")) {
+			t.Fatalf("sealed state contains plaintext")
+		}
+
+		msg, err := key.open(ctxt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, state) {
+			t.Fatalf("got %q, want %q", msg, state)
+		}
+	}
+
+	ctxt, err := keys[0].seal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey := PassphraseStateKey([]byte("wrong"))
+	if _, err := wrongKey.open(ctxt); err != ErrWrongStateKey {
+		t.Fatalf("expected ErrWrongStateKey, got %v", err)
+	}
+	if _, err := keys[1].open(ctxt); err == nil {
+		t.Fatalf("expected error opening passphrase-encrypted state with raw key")
+	}
+
+	if isEncryptedState(state) {
+		t.Fatalf("plaintext state detected as encrypted")
+	}
+}
+
+func TestLoadEncryptedClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_encrypt_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clientPath := filepath.Join(dir, "client")
+	keywheelPath := filepath.Join(dir, "keywheel")
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	c := &Client{
+		Username:            "alice@example.org",
+		LongTermPublicKey:   pub,
+		LongTermPrivateKey:  priv,
+		ClientPersistPath:   clientPath,
+		KeywheelPersistPath: keywheelPath,
+	}
+	c.addFriendConfig = testConfig("AddFriend", &config.AddFriendConfig{Version: config.AddFriendConfigVersion})
+	c.dialingConfig = testConfig("Dialing", &config.DialingConfig{Version: config.DialingConfigVersion})
+	if err := c.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	var k [32]byte
+	rand.Read(k[:])
+	store := &FileStore{ClientPath: clientPath, KeywheelPath: keywheelPath}
+
+	// Plaintext state is loaded and sealed on disk.
+	c2, err := LoadEncryptedClient(store, RawStateKey(&k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.Username != c.Username {
+		t.Fatalf("got username %q, want %q", c2.Username, c.Username)
+	}
+	data, err := ioutil.ReadFile(clientPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedState(data) || bytes.Contains(data, []byte("alice")) {
+		t.Fatal("client state was not encrypted on disk")
+	}
+
+	if _, err := LoadClient(clientPath, keywheelPath); err != ErrEncryptedState {
+		t.Fatalf("expected ErrEncryptedState, got %v", err)
+	}
+
+	c3, err := LoadEncryptedClient(store, RawStateKey(&k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3.Username != c.Username || !bytes.Equal(c3.LongTermPrivateKey, priv) {
+		t.Fatal("reloaded client does not match")
+	}
+}
+
+func testConfig(service string, inner config.InnerConfig) *config.SignedConfig {
+	return &config.SignedConfig{
+		Version: config.SignedConfigVersion,
+		Created: time.Now(),
+		Expires: time.Now().Add(24 * time.Hour),
+		Service: service,
+		Inner:   inner,
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"vuvuzela.io/alpenhorn/config"
+)
+
+// An Event is a value delivered by an EventStream. Each method of EventHandler
+// and of the optional handler interfaces has a corresponding event type, e.g.,
+// ConfirmedFriend corresponds to *ConfirmedFriendEvent. Applications use a
+// type switch to handle events.
+type Event interface {
+	Header() EventHeader
+}
+
+// EventHeader describes when an event happened.
+type EventHeader struct {
+	Time time.Time
+
+	// Round is the add-friend or dialing round the event belongs to.
+	// For events that are not tied to a specific round, it is the
+	// latest round of the event's protocol when the event happened.
+	// It is zero if the event is not tied to either protocol.
+	Round uint32
+}
+
+func (h EventHeader) Header() EventHeader {
+	return h
+}
+
+type ErrorEvent struct {
+	EventHeader
+	Err error
+}
+
+type ConfirmedFriendEvent struct {
+	EventHeader
+	Friend *Friend
+}
+
+type SentFriendRequestEvent struct {
+	EventHeader
+	Request *OutgoingFriendRequest
+}
+
+type ReceivedFriendRequestEvent struct {
+	EventHeader
+	Request *IncomingFriendRequest
+}
+
+type UnexpectedSigningKeyEvent struct {
+	EventHeader
+	Incoming *IncomingFriendRequest
+	Outgoing *OutgoingFriendRequest
+}
+
+type FriendKeyChangedEvent struct {
+	EventHeader
+	Friend  *Friend
+	Request *IncomingFriendRequest
+}
+
+type FriendRequestExpiredEvent struct {
+	EventHeader
+	Incoming *IncomingFriendRequest
+	Outgoing *OutgoingFriendRequest
+}
+
+type SendingCallEvent struct {
+	EventHeader
+	Call *OutgoingCall
+}
+
+type ReceivedCallEvent struct {
+	EventHeader
+	Call *IncomingCall
+}
+
+type NewConfigEvent struct {
+	EventHeader
+	Chain []*config.SignedConfig
+}
+
+type ConnectionStateEvent struct {
+	EventHeader
+	Service string
+	State   ConnectionState
+	Err     error
+}
+
+// OverflowEvent reports that the application did not keep up with the
+// EventStream and that Dropped events were discarded before this one.
+type OverflowEvent struct {
+	EventHeader
+	Dropped int
+}
+
+// EventStream is an EventHandler that delivers events on a channel so that
+// an application can handle all of its events from a single goroutine.
+// The client never blocks on an EventStream: if the channel's buffer is
+// full, events are dropped and an OverflowEvent is delivered once there
+// is room again.
+type EventStream struct {
+	// C is the channel of events.
+	C <-chan Event
+
+	client *Client
+
+	mu      sync.Mutex
+	ch      chan Event
+	dropped int
+}
+
+// Events replaces the client's Handler with a new EventStream that buffers
+// up to bufferSize events. It should be called before connecting the client.
+func (c *Client) Events(bufferSize int) *EventStream {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	ch := make(chan Event, bufferSize)
+	s := &EventStream{
+		C:      ch,
+		client: c,
+		ch:     ch,
+	}
+	c.Handler = s
+	return s
+}
+
+func (s *EventStream) send(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dropped > 0 {
+		overflow := &OverflowEvent{
+			EventHeader: EventHeader{Time: time.Now()},
+			Dropped:     s.dropped,
+		}
+		select {
+		case s.ch <- overflow:
+			s.dropped = 0
+		default:
+			s.dropped++
+			return
+		}
+	}
+
+	select {
+	case s.ch <- e:
+	default:
+		s.dropped++
+	}
+}
+
+func (s *EventStream) addFriendHeader() EventHeader {
+	return EventHeader{
+		Time:  time.Now(),
+		Round: atomic.LoadUint32(&s.client.lastAddFriendRound),
+	}
+}
+
+func (s *EventStream) dialingHeader() EventHeader {
+	return EventHeader{
+		Time:  time.Now(),
+		Round: atomic.LoadUint32(&s.client.lastDialingRound),
+	}
+}
+
+func (s *EventStream) Error(err error) {
+	s.send(&ErrorEvent{
+		EventHeader: EventHeader{Time: time.Now()},
+		Err:         err,
+	})
+}
+
+func (s *EventStream) ConfirmedFriend(f *Friend) {
+	s.send(&ConfirmedFriendEvent{
+		EventHeader: s.addFriendHeader(),
+		Friend:      f,
+	})
+}
+
+func (s *EventStream) SentFriendRequest(r *OutgoingFriendRequest) {
+	s.send(&SentFriendRequestEvent{
+		EventHeader: s.addFriendHeader(),
+		Request:     r,
+	})
+}
+
+func (s *EventStream) ReceivedFriendRequest(r *IncomingFriendRequest) {
+	h := s.addFriendHeader()
+	if r.ReceivedRound != 0 {
+		h.Round = r.ReceivedRound
+	}
+	s.send(&ReceivedFriendRequestEvent{
+		EventHeader: h,
+		Request:     r,
+	})
+}
+
+func (s *EventStream) UnexpectedSigningKey(in *IncomingFriendRequest, out *OutgoingFriendRequest) {
+	s.send(&UnexpectedSigningKeyEvent{
+		EventHeader: s.addFriendHeader(),
+		Incoming:    in,
+		Outgoing:    out,
+	})
+}
+
+func (s *EventStream) FriendKeyChanged(friend *Friend, in *IncomingFriendRequest) {
+	s.send(&FriendKeyChangedEvent{
+		EventHeader: s.addFriendHeader(),
+		Friend:      friend,
+		Request:     in,
+	})
+}
+
+func (s *EventStream) FriendRequestExpired(in *IncomingFriendRequest, out *OutgoingFriendRequest) {
+	s.send(&FriendRequestExpiredEvent{
+		EventHeader: s.addFriendHeader(),
+		Incoming:    in,
+		Outgoing:    out,
+	})
+}
+
+func (s *EventStream) SendingCall(call *OutgoingCall) {
+	h := s.dialingHeader()
+	if call.sentRound != 0 {
+		h.Round = call.sentRound
+	}
+	s.send(&SendingCallEvent{
+		EventHeader: h,
+		Call:        call,
+	})
+}
+
+func (s *EventStream) ReceivedCall(call *IncomingCall) {
+	s.send(&ReceivedCallEvent{
+		EventHeader: s.dialingHeader(),
+		Call:        call,
+	})
+}
+
+func (s *EventStream) NewConfig(chain []*config.SignedConfig) {
+	var h EventHeader
+	if len(chain) > 0 && chain[0].Service == "AddFriend" {
+		h = s.addFriendHeader()
+	} else {
+		h = s.dialingHeader()
+	}
+	s.send(&NewConfigEvent{
+		EventHeader: h,
+		Chain:       chain,
+	})
+}
+
+func (s *EventStream) ConnectionStateChanged(service string, state ConnectionState, err error) {
+	s.send(&ConnectionStateEvent{
+		EventHeader: EventHeader{Time: time.Now()},
+		Service:     service,
+		State:       state,
+		Err:         err,
+	})
+}
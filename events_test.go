@@ -0,0 +1,92 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"errors"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/config"
+)
+
+func TestEventStreamOverflow(t *testing.T) {
+	c := &Client{}
+	s := c.Events(2)
+	if c.Handler != s {
+		t.Fatal("Events did not set the client's handler")
+	}
+
+	for i := 0; i < 4; i++ {
+		s.Error(errors.New("test error"))
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := (<-s.C).(*ErrorEvent); !ok {
+			t.Fatal("expected ErrorEvent")
+		}
+	}
+
+	c.lastAddFriendRound = 42
+	s.ConfirmedFriend(&Friend{Username: "alice@example.org"})
+
+	overflow, ok := (<-s.C).(*OverflowEvent)
+	if !ok {
+		t.Fatal("expected OverflowEvent")
+	}
+	if overflow.Dropped != 2 {
+		t.Fatalf("unexpected number of dropped events: got %d, want %d", overflow.Dropped, 2)
+	}
+
+	ev, ok := (<-s.C).(*ConfirmedFriendEvent)
+	if !ok {
+		t.Fatal("expected ConfirmedFriendEvent")
+	}
+	if ev.Friend.Username != "alice@example.org" || ev.Round != 42 || ev.Time.IsZero() {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+// basicHandler implements only the required EventHandler methods.
+type basicHandler struct {
+	received   []*IncomingFriendRequest
+	unexpected []*IncomingFriendRequest
+}
+
+func (h *basicHandler) Error(error)                              {}
+func (h *basicHandler) ConfirmedFriend(*Friend)                  {}
+func (h *basicHandler) SentFriendRequest(*OutgoingFriendRequest) {}
+func (h *basicHandler) SendingCall(*OutgoingCall)                {}
+func (h *basicHandler) ReceivedCall(*IncomingCall)               {}
+func (h *basicHandler) NewConfig(chain []*config.SignedConfig)   {}
+func (h *basicHandler) ReceivedFriendRequest(in *IncomingFriendRequest) {
+	h.received = append(h.received, in)
+}
+func (h *basicHandler) UnexpectedSigningKey(in *IncomingFriendRequest, out *OutgoingFriendRequest) {
+	h.unexpected = append(h.unexpected, in)
+}
+
+func TestOptionalHandlers(t *testing.T) {
+	h := new(basicHandler)
+	c := &Client{Handler: h}
+
+	// The optional events are dropped or reported with the basic methods.
+	c.connectionStateChanged("AddFriend", Connected, nil)
+	friend := &Friend{Username: "bob@example.org"}
+	in := &IncomingFriendRequest{Username: "bob@example.org"}
+	c.friendKeyChanged(friend, in, nil)
+	c.friendKeyChanged(friend, in, &OutgoingFriendRequest{Username: "bob@example.org"})
+	if len(h.received) != 1 || len(h.unexpected) != 1 {
+		t.Fatalf("key change not reported: %d received, %d unexpected", len(h.received), len(h.unexpected))
+	}
+
+	s := c.Events(4)
+	c.connectionStateChanged("AddFriend", Connected, nil)
+	if _, ok := (<-s.C).(*ConnectionStateEvent); !ok {
+		t.Fatal("expected ConnectionStateEvent")
+	}
+	c.friendKeyChanged(friend, in, nil)
+	if _, ok := (<-s.C).(*FriendKeyChangedEvent); !ok {
+		t.Fatal("expected FriendKeyChangedEvent")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"crypto/ed25519"
 	"fmt"
 	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
 )
 
 // Friend is an entry in the client's address book.
@@ -17,7 +19,39 @@ type Friend struct {
 
 	// extraData stores application-specific data.
 	extraData []byte
-	client    *Client
+	// keyHistory records the friend's long-term keys, oldest first.
+	keyHistory []KeyRecord
+	// verified is set when the user compares safety numbers with the friend.
+	verified bool
+	client   *Client
+}
+
+// KeyRecord is an entry in a friend's key history.
+//
+//easyjson:readable
+type KeyRecord struct {
+	Key ed25519.PublicKey
+
+	// Confirmed is when the add-friend protocol completed with this key.
+	// It is zero for keys confirmed by older clients.
+	Confirmed time.Time
+}
+
+// KeyHistory returns the long-term keys that the friend has used, oldest
+// first. The last entry is the friend's current key. The client pins the
+// current key: a friend request signed by a different key is reported by
+// FriendKeyChangeHandler.FriendKeyChanged and does not replace the key unless the
+// application approves the request.
+func (f *Friend) KeyHistory() []KeyRecord {
+	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
+
+	if len(f.keyHistory) == 0 {
+		return []KeyRecord{{Key: f.LongTermKey}}
+	}
+	history := make([]KeyRecord, len(f.keyHistory))
+	copy(history, f.keyHistory)
+	return history
 }
 
 // GetFriends returns all the friends in the client's address book.
@@ -67,9 +101,13 @@ func (f *Friend) Remove() error {
 //
 // Applications should use the extra data field to store information
 // about friends instead of maintaining a separate friend list because
-// the Alpenhorn client will (eventually) ensure that the size of the
-// persisted data on disk does not leak metadata.
+// the Alpenhorn client pads the persisted data on disk so that its size
+// does not leak metadata. The data must be at most MaxExtraDataSize bytes.
 func (f *Friend) SetExtraData(data []byte) error {
+	if len(data) > MaxExtraDataSize {
+		return errors.New("extra data too large: %d bytes > %d bytes", len(data), MaxExtraDataSize)
+	}
+
 	f.client.mu.Lock()
 	f.extraData = make([]byte, len(data))
 	copy(f.extraData, data)
@@ -87,6 +125,27 @@ func (f *Friend) ExtraData() []byte {
 	return data
 }
 
+// Verified reports whether the user has verified the friend's long-term
+// key, e.g., by comparing safety numbers. The flag is cleared when the
+// friend's key changes.
+func (f *Friend) Verified() bool {
+	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
+	return f.verified
+}
+
+// SetVerified sets the friend's verified flag. Applications should only
+// mark a friend as verified after comparing the friend's SafetyNumber
+// out-of-band, e.g., in person.
+func (f *Friend) SetVerified(verified bool) error {
+	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
+
+	f.verified = verified
+	err := f.client.persistLocked()
+	return err
+}
+
 // UnsafeKeywheelState exposes the internal keywheel state for this friend.
 // This should only be used for debugging.
 func (f *Friend) UnsafeKeywheelState() (uint32, *[32]byte) {
@@ -99,16 +158,77 @@ func (f *Friend) SessionKey(round uint32) *[32]byte {
 	return f.client.wheel.SessionKey(f.Username, round)
 }
 
-// Intents are the dialing intents passed to Call.
-const IntentMax = 3
+// Intents are the dialing intents passed to Call. Their meaning is
+// defined by the application. IntentMax is the maximum number of intents
+// a client can support, and DefaultNumIntents is the number of intents
+// supported by a client that has not called SetIntents.
+//
+// Each intent costs the callee a dial token per friend per round, and
+// a caller's intent is only detected if it is less than the callee's
+// number of intents, so friends should agree on their intents.
+const (
+	IntentMax         = 16
+	DefaultNumIntents = 3
+)
+
+// SetIntents sets the names of the client's dialing intents. The number
+// of names determines how many intents the client can send and receive.
+// The intents are persisted along with the rest of the client's state.
+func (c *Client) SetIntents(names []string) error {
+	if len(names) == 0 || len(names) > IntentMax {
+		return errors.New("number of intents must be between 1 and %d, got %d", IntentMax, len(names))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.intents = append([]string(nil), names...)
+	return c.persistLocked()
+}
+
+// Intents returns the names of the client's dialing intents. If the
+// client has not called SetIntents, the names are empty strings.
+func (c *Client) Intents() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.intents == nil {
+		return make([]string, DefaultNumIntents)
+	}
+	return append([]string(nil), c.intents...)
+}
+
+// NumIntents returns the number of dialing intents the client supports.
+func (c *Client) NumIntents() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.numIntentsLocked()
+}
+
+func (c *Client) numIntentsLocked() int {
+	if c.intents == nil {
+		return DefaultNumIntents
+	}
+	return len(c.intents)
+}
+
+// IntentName returns the name of the given intent,
+// or the empty string if the intent is unnamed.
+func (c *Client) IntentName(intent int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if intent < 0 || intent >= len(c.intents) {
+		return ""
+	}
+	return c.intents[intent]
+}
 
 // Call is used to call a friend using Alpenhorn's dialing protocol.
 // Call does not send the call right away but queues the call for an
 // upcoming dialing round. The resulting OutgoingCall is the queued
 // call object. Call does nothing and returns nil if the friend is
-// not in the client's address book.
+// not in the client's address book. Call panics if the intent is not
+// less than the client's NumIntents.
 func (f *Friend) Call(intent int) *OutgoingCall {
-	if intent >= IntentMax {
+	if intent < 0 || intent >= f.client.NumIntents() {
 		panic(fmt.Sprintf("invalid intent: %d", intent))
 	}
 	if !f.client.wheel.Exists(f.Username) {
@@ -162,6 +282,9 @@ func (r *OutgoingCall) Intent() int {
 func (r *OutgoingCall) UpdateIntent(intent int) error {
 	r.client.mu.Lock()
 	defer r.client.mu.Unlock()
+	if intent < 0 || intent >= r.client.numIntentsLocked() {
+		return errors.New("invalid intent: %d", intent)
+	}
 	if r.dialToken != nil {
 		return ErrTooLate
 	}
@@ -7,6 +7,8 @@ package alpenhorn
 import (
 	"crypto/ed25519"
 	"errors"
+	"sync/atomic"
+	"time"
 
 	"vuvuzela.io/alpenhorn/pkg"
 )
@@ -20,9 +22,11 @@ import (
 // friend request.
 func (c *Client) SendFriendRequest(username string, key ed25519.PublicKey) (*OutgoingFriendRequest, error) {
 	req := &OutgoingFriendRequest{
-		Username:    username,
-		ExpectedKey: key,
-		client:      c,
+		Username:     username,
+		ExpectedKey:  key,
+		Created:      time.Now(),
+		CreatedRound: atomic.LoadUint32(&c.lastAddFriendRound),
+		client:       c,
 	}
 	c.mu.Lock()
 	c.outgoingFriendRequests = append(c.outgoingFriendRequests, req)
@@ -46,6 +50,13 @@ type OutgoingFriendRequest struct {
 	// request is sent.
 	DialRound uint32
 
+	// Created is when the request was queued, and CreatedRound is the
+	// latest add-friend round at that time, or the first add-friend round
+	// after that if the client had not seen a round yet. They determine
+	// when the request expires.
+	Created      time.Time
+	CreatedRound uint32
+
 	client *Client
 }
 
@@ -61,9 +72,24 @@ type sentFriendRequest struct {
 	DHPublicKey  *[32]byte
 	DHPrivateKey *[32]byte
 
+	Sent time.Time
+
 	client *Client
 }
 
+func (r *sentFriendRequest) outgoing() *OutgoingFriendRequest {
+	return &OutgoingFriendRequest{
+		Username:     r.Username,
+		ExpectedKey:  r.ExpectedKey,
+		Confirmation: r.Confirmation,
+		DialRound:    r.DialRound,
+		Created:      r.Sent,
+		CreatedRound: r.SentRound,
+
+		client: r.client,
+	}
+}
+
 var ErrTooLate = errors.New("too late")
 
 // Cancel cancels the friend request by removing it from the queue.
@@ -103,14 +129,7 @@ func (c *Client) GetSentFriendRequests() []*OutgoingFriendRequest {
 
 	reqs := make([]*OutgoingFriendRequest, len(c.sentFriendRequests))
 	for i, req := range c.sentFriendRequests {
-		reqs[i] = &OutgoingFriendRequest{
-			Username:     req.Username,
-			ExpectedKey:  req.ExpectedKey,
-			Confirmation: req.Confirmation,
-			DialRound:    req.DialRound,
-
-			client: c,
-		}
+		reqs[i] = req.outgoing()
 	}
 	return reqs
 }
@@ -123,6 +142,11 @@ type IncomingFriendRequest struct {
 	DialRound   uint32
 	Verifiers   []pkg.PublicServerConfig
 
+	// Received is when the request was received, and ReceivedRound
+	// is the add-friend round it was received in.
+	Received      time.Time
+	ReceivedRound uint32
+
 	client *Client
 }
 
@@ -130,11 +154,24 @@ type IncomingFriendRequest struct {
 // request. The add-friend protocol is complete for this friend when the
 // confirmation request is sent. Approve assumes that the friend request
 // has not been previously rejected.
+//
+// If the request is the response to a friend request the user sent but is
+// signed by an unexpected key (see EventHandler.UnexpectedSigningKey),
+// Approve accepts the key and completes the add-friend protocol right away,
+// returning the sent request.
 func (r *IncomingFriendRequest) Approve() (*OutgoingFriendRequest, error) {
+	if sent := r.client.matchToSent(r); sent != nil {
+		r.client.newFriend(r, sent)
+		return sent.outgoing(), r.client.persistClient()
+	}
+
 	out := &OutgoingFriendRequest{
 		Username:     r.Username,
 		Confirmation: true,
 		DialRound:    r.DialRound,
+		Created:      time.Now(),
+		CreatedRound: atomic.LoadUint32(&r.client.lastAddFriendRound),
+		client:       r.client,
 	}
 	c := r.client
 	c.mu.Lock()
@@ -147,7 +184,9 @@ func (r *IncomingFriendRequest) Approve() (*OutgoingFriendRequest, error) {
 }
 
 // Reject rejects the friend request, returning ErrTooLate if the
-// friend request is not found in the client's queue.
+// friend request is not found in the client's queue. Rejecting a
+// request with an unexpected signing key also removes the sent
+// request it responds to.
 func (r *IncomingFriendRequest) Reject() error {
 	r.client.mu.Lock()
 	defer r.client.mu.Unlock()
@@ -164,6 +203,20 @@ func (r *IncomingFriendRequest) Reject() error {
 	}
 
 	r.client.incomingFriendRequests = append(reqs[:index], reqs[index+1:]...)
+
+	sent := r.client.sentFriendRequests[:0]
+	for _, req := range r.client.sentFriendRequests {
+		if req.Username == r.Username && req.DialRound == r.DialRound {
+			if req.DHPrivateKey != nil {
+				*req.DHPrivateKey = [32]byte{}
+				req.DHPrivateKey = nil
+			}
+		} else {
+			sent = append(sent, req)
+		}
+	}
+	r.client.sentFriendRequests = sent
+
 	err := r.client.persistLocked()
 	return err
 }
@@ -176,3 +229,92 @@ func (c *Client) GetIncomingFriendRequests() []*IncomingFriendRequest {
 	copy(r, c.incomingFriendRequests)
 	return r
 }
+
+// expired reports whether a friend request created at time t in add-friend
+// round r has expired by the given time and round. Requests persisted by
+// older clients have no time or round and never expire.
+func (c *Client) expired(t time.Time, r uint32, now time.Time, round uint32) bool {
+	if c.FriendRequestExpiry > 0 && !t.IsZero() && now.Sub(t) >= c.FriendRequestExpiry {
+		return true
+	}
+	if c.FriendRequestExpiryRounds > 0 && r != 0 && round >= r && round-r >= c.FriendRequestExpiryRounds {
+		return true
+	}
+	return false
+}
+
+// expireFriendRequests removes the friend requests that have expired
+// as of the given add-friend round and notifies the application.
+func (c *Client) expireFriendRequests(round uint32) {
+	if c.FriendRequestExpiry == 0 && c.FriendRequestExpiryRounds == 0 {
+		return
+	}
+	now := time.Now()
+
+	var expiredIn []*IncomingFriendRequest
+	var expiredOut []*OutgoingFriendRequest
+
+	c.mu.Lock()
+	incoming := c.incomingFriendRequests[:0]
+	for _, req := range c.incomingFriendRequests {
+		if c.expired(req.Received, req.ReceivedRound, now, round) {
+			expiredIn = append(expiredIn, req)
+		} else {
+			incoming = append(incoming, req)
+		}
+	}
+	c.incomingFriendRequests = incoming
+
+	stamped := false
+	outgoing := c.outgoingFriendRequests[:0]
+	for _, req := range c.outgoingFriendRequests {
+		if req.CreatedRound == 0 && !req.Created.IsZero() {
+			// The request was queued before the client learned the
+			// current add-friend round, so its rounds start now.
+			req.CreatedRound = round
+			stamped = true
+		}
+		if c.expired(req.Created, req.CreatedRound, now, round) {
+			expiredOut = append(expiredOut, req)
+		} else {
+			outgoing = append(outgoing, req)
+		}
+	}
+	c.outgoingFriendRequests = outgoing
+
+	sent := c.sentFriendRequests[:0]
+	for _, req := range c.sentFriendRequests {
+		if c.expired(req.Sent, req.SentRound, now, round) {
+			// Erase the DH private key since the request can
+			// no longer be completed.
+			if req.DHPrivateKey != nil {
+				*req.DHPrivateKey = [32]byte{}
+				req.DHPrivateKey = nil
+			}
+			expiredOut = append(expiredOut, req.outgoing())
+		} else {
+			sent = append(sent, req)
+		}
+	}
+	c.sentFriendRequests = sent
+
+	expiredTags := c.expireDeviceSyncTagsLocked(now, round)
+
+	if len(expiredIn) > 0 || len(expiredOut) > 0 || expiredTags || stamped {
+		if err := c.persistLocked(); err != nil {
+			panic("failed to persist state: " + err.Error())
+		}
+	}
+	c.mu.Unlock()
+
+	h, ok := c.Handler.(FriendRequestExpiryHandler)
+	if !ok {
+		return
+	}
+	for _, req := range expiredIn {
+		h.FriendRequestExpired(req, nil)
+	}
+	for _, req := range expiredOut {
+		h.FriendRequestExpired(nil, req)
+	}
+}
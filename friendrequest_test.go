@@ -0,0 +1,71 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFriendRequestExpired(t *testing.T) {
+	now := time.Now()
+	c := &Client{
+		FriendRequestExpiry:       time.Hour,
+		FriendRequestExpiryRounds: 10,
+	}
+
+	tests := []struct {
+		created time.Time
+		round   uint32
+		expired bool
+	}{
+		{now, 100, false},
+		{now.Add(-59 * time.Minute), 100, false},
+		{now.Add(-time.Hour), 100, true},
+		{now, 95, false},
+		{now, 90, true},
+		{time.Time{}, 0, false},
+		{now, 200, false},
+	}
+	for _, test := range tests {
+		got := c.expired(test.created, test.round, now, 100)
+		if got != test.expired {
+			t.Fatalf("expired(%s, %d): got %v, want %v", now.Sub(test.created), test.round, got, test.expired)
+		}
+	}
+
+	c = &Client{}
+	if c.expired(now.Add(-24*time.Hour), 1, now, 1000) {
+		t.Fatalf("friend requests should not expire when expiry is disabled")
+	}
+}
+
+func TestFriendRequestQueuedBeforeFirstRound(t *testing.T) {
+	c := &Client{
+		FriendRequestExpiryRounds: 10,
+		Store:                     new(MemoryStore),
+	}
+
+	req, err := c.SendFriendRequest("bob@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.CreatedRound != 0 {
+		t.Fatalf("unexpected CreatedRound: %d", req.CreatedRound)
+	}
+
+	c.expireFriendRequests(100)
+	if req.CreatedRound != 100 {
+		t.Fatalf("CreatedRound not stamped: got %d, want %d", req.CreatedRound, 100)
+	}
+	c.expireFriendRequests(109)
+	if len(c.GetOutgoingFriendRequests()) != 1 {
+		t.Fatal("friend request expired too early")
+	}
+	c.expireFriendRequests(110)
+	if len(c.GetOutgoingFriendRequests()) != 0 {
+		t.Fatal("friend request did not expire")
+	}
+}
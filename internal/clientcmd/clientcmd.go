@@ -0,0 +1,144 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package clientcmd implements the account setup shared by
+// the alpenhorn-client and alpenhorn-term commands.
+package clientcmd
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"os"
+	"path/filepath"
+
+	"vuvuzela.io/alpenhorn"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg"
+	"vuvuzela.io/crypto/rand"
+)
+
+// Account describes where a client's state is stored.
+type Account struct {
+	PersistPath string
+
+	// StateKeyPath, if set, is the path to a file containing the key that
+	// encrypts the client state: 32 bytes encoded in base32, as read by
+	// alpenhorn.ReadStateKeyFile. It is a key, not a passphrase.
+	StateKeyPath string
+
+	ConfigServerURL string
+}
+
+// RegisterFlags registers the account flags with the default flag set.
+func (a *Account) RegisterFlags() {
+	flag.StringVar(&a.PersistPath, "persist", "persist_client", "persistent data directory")
+	flag.StringVar(&a.StateKeyPath, "stateKey", "", "path to a file with a base32-encoded 32-byte key that encrypts the client state")
+	flag.StringVar(&a.ConfigServerURL, "url", "", "url of config server (default: the standard config server)")
+}
+
+func (a *Account) Store() *alpenhorn.FileStore {
+	return &alpenhorn.FileStore{
+		ClientPath:   filepath.Join(a.PersistPath, "client.state"),
+		KeywheelPath: filepath.Join(a.PersistPath, "keywheel.state"),
+	}
+}
+
+func (a *Account) ConfigClient() *config.Client {
+	if a.ConfigServerURL == "" {
+		return config.StdClient
+	}
+	return &config.Client{
+		ConfigServerURL: a.ConfigServerURL,
+	}
+}
+
+func (a *Account) stateKey() (*alpenhorn.StateKey, error) {
+	if a.StateKeyPath == "" {
+		return nil, nil
+	}
+	return alpenhorn.ReadStateKeyFile(a.StateKeyPath)
+}
+
+// Create creates a new account with fresh keys, bootstraps it with the
+// current configs from the config server, and persists it.
+func (a *Account) Create(username string) (*alpenhorn.Client, error) {
+	if err := pkg.ValidateUsername(username); err != nil {
+		return nil, errors.Wrap(err, "invalid username")
+	}
+	if err := os.MkdirAll(a.PersistPath, 0700); err != nil {
+		return nil, err
+	}
+	stateKey, err := a.stateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	configClient := a.ConfigClient()
+	addFriendConfig, err := configClient.CurrentConfig("AddFriend")
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching addfriend config")
+	}
+	dialingConfig, err := configClient.CurrentConfig("Dialing")
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching dialing config")
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	_, loginKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &alpenhorn.Client{
+		Username:           username,
+		LongTermPublicKey:  publicKey,
+		LongTermPrivateKey: privateKey,
+		PKGLoginKey:        loginKey,
+
+		ConfigClient: configClient,
+		Store:        a.Store(),
+		StateKey:     stateKey,
+	}
+	if err := client.Bootstrap(addFriendConfig, dialingConfig); err != nil {
+		return nil, err
+	}
+	if err := client.Persist(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Load loads the account's client.
+func (a *Account) Load() (*alpenhorn.Client, error) {
+	stateKey, err := a.stateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var client *alpenhorn.Client
+	if stateKey != nil {
+		client, err = alpenhorn.LoadEncryptedClient(a.Store(), stateKey)
+	} else {
+		client, err = alpenhorn.LoadClientFromStore(a.Store())
+	}
+	if err != nil {
+		return nil, err
+	}
+	client.ConfigClient = a.ConfigClient()
+	return client, nil
+}
+
+// Register registers the client with every PKG in its current
+// add-friend config.
+func Register(client *alpenhorn.Client, token string) []alpenhorn.PKGStatus {
+	statuses := client.PKGStatus()
+	for i, st := range statuses {
+		statuses[i].Error = client.Register(st.Server, token)
+	}
+	return statuses
+}
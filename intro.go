@@ -64,6 +64,33 @@ func (i *introduction) Sign(key ed25519.PrivateKey) {
 	copy(i.Signature[:], sig)
 }
 
+// SignSync signs a sync intro (see genSyncIntro). Sync intros carry an
+// encrypted DH key in place of the server multisignature, so the signature
+// covers that field too.
+func (i *introduction) SignSync(key ed25519.PrivateKey) {
+	sig := ed25519.Sign(key, i.syncMsg())
+	copy(i.Signature[:], sig)
+}
+
+// VerifySync verifies a sync intro signed by the user's own long-term key.
+// No attestation is needed since the key is known.
+func (i *introduction) VerifySync(longTermKey ed25519.PublicKey) bool {
+	if !bytes.Equal(i.LongTermKey[:], longTermKey) {
+		return false
+	}
+	return ed25519.Verify(longTermKey, i.syncMsg(), i.Signature[:])
+}
+
+func (i *introduction) syncMsg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("SyncIntroduction")
+	buf.Write(i.Username[:])
+	buf.Write(i.DHPublicKey[:])
+	binary.Write(buf, binary.BigEndian, i.DialingRound)
+	buf.Write(i.ServerMultisig[:])
+	return buf.Bytes()
+}
+
 func (i *introduction) msg() []byte {
 	buf := new(bytes.Buffer)
 	buf.WriteString("Introduction")
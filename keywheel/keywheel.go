@@ -6,19 +6,27 @@
 package keywheel
 
 import (
-	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"sync"
+
+	"vuvuzela.io/concurrency"
 )
 
 // Use github.com/davidlazar/easyjson:
 //go:generate easyjson .
 
-const version byte = 1
+// Serialization versions. Version 1 is indented JSON and is
+// only supported for loading old keywheels.
+const (
+	versionJSON   byte = 1
+	versionBinary byte = 2
+)
 
 type Wheel struct {
 	mu      sync.Mutex
@@ -41,20 +49,48 @@ func (rs roundSecret) getSecret(round uint32) *[32]byte {
 
 	secret := rs.Secret
 	for r := rs.Round; r < round; r++ {
-		secret = hash1(secret, r)
+		next := hash1(secret, r)
+		if secret != rs.Secret {
+			zero(secret)
+		}
+		secret = next
 	}
 
 	return secret
 }
 
+// release erases a secret returned by getSecret once it is no longer
+// needed, unless the secret is the one stored in the keywheel.
+func (rs roundSecret) release(secret *[32]byte) {
+	if secret != rs.Secret {
+		zero(secret)
+	}
+}
+
+// zero overwrites a secret that is no longer needed.
+func zero(secret *[32]byte) {
+	for i := range secret {
+		secret[i] = 0
+	}
+}
+
+// Put adds username to the keywheel with the given secret for round.
+// The keywheel keeps its own copy of the secret so that it can erase
+// the secret when it is no longer needed.
 func (w *Wheel) Put(username string, round uint32, secret *[32]byte) {
+	s := new([32]byte)
+	*s = *secret
+
 	w.mu.Lock()
 	if w.secrets == nil {
 		w.secrets = make(map[string]*roundSecret)
 	}
+	if old := w.secrets[username]; old != nil {
+		zero(old.Secret)
+	}
 	w.secrets[username] = &roundSecret{
 		Round:  round,
-		Secret: secret,
+		Secret: s,
 	}
 	w.mu.Unlock()
 }
@@ -77,39 +113,54 @@ func (w *Wheel) Exists(username string) bool {
 // UnsafeGet returns the internal keywheel state for a username.
 // This is unsafe; use SessionKey, if possible.
 func (w *Wheel) UnsafeGet(username string) (round uint32, secret *[32]byte) {
-	rs := w.get(username)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rs := w.secrets[username]
 	if rs != nil {
 		round = rs.Round
-		secret = rs.Secret
+		secret = new([32]byte)
+		*secret = *rs.Secret
 	}
 	return
 }
 
 func (w *Wheel) Remove(username string) {
 	w.mu.Lock()
+	if rs := w.secrets[username]; rs != nil {
+		zero(rs.Secret)
+	}
 	delete(w.secrets, username)
 	w.mu.Unlock()
 }
 
 func (w *Wheel) SessionKey(username string, round uint32) *[32]byte {
-	rs := w.get(username)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	rs := w.secrets[username]
 	if rs == nil || rs.Round > round {
 		return nil
 	}
 
 	// TODO should we hash the intent also?
-	key := hash3(rs.getSecret(round), round)
+	secret := rs.getSecret(round)
+	key := hash3(secret, round)
+	rs.release(secret)
 	return key
 }
 
 func (w *Wheel) OutgoingDialToken(username string, round uint32, intent int) *[32]byte {
-	rs := w.get(username)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	rs := w.secrets[username]
 	if rs == nil || rs.Round > round {
 		return nil
 	}
 
 	key := rs.getSecret(round)
 	token := hash2(key, round, username, intent)
+	rs.release(key)
 	return token
 }
 
@@ -118,81 +169,212 @@ type UserDialTokens struct {
 	Tokens       []*[32]byte
 }
 
+// IncomingDialTokens returns the dial tokens that friends would use to
+// call myUsername in the given round. The tokens are computed in parallel
+// without holding the keywheel's lock.
 func (w *Wheel) IncomingDialTokens(myUsername string, round uint32, numIntents int) []*UserDialTokens {
+	entries := w.snapshot(round)
+
+	all := make([]*UserDialTokens, len(entries))
+	concurrency.ParallelFor(len(entries), func(p *concurrency.P) {
+		for i, ok := p.Next(); ok; i, ok = p.Next() {
+			e := entries[i]
+			u := &UserDialTokens{
+				FromUsername: e.username,
+				Tokens:       make([]*[32]byte, numIntents),
+			}
+			key := e.copy.getSecret(round)
+			for j := range u.Tokens {
+				u.Tokens[j] = hash2(key, round, myUsername, j)
+			}
+			e.copy.release(key)
+			zero(e.copy.Secret)
+			all[i] = u
+		}
+	})
+	return all
+}
+
+type snapshotEntry struct {
+	username string
+	orig     *roundSecret
+	copy     roundSecret
+}
+
+// snapshot copies the secrets that are valid for maxRound
+// so they can be used without holding the lock.
+func (w *Wheel) snapshot(maxRound uint32) []snapshotEntry {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	all := make([]*UserDialTokens, 0, len(w.secrets))
-	for friend, rs := range w.secrets {
-		if rs.Round > round {
+	entries := make([]snapshotEntry, 0, len(w.secrets))
+	for username, rs := range w.secrets {
+		if rs.Round > maxRound {
 			continue
 		}
-		u := &UserDialTokens{
-			FromUsername: friend,
-			Tokens:       make([]*[32]byte, numIntents),
-		}
-		key := rs.getSecret(round)
-		for i := range u.Tokens {
-			u.Tokens[i] = hash2(key, round, myUsername, i)
-		}
-		all = append(all, u)
+		s := new([32]byte)
+		*s = *rs.Secret
+		entries = append(entries, snapshotEntry{
+			username: username,
+			orig:     rs,
+			copy: roundSecret{
+				Round:  rs.Round,
+				Secret: s,
+			},
+		})
 	}
-	return all
+	return entries
 }
 
+// EraseKeys erases the secrets for the given round and all earlier rounds.
 func (w *Wheel) EraseKeys(round uint32) {
+	w.Advance(round + 1)
+}
+
+// Advance moves every secret in the keywheel forward to the given round,
+// erasing the secrets for earlier rounds. A client that was offline for a
+// long time should advance its keywheel once it learns the current round,
+// so that later operations don't hash forward through the whole gap.
+// The hashing is done in parallel without holding the keywheel's lock.
+func (w *Wheel) Advance(round uint32) {
+	if round == 0 {
+		return
+	}
+	entries := w.snapshot(round - 1)
+
+	advanced := make([]*[32]byte, len(entries))
+	concurrency.ParallelFor(len(entries), func(p *concurrency.P) {
+		for i, ok := p.Next(); ok; i, ok = p.Next() {
+			advanced[i] = entries[i].copy.getSecret(round)
+			zero(entries[i].copy.Secret)
+		}
+	})
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
-
-	newRound := round + 1
-	for _, rs := range w.secrets {
-		newSecret := rs.getSecret(newRound)
-		if newSecret != nil {
-			rs.Round = newRound
-			rs.Secret = newSecret
+	for i, e := range entries {
+		rs := w.secrets[e.username]
+		if rs != e.orig || rs.Round != e.copy.Round {
+			// The entry changed while we weren't holding the lock.
+			zero(advanced[i])
+			if rs != nil && rs.Round < round {
+				newSecret := rs.getSecret(round)
+				zero(rs.Secret)
+				rs.Round = round
+				rs.Secret = newSecret
+			}
+			continue
 		}
+		zero(rs.Secret)
+		rs.Round = round
+		rs.Secret = advanced[i]
 	}
 }
 
+// MarshalBinary encodes the keywheel in the following format:
+//
+//	version (2) || uint32 count || entries
+//
+// where each entry, sorted by username, is:
+//
+//	uint16 len(username) || username || uint32 round || secret
 func (w *Wheel) MarshalBinary() ([]byte, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	buf := new(bytes.Buffer)
-	if _, err := buf.Write([]byte{version}); err != nil {
-		return nil, err
+	usernames := make([]string, 0, len(w.secrets))
+	size := 1 + 4
+	for username := range w.secrets {
+		if len(username) > math.MaxUint16 {
+			return nil, fmt.Errorf("username too long: %d bytes", len(username))
+		}
+		usernames = append(usernames, username)
+		size += 2 + len(username) + 4 + 32
 	}
-
-	encoder := json.NewEncoder(buf)
-	// use indented json for now for easier debugging
-	encoder.SetIndent("", "  ")
-	err := encoder.Encode(w.secrets)
-	if err != nil {
-		return nil, err
+	sort.Strings(usernames)
+
+	data := make([]byte, size)
+	data[0] = versionBinary
+	binary.BigEndian.PutUint32(data[1:5], uint32(len(usernames)))
+
+	b := data[5:]
+	for _, username := range usernames {
+		rs := w.secrets[username]
+		binary.BigEndian.PutUint16(b[0:2], uint16(len(username)))
+		b = b[2:]
+		copy(b, username)
+		b = b[len(username):]
+		binary.BigEndian.PutUint32(b[0:4], rs.Round)
+		copy(b[4:36], rs.Secret[:])
+		b = b[36:]
 	}
 
-	return buf.Bytes(), nil
+	return data, nil
 }
 
 func (w *Wheel) UnmarshalBinary(data []byte) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	ver := data[0]
-	if ver != version {
-		return fmt.Errorf("unknown serialization version: %d", ver)
+	if len(data) == 0 {
+		return fmt.Errorf("empty keywheel data")
 	}
 
-	secrets := make(map[string]*roundSecret)
-	err := json.Unmarshal(data[1:], &secrets)
+	var secrets map[string]*roundSecret
+	var err error
+	switch data[0] {
+	case versionBinary:
+		secrets, err = unmarshalBinary(data[1:])
+	case versionJSON:
+		secrets = make(map[string]*roundSecret)
+		err = json.Unmarshal(data[1:], &secrets)
+	default:
+		err = fmt.Errorf("unknown serialization version: %d", data[0])
+	}
 	if err != nil {
 		return err
 	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, rs := range w.secrets {
+		zero(rs.Secret)
+	}
 	w.secrets = secrets
 
 	return nil
 }
 
+func unmarshalBinary(data []byte) (map[string]*roundSecret, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("short keywheel data")
+	}
+	count := binary.BigEndian.Uint32(data[0:4])
+	data = data[4:]
+
+	secrets := make(map[string]*roundSecret)
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("short keywheel data")
+		}
+		n := int(binary.BigEndian.Uint16(data[0:2]))
+		data = data[2:]
+		if len(data) < n+4+32 {
+			return nil, fmt.Errorf("short keywheel data")
+		}
+		username := string(data[:n])
+		rs := &roundSecret{
+			Round:  binary.BigEndian.Uint32(data[n : n+4]),
+			Secret: new([32]byte),
+		}
+		copy(rs.Secret[:], data[n+4:n+4+32])
+		secrets[username] = rs
+		data = data[n+4+32:]
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("trailing keywheel data: %d bytes", len(data))
+	}
+
+	return secrets, nil
+}
+
 var (
 	hash1UniqueBytes = []byte{1, 1, 1, 1}
 	hash2UniqueBytes = []byte{2, 2, 2, 2}
@@ -7,6 +7,7 @@ package keywheel
 import (
 	"bytes"
 	"crypto/rand"
+	"fmt"
 	"testing"
 )
 
@@ -31,16 +32,95 @@ func TestMarshal(t *testing.T) {
 	w2.EraseKeys(101)
 
 	data, _ := w2.MarshalBinary()
-	expected := `{
+	secret := hash1(hash1(new([32]byte), 100), 101)
+	expected := []byte{
+		2,          // version
+		0, 0, 0, 1, // count
+		0, 5, 'a', 'l', 'i', 'c', 'e', // username
+		0, 0, 0, 102, // round
+	}
+	expected = append(expected, secret[:]...)
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("persisted state, got:\n%x\nwant:\n%x\n", data, expected)
+	}
+}
+
+func TestUnmarshalVersion1(t *testing.T) {
+	data := []byte("\x01" + `{
   "alice": {
     "Round": 102,
     "Secret": "bzc1exn1snjc7c43szqhmpd8h7c1hgep42ydwpy48ec6zt02ctx0"
   }
 }
-`
-	// ignore version byte
-	if !bytes.Equal(data[1:], []byte(expected)) {
-		t.Fatalf("persisted state, got:\n%q\nwant:\n%q\n", data[1:], expected)
+`)
+	var w Wheel
+	if err := w.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	round, secret := w.UnsafeGet("alice")
+	expected := hash1(hash1(new([32]byte), 100), 101)
+	if round != 102 || !bytes.Equal(secret[:], expected[:]) {
+		t.Fatalf("unexpected state: round=%d secret=%x", round, secret[:])
+	}
+}
+
+// TestErasedSecretsNotPersisted checks that after EraseKeys(r), no secret
+// for round r or earlier can be found in the serialized keywheel.
+func TestErasedSecretsNotPersisted(t *testing.T) {
+	var w Wheel
+
+	const start = 100
+	secrets := make(map[string][]*[32]byte)
+	for _, username := range []string{"alice", "bob", "chris"} {
+		s := new([32]byte)
+		rand.Read(s[:])
+		w.Put(username, start, s)
+
+		for r := uint32(start); r < start+10; r++ {
+			secrets[username] = append(secrets[username], s)
+			s = hash1(s, r)
+		}
+	}
+
+	for erased := uint32(start); erased < start+9; erased++ {
+		w.EraseKeys(erased)
+		data, err := w.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for username, ss := range secrets {
+			for i, s := range ss {
+				r := uint32(start + i)
+				found := bytes.Contains(data, s[:])
+				if r <= erased && found {
+					t.Fatalf("secret for %s at round %d survives EraseKeys(%d)", username, r, erased)
+				}
+				if r == erased+1 && !found {
+					t.Fatalf("secret for %s at round %d missing after EraseKeys(%d)", username, r, erased)
+				}
+			}
+		}
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	var w Wheel
+	secret := new([32]byte)
+	rand.Read(secret[:])
+	w.Put("alice", 100, secret)
+
+	key := w.SessionKey("alice", 5000)
+	w.Advance(5000)
+	if round, _ := w.UnsafeGet("alice"); round != 5000 {
+		t.Fatalf("unexpected round after Advance: got %d, want %d", round, 5000)
+	}
+	if k := w.SessionKey("alice", 5000); !bytes.Equal(k[:], key[:]) {
+		t.Fatalf("session key changed after Advance: %x != %x", k[:], key[:])
+	}
+	if k := w.SessionKey("alice", 4999); k != nil {
+		t.Fatalf("expected nil session key for round 4999")
 	}
 }
 
@@ -134,3 +214,48 @@ func BenchmarkGetSecret(b *testing.B) {
 		_ = rs.getSecret(1)
 	}
 }
+
+func benchmarkWheel(numFriends int, round uint32) *Wheel {
+	w := new(Wheel)
+	for i := 0; i < numFriends; i++ {
+		secret := new([32]byte)
+		rand.Read(secret[:])
+		w.Put(fmt.Sprintf("friend%d@example.org", i), round, secret)
+	}
+	return w
+}
+
+var benchmarkSizes = []struct {
+	friends int
+	gap     uint32
+}{
+	{1000, 1},
+	{5000, 1},
+	{1000, 1000},
+	{5000, 1000},
+}
+
+func BenchmarkIncomingDialTokens(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("friends=%d/gap=%d", size.friends, size.gap), func(b *testing.B) {
+			w := benchmarkWheel(size.friends, 100)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.IncomingDialTokens("alice@example.org", 100+size.gap, 3)
+			}
+		})
+	}
+}
+
+func BenchmarkAdvance(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("friends=%d/gap=%d", size.friends, size.gap), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				w := benchmarkWheel(size.friends, 100)
+				b.StartTimer()
+				w.Advance(100 + size.gap)
+			}
+		})
+	}
+}
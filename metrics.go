@@ -0,0 +1,235 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultRoundHistorySize is the number of rounds per service that the
+// client remembers when Client.RoundHistorySize is zero.
+const DefaultRoundHistorySize = 128
+
+// RoundStats describes the client's participation in a round. Round stats
+// are kept in memory only: they reveal whether the client sent a real
+// request or call, so they are never persisted or exported as metrics.
+type RoundStats struct {
+	// Service is "AddFriend" or "Dialing".
+	Service string
+	Round   uint32
+	Started time.Time
+
+	// OnionSent is true if the client sent an onion in this round.
+	// Real is true if the onion carried a friend request or call
+	// (as opposed to cover traffic).
+	OnionSent bool
+	Real      bool
+
+	// ExtractSuccess is true if the client extracted its private keys
+	// from every PKG. It is only used by the add-friend protocol.
+	ExtractSuccess bool
+	ExtractLatency time.Duration
+
+	// MailboxSize is the size in bytes of the scanned add-friend
+	// mailbox, and BloomFilterSize is the size in bytes of the
+	// scanned dialing bloom filter.
+	MailboxSize     int
+	BloomFilterSize int
+	FetchLatency    time.Duration
+}
+
+type serviceMetrics struct {
+	rounds           uint64
+	onionsSent       uint64
+	extractFailures  uint64
+	extractCount     uint64
+	extractSeconds   float64
+	fetchFailures    uint64
+	fetchCount       uint64
+	fetchSeconds     float64
+	mailboxBytes     uint64
+	lastMailboxBytes int
+}
+
+type roundHistory struct {
+	mu      sync.Mutex
+	rounds  map[string][]*RoundStats
+	metrics map[string]*serviceMetrics
+}
+
+func (c *Client) roundHistorySize() int {
+	if c.RoundHistorySize > 0 {
+		return c.RoundHistorySize
+	}
+	return DefaultRoundHistorySize
+}
+
+// updateRound applies fn to the stats for the given round,
+// creating them if needed.
+func (c *Client) updateRound(service string, round uint32, fn func(*RoundStats, *serviceMetrics)) {
+	h := &c.history
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.rounds == nil {
+		h.rounds = make(map[string][]*RoundStats)
+		h.metrics = make(map[string]*serviceMetrics)
+	}
+	m := h.metrics[service]
+	if m == nil {
+		m = new(serviceMetrics)
+		h.metrics[service] = m
+	}
+
+	rounds := h.rounds[service]
+	var st *RoundStats
+	for i := len(rounds) - 1; i >= 0; i-- {
+		if rounds[i].Round == round {
+			st = rounds[i]
+			break
+		}
+	}
+	if st == nil {
+		st = &RoundStats{
+			Service: service,
+			Round:   round,
+			Started: time.Now(),
+		}
+		m.rounds++
+		rounds = append(rounds, st)
+		if n := len(rounds) - c.roundHistorySize(); n > 0 {
+			rounds = append(rounds[:0], rounds[n:]...)
+		}
+		h.rounds[service] = rounds
+	}
+	fn(st, m)
+}
+
+func (c *Client) recordRound(service string, round uint32) {
+	c.updateRound(service, round, func(*RoundStats, *serviceMetrics) {})
+}
+
+func (c *Client) recordOnion(service string, round uint32, real bool) {
+	c.updateRound(service, round, func(st *RoundStats, m *serviceMetrics) {
+		st.OnionSent = true
+		st.Real = real
+		m.onionsSent++
+	})
+}
+
+func (c *Client) recordExtract(round uint32, success bool, latency time.Duration) {
+	c.updateRound("AddFriend", round, func(st *RoundStats, m *serviceMetrics) {
+		st.ExtractSuccess = success
+		st.ExtractLatency = latency
+		m.extractCount++
+		m.extractSeconds += latency.Seconds()
+		if !success {
+			m.extractFailures++
+		}
+	})
+}
+
+func (c *Client) recordFetch(service string, round uint32, size int, latency time.Duration, err error) {
+	c.updateRound(service, round, func(st *RoundStats, m *serviceMetrics) {
+		st.FetchLatency = latency
+		m.fetchCount++
+		m.fetchSeconds += latency.Seconds()
+		if err != nil {
+			m.fetchFailures++
+			return
+		}
+		if service == "AddFriend" {
+			st.MailboxSize = size
+		} else {
+			st.BloomFilterSize = size
+		}
+		m.mailboxBytes += uint64(size)
+		m.lastMailboxBytes = size
+	})
+}
+
+// RoundHistory returns the stats for the most recent rounds of the given
+// service ("AddFriend" or "Dialing"), oldest first. If service is empty,
+// it returns the stats for both services.
+func (c *Client) RoundHistory(service string) []RoundStats {
+	c.history.mu.Lock()
+	defer c.history.mu.Unlock()
+
+	var stats []RoundStats
+	for s, rounds := range c.history.rounds {
+		if service != "" && s != service {
+			continue
+		}
+		for _, st := range rounds {
+			stats = append(stats, *st)
+		}
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Started.Before(stats[j].Started)
+	})
+	return stats
+}
+
+// WriteMetrics writes the client's metrics in the Prometheus text format.
+// The metrics count rounds and onions but never distinguish real traffic
+// from cover traffic.
+func (c *Client) WriteMetrics(w io.Writer) error {
+	c.history.mu.Lock()
+	services := make([]string, 0, len(c.history.metrics))
+	metrics := make(map[string]serviceMetrics, len(c.history.metrics))
+	for s, m := range c.history.metrics {
+		services = append(services, s)
+		metrics[s] = *m
+	}
+	c.history.mu.Unlock()
+	sort.Strings(services)
+
+	bw := bufio.NewWriter(w)
+	metric := func(name, typ, help string, value func(m serviceMetrics) interface{}) {
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, typ)
+		for _, s := range services {
+			fmt.Fprintf(bw, "%s{service=%q} %v\n", name, s, value(metrics[s]))
+		}
+	}
+
+	metric("alpenhorn_client_rounds_total", "counter", "Rounds announced to the client.",
+		func(m serviceMetrics) interface{} { return m.rounds })
+	metric("alpenhorn_client_onions_sent_total", "counter", "Onions sent by the client (real or cover).",
+		func(m serviceMetrics) interface{} { return m.onionsSent })
+	metric("alpenhorn_client_extract_failures_total", "counter", "Rounds where PKG extraction failed.",
+		func(m serviceMetrics) interface{} { return m.extractFailures })
+	metric("alpenhorn_client_extract_latency_seconds_sum", "counter", "Total time spent extracting keys from PKGs.",
+		func(m serviceMetrics) interface{} { return m.extractSeconds })
+	metric("alpenhorn_client_extract_latency_seconds_count", "counter", "Number of PKG extractions.",
+		func(m serviceMetrics) interface{} { return m.extractCount })
+	metric("alpenhorn_client_fetch_failures_total", "counter", "Failed mailbox fetches from the CDN.",
+		func(m serviceMetrics) interface{} { return m.fetchFailures })
+	metric("alpenhorn_client_fetch_latency_seconds_sum", "counter", "Total time spent fetching mailboxes from the CDN.",
+		func(m serviceMetrics) interface{} { return m.fetchSeconds })
+	metric("alpenhorn_client_fetch_latency_seconds_count", "counter", "Number of mailbox fetches from the CDN.",
+		func(m serviceMetrics) interface{} { return m.fetchCount })
+	metric("alpenhorn_client_mailbox_bytes_total", "counter", "Bytes of mailboxes and bloom filters scanned.",
+		func(m serviceMetrics) interface{} { return m.mailboxBytes })
+	metric("alpenhorn_client_mailbox_bytes", "gauge", "Size of the most recently scanned mailbox or bloom filter.",
+		func(m serviceMetrics) interface{} { return m.lastMailboxBytes })
+
+	return bw.Flush()
+}
+
+// MetricsHandler returns an HTTP handler that serves the client's
+// metrics for a Prometheus-style collector.
+func (c *Client) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.WriteMetrics(w)
+	})
+}
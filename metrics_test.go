@@ -0,0 +1,66 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+func TestRoundHistory(t *testing.T) {
+	c := &Client{RoundHistorySize: 3}
+
+	for round := uint32(1); round <= 5; round++ {
+		c.recordRound("AddFriend", round)
+		c.recordExtract(round, round != 2, time.Millisecond)
+		c.recordOnion("AddFriend", round, round == 4)
+		c.recordFetch("AddFriend", round, 100*int(round), time.Millisecond, nil)
+	}
+	c.recordRound("Dialing", 7)
+	c.recordOnion("Dialing", 7, false)
+	c.recordFetch("Dialing", 7, 0, time.Millisecond, errors.New("cdn down"))
+
+	history := c.RoundHistory("AddFriend")
+	if len(history) != 3 {
+		t.Fatalf("expected 3 rounds in history, got %d", len(history))
+	}
+	for i, st := range history {
+		round := uint32(i + 3)
+		if st.Round != round || st.Service != "AddFriend" {
+			t.Fatalf("unexpected round in history: %+v", st)
+		}
+		if !st.OnionSent || st.Real != (round == 4) || !st.ExtractSuccess {
+			t.Fatalf("unexpected stats for round %d: %+v", round, st)
+		}
+		if st.MailboxSize != 100*int(round) {
+			t.Fatalf("round %d: expected mailbox size %d, got %d", round, 100*round, st.MailboxSize)
+		}
+	}
+
+	if all := c.RoundHistory(""); len(all) != 4 {
+		t.Fatalf("expected 4 rounds in combined history, got %d", len(all))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := c.WriteMetrics(buf); err != nil {
+		t.Fatal(err)
+	}
+	metrics := buf.String()
+	for _, line := range []string{
+		`alpenhorn_client_rounds_total{service="AddFriend"} 5`,
+		`alpenhorn_client_onions_sent_total{service="AddFriend"} 5`,
+		`alpenhorn_client_extract_failures_total{service="AddFriend"} 1`,
+		`alpenhorn_client_mailbox_bytes_total{service="AddFriend"} 1500`,
+		`alpenhorn_client_fetch_failures_total{service="Dialing"} 1`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("metrics missing %q:\n%s", line, metrics)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// MaxExtraDataSize is the maximum size of a friend's extra data.
+// Bounding the extra data bounds how much each friend adds to the
+// size of the persisted client state.
+const MaxExtraDataSize = 4096
+
+// DefaultPersistSizeClasses are the sizes that the persisted client state
+// and keywheel are padded to when Client.PersistSizeClasses is nil.
+var DefaultPersistSizeClasses = []int{
+	64 << 10,
+	256 << 10,
+	1 << 20,
+	4 << 20,
+}
+
+var paddedMagic = []byte("alpenhorn-padded-v1\n")
+
+// pad pads data to the smallest size class that fits it. Data larger than
+// the largest size class is padded to a multiple of the largest class.
+// The format is:
+//
+//	magic || uint32 length || data || zeros
+func pad(data []byte, sizeClasses []int) []byte {
+	n := len(paddedMagic) + 4 + len(data)
+
+	size := 0
+	for _, class := range sizeClasses {
+		if n <= class {
+			size = class
+			break
+		}
+	}
+	if size == 0 && len(sizeClasses) > 0 {
+		largest := sizeClasses[len(sizeClasses)-1]
+		size = (n + largest - 1) / largest * largest
+	}
+	if size < n {
+		size = n
+	}
+
+	out := make([]byte, size)
+	copy(out, paddedMagic)
+	binary.BigEndian.PutUint32(out[len(paddedMagic):], uint32(len(data)))
+	copy(out[len(paddedMagic)+4:], data)
+	return out
+}
+
+func isPadded(data []byte) bool {
+	return bytes.HasPrefix(data, paddedMagic)
+}
+
+// unpad removes the padding added by pad. Data that is not
+// padded (i.e., written by older clients) is returned as is.
+func unpad(data []byte) ([]byte, error) {
+	if !isPadded(data) {
+		return data, nil
+	}
+	data = data[len(paddedMagic):]
+	if len(data) < 4 {
+		return nil, errors.New("short padded data")
+	}
+	n := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint64(n) > uint64(len(data)) {
+		return nil, errors.New("invalid padded length: %d > %d", n, len(data))
+	}
+	return data[:n], nil
+}
+
+// sizeClasses returns the size classes used to pad persisted data.
+func (c *Client) sizeClasses() []int {
+	if c.PersistSizeClasses != nil {
+		return c.PersistSizeClasses
+	}
+	return DefaultPersistSizeClasses
+}
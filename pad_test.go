@@ -0,0 +1,49 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPad(t *testing.T) {
+	classes := []int{128, 512}
+
+	tests := []struct {
+		dataLen int
+		size    int
+	}{
+		{0, 128},
+		{10, 128},
+		{128 - len(paddedMagic) - 4, 128},
+		{128 - len(paddedMagic) - 3, 512},
+		{500, 1024},
+		{2000, 2048},
+	}
+	for _, test := range tests {
+		data := bytes.Repeat([]byte{'x'}, test.dataLen)
+		padded := pad(data, classes)
+		if len(padded) != test.size {
+			t.Fatalf("pad(%d bytes): got %d bytes, want %d", test.dataLen, len(padded), test.size)
+		}
+		unpadded, err := unpad(padded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unpadded, data) {
+			t.Fatalf("unpad(pad(%d bytes)) returned %d bytes", test.dataLen, len(unpadded))
+		}
+	}
+
+	legacy := []byte(`{"Username": "alice@example.org"}`)
+	data, err := unpad(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, legacy) {
+		t.Fatalf("unpad modified unpadded data")
+	}
+}
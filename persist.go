@@ -7,10 +7,9 @@ package alpenhorn
 import (
 	"crypto/ed25519"
 	"encoding/json"
-	"io/ioutil"
 
 	"vuvuzela.io/alpenhorn/config"
-	"vuvuzela.io/internal/ioutil2"
+	"vuvuzela.io/alpenhorn/errors"
 )
 
 //easyjson:readable
@@ -27,6 +26,12 @@ type persistedState struct {
 	OutgoingFriendRequests []*OutgoingFriendRequest
 	SentFriendRequests     []*sentFriendRequest
 	Friends                map[string]*persistedFriend
+
+	Intents []string
+
+	DeviceKey       *[32]byte
+	DeviceSyncQueue []*deviceSync
+	DeviceSyncTags  []*deviceSync
 }
 
 // persistedFriend is the persisted representation of the Friend type.
@@ -36,38 +41,112 @@ type persistedFriend struct {
 	Username    string
 	LongTermKey ed25519.PublicKey
 	ExtraData   []byte
+	KeyHistory  []KeyRecord
+	Verified    bool
 }
 
-// LoadClient loads a client from persisted state at the given path.
-// You should set the client's KeywheelPersistPath before connecting.
+// LoadClient loads a client from persisted state at the given paths.
 func LoadClient(clientPersistPath, keywheelPersistPath string) (*Client, error) {
-	clientData, err := ioutil.ReadFile(clientPersistPath)
+	c := &Client{
+		ClientPersistPath:   clientPersistPath,
+		KeywheelPersistPath: keywheelPersistPath,
+	}
+	if _, err := c.load(c.store()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadClientFromStore loads a client from the state in the given store.
+// The returned client continues to persist itself to the store.
+func LoadClientFromStore(store ClientStore) (*Client, error) {
+	c := &Client{
+		Store: store,
+	}
+	if _, err := c.load(store); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadEncryptedClient loads a client from the given store, decrypting
+// the client state with key. If the stored state is not encrypted, it
+// is loaded as is and immediately persisted again in encrypted form.
+// The returned client continues to encrypt its state with key.
+func LoadEncryptedClient(store ClientStore, key *StateKey) (*Client, error) {
+	c := &Client{
+		Store:    store,
+		StateKey: key,
+	}
+	encrypted, err := c.load(store)
 	if err != nil {
 		return nil, err
 	}
+	if !encrypted {
+		if err := c.Persist(); err != nil {
+			return nil, errors.Wrap(err, "migrating client state to encrypted format")
+		}
+	}
+	return c, nil
+}
+
+// load reads the client's state from the store, decrypting it with
+// c.StateKey if needed. It reports whether the state was encrypted.
+func (c *Client) load(store ClientStore) (bool, error) {
+	clientData, err := store.LoadState()
+	if err != nil {
+		return false, err
+	}
+
+	encrypted := isEncryptedState(clientData)
+	if encrypted {
+		if c.StateKey == nil {
+			return true, ErrEncryptedState
+		}
+		clientData, err = c.StateKey.open(clientData)
+		if err != nil {
+			return true, err
+		}
+	}
+	clientData, err = unpad(clientData)
+	if err != nil {
+		return encrypted, errors.Wrap(err, "client state")
+	}
 
 	st := new(persistedState)
 	err = json.Unmarshal(clientData, st)
 	if err != nil {
-		return nil, err
+		return encrypted, err
 	}
 
-	keywheelData, err := ioutil.ReadFile(keywheelPersistPath)
+	keywheelData, err := store.LoadKeywheel()
 	if err != nil {
-		return nil, err
+		return encrypted, err
 	}
-
-	c := &Client{
-		ClientPersistPath:   clientPersistPath,
-		KeywheelPersistPath: keywheelPersistPath,
+	keywheelData, err = unpad(keywheelData)
+	if err != nil {
+		return encrypted, errors.Wrap(err, "keywheel")
 	}
+
 	err = c.wheel.UnmarshalBinary(keywheelData)
 	if err != nil {
-		return nil, err
+		return encrypted, err
 	}
 
 	c.loadStateLocked(st)
-	return c, nil
+	return encrypted, nil
+}
+
+// store returns the client's ClientStore, falling back to a
+// FileStore if the client only has persist paths.
+func (c *Client) store() ClientStore {
+	if c.Store != nil {
+		return c.Store
+	}
+	return &FileStore{
+		ClientPath:   c.ClientPersistPath,
+		KeywheelPath: c.KeywheelPersistPath,
+	}
 }
 
 func (c *Client) loadStateLocked(st *persistedState) {
@@ -82,6 +161,12 @@ func (c *Client) loadStateLocked(st *persistedState) {
 	c.dialingConfig = st.DialingConfig
 	c.dialingConfigHash = st.DialingConfig.Hash()
 
+	c.intents = st.Intents
+
+	c.deviceKey = st.DeviceKey
+	c.deviceSyncQueue = st.DeviceSyncQueue
+	c.deviceSyncTags = st.DeviceSyncTags
+
 	c.incomingFriendRequests = st.IncomingFriendRequests
 	c.outgoingFriendRequests = st.OutgoingFriendRequests
 	c.sentFriendRequests = st.SentFriendRequests
@@ -102,6 +187,8 @@ func (c *Client) loadStateLocked(st *persistedState) {
 			Username:    friend.Username,
 			LongTermKey: friend.LongTermKey,
 			extraData:   friend.ExtraData,
+			keyHistory:  friend.KeyHistory,
+			verified:    friend.Verified,
 			client:      c,
 		}
 	}
@@ -136,10 +223,23 @@ func (c *Client) persistClient() error {
 }
 
 func (c *Client) persistClientLocked() error {
-	if c.ClientPersistPath == "" {
-		return nil
+	data, err := json.MarshalIndent(c.persistedStateLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = pad(data, c.sizeClasses())
+
+	if c.StateKey != nil {
+		data, err = c.StateKey.seal(data)
+		if err != nil {
+			return errors.Wrap(err, "encrypting client state")
+		}
 	}
 
+	return c.store().SaveState(data)
+}
+
+func (c *Client) persistedStateLocked() *persistedState {
 	st := &persistedState{
 		Username:           c.Username,
 		LongTermPublicKey:  c.LongTermPublicKey,
@@ -154,6 +254,12 @@ func (c *Client) persistClientLocked() error {
 		SentFriendRequests:     c.sentFriendRequests,
 
 		Friends: make(map[string]*persistedFriend, len(c.friends)),
+
+		Intents: c.intents,
+
+		DeviceKey:       c.deviceKey,
+		DeviceSyncQueue: c.deviceSyncQueue,
+		DeviceSyncTags:  c.deviceSyncTags,
 	}
 
 	for username, friend := range c.friends {
@@ -161,15 +267,11 @@ func (c *Client) persistClientLocked() error {
 			Username:    friend.Username,
 			LongTermKey: friend.LongTermKey,
 			ExtraData:   friend.extraData,
+			KeyHistory:  friend.keyHistory,
+			Verified:    friend.verified,
 		}
 	}
-
-	data, err := json.MarshalIndent(st, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	return ioutil2.WriteFileAtomic(c.ClientPersistPath, data, 0600)
+	return st
 }
 
 func (c *Client) persistKeywheel() error {
@@ -180,14 +282,11 @@ func (c *Client) persistKeywheel() error {
 }
 
 func (c *Client) persistKeywheelLocked() error {
-	if c.KeywheelPersistPath == "" {
-		return nil
-	}
-
 	data, err := c.wheel.MarshalBinary()
 	if err != nil {
 		return err
 	}
+	data = pad(data, c.sizeClasses())
 
-	return ioutil2.WriteFileAtomic(c.KeywheelPersistPath, data, 0600)
+	return c.store().SaveKeywheel(data)
 }
@@ -6,12 +6,14 @@ package pkg
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 
@@ -58,6 +60,61 @@ func (c *Client) Register(server PublicServerConfig, token string) error {
 	return nil
 }
 
+// RotateLoginKey replaces the client's login key on the PKG server with
+// newKey. The request is signed by the client's current login key and
+// the current time. The caller should set c.LoginKey to newKey once every
+// PKG server accepts it.
+func (c *Client) RotateLoginKey(server PublicServerConfig, newKey ed25519.PrivateKey) error {
+	args := &rotateKeyArgs{
+		Username:         c.Username,
+		NewLoginKey:      newKey.Public().(ed25519.PublicKey),
+		Time:             time.Now(),
+		ServerSigningKey: server.Key,
+	}
+	msg := args.msg()
+	args.Signature = ed25519.Sign(c.LoginKey, msg)
+	args.NewKeySignature = ed25519.Sign(newKey, msg)
+
+	var reply string
+	return c.do(server, "rotatekey", args, &reply)
+}
+
+// ResetLoginKey replaces the client's login key on the PKG server with
+// newKey without using the current login key. Instead, the user proves
+// ownership of the username with a fresh registration token. It is used
+// to recover an account after losing the login key. The server refuses
+// resets unless its registration verifier proves ownership of usernames,
+// and the client's clock must be roughly in sync with the server's.
+func (c *Client) ResetLoginKey(server PublicServerConfig, newKey ed25519.PrivateKey, token string) error {
+	args := &resetKeyArgs{
+		Username:          c.Username,
+		NewLoginKey:       newKey.Public().(ed25519.PublicKey),
+		RegistrationToken: token,
+		Time:              time.Now(),
+		ServerSigningKey:  server.Key,
+	}
+	args.NewKeySignature = ed25519.Sign(newKey, args.msg())
+
+	var reply string
+	return c.do(server, "resetkey", args, &reply)
+}
+
+// Deregister removes the client's username from the PKG server. The
+// client can no longer extract keys from the server until it registers
+// again. The request is signed with the current time (see ResetLoginKey),
+// so it can't be replayed after the user registers again.
+func (c *Client) Deregister(server PublicServerConfig) error {
+	args := &deregisterArgs{
+		Username:         c.Username,
+		Time:             time.Now(),
+		ServerSigningKey: server.Key,
+	}
+	args.Signature = ed25519.Sign(c.LoginKey, args.msg())
+
+	var reply string
+	return c.do(server, "deregister", args, &reply)
+}
+
 func (c *Client) CheckStatus(server PublicServerConfig) error {
 	args := &statusArgs{
 		Username:         c.Username,
@@ -161,6 +218,9 @@ type pkgRequest struct {
 	Reply  interface{}
 	Client *edhttp.Client
 
+	// Context, if non-nil, is used to cancel the request.
+	Context context.Context
+
 	TweakRequest func(*http.Request)
 }
 
@@ -175,6 +235,9 @@ func (req *pkgRequest) Do() error {
 	if err != nil {
 		return err
 	}
+	if req.Context != nil {
+		httpReq = httpReq.WithContext(req.Context)
+	}
 	if req.TweakRequest != nil {
 		req.TweakRequest(httpReq)
 	}
@@ -0,0 +1,272 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+const (
+	// DefaultPKGTimeout is the PKG request timeout used when
+	// CoordinatorClient.PKGTimeout is zero.
+	DefaultPKGTimeout = 10 * time.Second
+
+	// DefaultMaxAttempts is the number of attempts used when
+	// CoordinatorClient.MaxAttempts is zero.
+	DefaultMaxAttempts = 3
+
+	retryDelay = 250 * time.Millisecond
+)
+
+type CoordinatorClient struct {
+	CoordinatorKey ed25519.PrivateKey
+
+	// PKGTimeout is the deadline for each commit or reveal request.
+	// If zero, DefaultPKGTimeout is used.
+	PKGTimeout time.Duration
+
+	// MaxAttempts is the maximum number of times a commit or reveal
+	// request is sent to a PKG. Only transient failures are retried.
+	// If zero, DefaultMaxAttempts is used.
+	MaxAttempts int
+
+	initOnce sync.Once
+	client   *edhttp.Client
+}
+
+func (c *CoordinatorClient) init() {
+	c.initOnce.Do(func() {
+		c.client = &edhttp.Client{
+			Key: c.CoordinatorKey,
+		}
+	})
+}
+
+// A ServerError describes why a PKG failed to take part in a round.
+type ServerError struct {
+	Server PublicServerConfig
+
+	// Phase is "commit" or "reveal".
+	Phase string
+
+	// Attempts is the number of requests sent to the PKG.
+	Attempts int
+
+	Err error
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s %s (%d attempts): %s", e.Phase, e.Server.Address, e.Attempts, e.Err)
+}
+
+// A RoundError is returned when a round can't be started
+// because too many PKGs failed.
+type RoundError struct {
+	Round uint32
+
+	// Phase is the protocol phase that failed: "commit" or "reveal".
+	Phase string
+
+	// Threshold is the number of PKGs that needed to succeed.
+	Threshold int
+
+	// Errors has an entry for each PKG that failed.
+	Errors []*ServerError
+}
+
+func (e *RoundError) Error() string {
+	errs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err.Error()
+	}
+	return fmt.Sprintf("round %d: %s failed (need %d PKGs): %s", e.Round, e.Phase, e.Threshold, strings.Join(errs, "; "))
+}
+
+// NewRound runs the commit/reveal protocol with the PKGs to start a new
+// round. The context can be used to abandon the round early.
+func (c *CoordinatorClient) NewRound(ctx context.Context, pkgs []PublicServerConfig, round uint32) (RoundSettings, error) {
+	return c.NewQuorumRound(ctx, pkgs, len(pkgs), round)
+}
+
+// NewQuorumRound is like NewRound, but the round proceeds as long as at
+// least threshold of the PKGs commit to keys. PKGs that fail to commit are
+// left out of the round, and the returned settings only include the PKGs
+// that took part in the round. Every PKG that commits must also reveal,
+// since each reveal signature covers the full set of commitments.
+//
+// The PKGs are contacted concurrently, but no PKG is asked to reveal its
+// keys until every PKG has either committed or failed. If the round can't
+// be started because of PKG failures, the error is a *RoundError.
+func (c *CoordinatorClient) NewQuorumRound(ctx context.Context, pkgs []PublicServerConfig, threshold int, round uint32) (RoundSettings, error) {
+	c.init()
+
+	if threshold < 1 || threshold > len(pkgs) {
+		return nil, errors.New("invalid threshold %d for %d PKGs", threshold, len(pkgs))
+	}
+
+	commitArgs := &commitArgs{
+		Round: round,
+	}
+	commitReplies := make([]commitReply, len(pkgs))
+	replies := make([]interface{}, len(pkgs))
+	for i := range replies {
+		replies[i] = &commitReplies[i]
+	}
+	errs := c.callAll(ctx, pkgs, "commit", commitArgs, replies)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var quorum []PublicServerConfig
+	var failures []*ServerError
+	commitments := make(map[string][]byte)
+	for i, pkg := range pkgs {
+		if errs[i] != nil {
+			failures = append(failures, errs[i])
+			continue
+		}
+		commitments[hex.EncodeToString(pkg.Key)] = commitReplies[i].Commitment
+		quorum = append(quorum, pkg)
+	}
+	if len(quorum) < threshold {
+		return nil, &RoundError{
+			Round:     round,
+			Phase:     "commit",
+			Threshold: threshold,
+			Errors:    failures,
+		}
+	}
+
+	revealArgs := &revealArgs{
+		Round:       round,
+		Commitments: commitments,
+	}
+	revealReplies := make([]RevealReply, len(quorum))
+	replies = make([]interface{}, len(quorum))
+	for i := range replies {
+		replies[i] = &revealReplies[i]
+	}
+	errs = c.callAll(ctx, quorum, "reveal", revealArgs, replies)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	settings := make(RoundSettings)
+	failures = nil
+	for i, pkg := range quorum {
+		if errs[i] != nil {
+			failures = append(failures, errs[i])
+			continue
+		}
+		settings[hex.EncodeToString(pkg.Key)] = revealReplies[i]
+	}
+	if len(failures) > 0 {
+		return nil, &RoundError{
+			Round:     round,
+			Phase:     "reveal",
+			Threshold: len(quorum),
+			Errors:    failures,
+		}
+	}
+
+	keys := make([]ed25519.PublicKey, len(pkgs))
+	for i := range pkgs {
+		keys[i] = pkgs[i].Key
+	}
+	if !settings.VerifyQuorum(round, keys, threshold) {
+		return nil, errors.New("could not verify round settings")
+	}
+
+	return settings, nil
+}
+
+// callAll sends the request to every server concurrently and waits for
+// all of them to finish. The reply from servers[i] is stored in replies[i].
+// The result has a non-nil entry for each server that failed.
+func (c *CoordinatorClient) callAll(ctx context.Context, servers []PublicServerConfig, path string, args interface{}, replies []interface{}) []*ServerError {
+	errs := make([]*ServerError, len(servers))
+
+	var wg sync.WaitGroup
+	for i := range servers {
+		wg.Add(1)
+		go func(i int) {
+			errs[i] = c.call(ctx, servers[i], path, args, replies[i])
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func (c *CoordinatorClient) call(ctx context.Context, server PublicServerConfig, path string, args, reply interface{}) *ServerError {
+	timeout := c.PKGTimeout
+	if timeout == 0 {
+		timeout = DefaultPKGTimeout
+	}
+	maxAttempts := c.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, timeout)
+		req := &pkgRequest{
+			PublicServerConfig: server,
+
+			Path:    path,
+			Args:    args,
+			Reply:   reply,
+			Client:  c.client,
+			Context: reqCtx,
+		}
+		err = req.Do()
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= maxAttempts || !temporaryError(err) {
+			break
+		}
+
+		timer := time.NewTimer(time.Duration(attempt) * retryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return &ServerError{
+		Server:   server,
+		Phase:    path,
+		Attempts: attempt,
+		Err:      err,
+	}
+}
+
+// temporaryError reports whether a failed PKG request might succeed if
+// retried. Errors reported by the PKG are permanent unless they are
+// internal errors; transport errors and timeouts are temporary.
+func temporaryError(err error) bool {
+	if pkgErr, ok := err.(Error); ok {
+		return pkgErr.Code == ErrDatabaseError || pkgErr.Code == ErrUnknown
+	}
+	return true
+}
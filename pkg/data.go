@@ -93,12 +93,27 @@ type UserEventType int
 
 const (
 	EventRegistered UserEventType = iota + 1
+
+	// EventLoginKeyRotated means the user replaced their login key
+	// with a request signed by the previous login key.
+	EventLoginKeyRotated
+
+	// EventLoginKeyReset means the user replaced their login key
+	// using a registration token.
+	EventLoginKeyReset
+
+	// EventDeregistered means the user deleted their account.
+	EventDeregistered
 )
 
 type UserEvent struct {
 	Time     time.Time
 	Type     UserEventType
 	LoginKey ed25519.PublicKey
+
+	// RequestTime is the signed timestamp of the request that caused
+	// the event, if the request had one (see checkRequestTime).
+	RequestTime time.Time
 }
 
 func (e UserEventLog) Marshal() []byte {
@@ -119,26 +134,33 @@ func (e *UserEventLog) Unmarshal(data []byte) error {
 	return json.Unmarshal(data[1:], e)
 }
 
-func appendLog(tx *badger.Txn, identity *[64]byte, event UserEvent) error {
-	logKey := dbUserKey(identity, userLogSuffix)
-	item, err := tx.Get(logKey)
-	var currLog UserEventLog
+func getLog(tx *badger.Txn, identity *[64]byte) (UserEventLog, error) {
+	item, err := tx.Get(dbUserKey(identity, userLogSuffix))
 	if err == badger.ErrKeyNotFound {
-		currLog = nil
+		return nil, nil
 	} else if err != nil {
-		return errorf(ErrDatabaseError, "%s", err)
-	} else {
-		err := item.Value(func(data []byte) error {
-			return json.Unmarshal(data, currLog)
-		})
-		if err != nil {
-			return errorf(ErrDatabaseError, "%s", err)
-		}
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+
+	var currLog UserEventLog
+	err = item.Value(func(data []byte) error {
+		return currLog.Unmarshal(data)
+	})
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	return currLog, nil
+}
+
+func appendLog(tx *badger.Txn, identity *[64]byte, event UserEvent) error {
+	currLog, err := getLog(tx, identity)
+	if err != nil {
+		return err
 	}
 
 	currLog = append(currLog, event)
 	data := currLog.Marshal()
-	if err := tx.Set(logKey, data); err != nil {
+	if err := tx.Set(dbUserKey(identity, userLogSuffix), data); err != nil {
 		return errorf(ErrDatabaseError, "%s", err)
 	}
 	return nil
@@ -43,3 +43,37 @@ func TestMarshalLastExtraction(t *testing.T) {
 		t.Fatalf("after unmarshal: got %#v, want %#v", e2, e)
 	}
 }
+
+func TestAppendLog(t *testing.T) {
+	srv, cleanup := newTestServer(t, &HMACVerifier{Key: []byte("test key")})
+	defer cleanup()
+
+	id := ValidUsernameToIdentity("alice@example.org")
+	loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	events := []UserEvent{
+		{Time: time.Now(), Type: EventRegistered, LoginKey: loginKey},
+		{Time: time.Now(), Type: EventDeregistered, LoginKey: loginKey},
+	}
+	for _, e := range events {
+		tx := srv.db.NewTransaction(true)
+		if err := appendLog(tx, id, e); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	userLog, err := srv.GetUserLog(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userLog) != len(events) {
+		t.Fatalf("expected %d events, got %d: %#v", len(events), len(userLog), userLog)
+	}
+	for i, e := range userLog {
+		if e.Type != events[i].Type || !e.Time.Equal(events[i].Time) {
+			t.Fatalf("event %d: got %#v, want %#v", i, e, events[i])
+		}
+	}
+}
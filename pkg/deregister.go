@@ -0,0 +1,128 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+type deregisterArgs struct {
+	Username string
+	Time     time.Time
+
+	// ServerSigningKey ties the request to a single PKG.
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature signs the fields above with the user's login key.
+	Signature []byte
+}
+
+func (a *deregisterArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("DeregisterArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	binary.Write(buf, binary.BigEndian, a.Time.UnixNano())
+	return buf.Bytes()
+}
+
+func (srv *Server) deregisterHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 512)
+	args := new(deregisterArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	logger := srv.log.WithFields(log.Fields{"username": args.Username})
+	err = srv.deregister(args)
+	if err != nil {
+		logFailure(logger.WithFields(log.Fields{"code": errorCode(err).String()}), "Deregistration failed", err)
+		httpError(w, err)
+		return
+	}
+	logger.Info("Deregistration successful")
+
+	w.Write([]byte("\"OK\""))
+}
+
+// deregister removes the user's registration so the user can no longer
+// extract keys and the username is no longer in the registrar's user
+// filter. The user's log is kept (with an EventDeregistered entry) until
+// the user is purged, and the username can be registered again.
+func (srv *Server) deregister(args *deregisterArgs) error {
+	tx := srv.db.NewTransaction(true)
+	defer tx.Discard()
+
+	user, id, err := srv.getUser(tx, args.Username)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(user.LoginKey, args.msg(), args.Signature) {
+		return errorf(ErrInvalidSignature, "")
+	}
+	if err := srv.checkRequestTime(tx, id, args.Time); err != nil {
+		return err
+	}
+
+	for _, suffix := range [][]byte{registrationSuffix, lastExtractionSuffix} {
+		if err := tx.Delete(dbUserKey(id, suffix)); err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+	}
+
+	err = appendLog(tx, id, UserEvent{
+		Time:        time.Now(),
+		Type:        EventDeregistered,
+		LoginKey:    user.LoginKey,
+		RequestTime: args.Time,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
+
+// PurgeUser removes every record the PKG has about the user, including
+// the user's log. It is meant for administrators, e.g., to honor a request
+// to delete an account. Unlike deregistration, it does not require the
+// user's login key.
+func (srv *Server) PurgeUser(username string) error {
+	id, err := UsernameToIdentity(username)
+	if err != nil {
+		return errorf(ErrInvalidUsername, "%s", err)
+	}
+
+	err = srv.db.Update(func(tx *badger.Txn) error {
+		for _, suffix := range [][]byte{registrationSuffix, lastExtractionSuffix, userLogSuffix} {
+			if err := tx.Delete(dbUserKey(id, suffix)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+
+	srv.log.WithFields(log.Fields{"username": username}).Info("Purged user")
+	return nil
+}
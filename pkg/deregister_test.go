@@ -0,0 +1,123 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestDeregisterReplay(t *testing.T) {
+	v := &HMACVerifier{Key: []byte("test key")}
+	srv, cleanup := newTestServer(t, v)
+	defer cleanup()
+
+	username := "alice@example.org"
+	alicePub, alicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	register := func() {
+		err := srv.register(&registerArgs{
+			Username:          username,
+			LoginKey:          alicePub,
+			RegistrationToken: v.NewToken(username, time.Now().Add(time.Hour)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deregister := func(when time.Time) error {
+		args := &deregisterArgs{
+			Username:         username,
+			Time:             when,
+			ServerSigningKey: srv.publicKey,
+		}
+		args.Signature = ed25519.Sign(alicePriv, args.msg())
+		return srv.deregister(args)
+	}
+	register()
+
+	if err := deregister(time.Now().Add(-time.Hour)); !isErrorCode(err, ErrUnauthorized) {
+		t.Fatalf("deregister with stale time: got %v", err)
+	}
+	when := time.Now()
+	if err := deregister(when); err != nil {
+		t.Fatal(err)
+	}
+
+	// Registering again with the same login key doesn't let an
+	// attacker replay the old deregistration.
+	register()
+	if err := deregister(when); !isErrorCode(err, ErrUnauthorized) {
+		t.Fatalf("replayed deregister: got %v", err)
+	}
+
+	userLog, err := srv.GetUserLog(ValidUsernameToIdentity(username))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userLog) != 3 || userLog[1].Type != EventDeregistered || !userLog[1].RequestTime.Equal(when) {
+		t.Fatalf("unexpected user log: %#v", userLog)
+	}
+}
+
+func TestRotateKeyReplay(t *testing.T) {
+	v := &HMACVerifier{Key: []byte("test key")}
+	srv, cleanup := newTestServer(t, v)
+	defer cleanup()
+
+	username := "alice@example.org"
+	pub1, priv1, _ := ed25519.GenerateKey(rand.Reader)
+	_, priv2, _ := ed25519.GenerateKey(rand.Reader)
+	err := srv.register(&registerArgs{
+		Username:          username,
+		LoginKey:          pub1,
+		RegistrationToken: v.NewToken(username, time.Now().Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotate := func(oldKey, newKey ed25519.PrivateKey, when time.Time) error {
+		args := &rotateKeyArgs{
+			Username:         username,
+			NewLoginKey:      newKey.Public().(ed25519.PublicKey),
+			Time:             when,
+			ServerSigningKey: srv.publicKey,
+		}
+		msg := args.msg()
+		args.Signature = ed25519.Sign(oldKey, msg)
+		args.NewKeySignature = ed25519.Sign(newKey, msg)
+		return srv.rotateKey(args)
+	}
+
+	if err := rotate(priv1, priv2, time.Now().Add(-time.Hour)); !isErrorCode(err, ErrUnauthorized) {
+		t.Fatalf("rotate with stale time: got %v", err)
+	}
+	when := time.Now()
+	if err := rotate(priv1, priv2, when); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotate(priv2, priv1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// The current key is the first key again, but the first
+	// rotation can't be replayed.
+	if err := rotate(priv1, priv2, when); !isErrorCode(err, ErrUnauthorized) {
+		t.Fatalf("replayed rotation: got %v", err)
+	}
+
+	userLog, err := srv.GetUserLog(ValidUsernameToIdentity(username))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userLog) != 3 || userLog[1].Type != EventLoginKeyRotated || !userLog[1].RequestTime.Equal(when) {
+		t.Fatalf("unexpected user log: %#v", userLog)
+	}
+}
+
+func isErrorCode(err error, code ErrorCode) bool {
+	e, ok := err.(Error)
+	return ok && e.Code == code
+}
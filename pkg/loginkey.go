@@ -0,0 +1,257 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+	"github.com/dgraph-io/badger"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// Login keys can be changed in two ways. A user who still has their login
+// key can rotate it by signing the new key with the old key. A user who
+// lost their login key can reset it with a fresh registration token from
+// the registrar, which proves ownership of the username the same way
+// registration does. Both kinds of changes are recorded in the user's
+// UserEventLog.
+//
+// A reset is only as strong as the server's RegistrationVerifier, so the
+// server refuses resets unless its verifier proves ownership of usernames
+// (see OwnershipVerifier). Rotation and reset requests are timestamped so
+// that a captured request can't be replayed, for example after the user's
+// login key is changed back to the key that signed it.
+
+type rotateKeyArgs struct {
+	Username    string
+	NewLoginKey ed25519.PublicKey
+	Time        time.Time
+
+	// ServerSigningKey ties the request to a single PKG.
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature signs the fields above with the current login key.
+	Signature []byte
+
+	// NewKeySignature signs the fields above with the new login key
+	// to prove possession of the new key.
+	NewKeySignature []byte
+}
+
+func (a *rotateKeyArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("RotateKeyArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	buf.Write(a.NewLoginKey)
+	binary.Write(buf, binary.BigEndian, a.Time.UnixNano())
+	return buf.Bytes()
+}
+
+type resetKeyArgs struct {
+	Username          string
+	NewLoginKey       ed25519.PublicKey
+	RegistrationToken string
+	Time              time.Time
+
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// NewKeySignature signs the username, new login key,
+	// and time with the new login key.
+	NewKeySignature []byte
+}
+
+func (a *resetKeyArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("ResetKeyArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	buf.Write(a.NewLoginKey)
+	binary.Write(buf, binary.BigEndian, a.Time.UnixNano())
+	return buf.Bytes()
+}
+
+// maxRequestSkew is how far the time in a signed request can be from
+// the server's clock.
+const maxRequestSkew = 5 * time.Minute
+
+// checkRequestTime rejects a signed request whose time is too far from
+// the server's clock or not after the time of every earlier request in
+// the user's log, so each request can be used at most once.
+func (srv *Server) checkRequestTime(tx *badger.Txn, id *[64]byte, t time.Time) error {
+	if tx == nil {
+		tx = srv.db.NewTransaction(false)
+		defer tx.Discard()
+	}
+	userLog, err := getLog(tx, id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if t.Before(now.Add(-maxRequestSkew)) || t.After(now.Add(maxRequestSkew)) {
+		return errorf(ErrUnauthorized, "request time %s is too far from server time", t.UTC().Format(time.RFC3339))
+	}
+	for _, e := range userLog {
+		if !t.After(e.RequestTime) {
+			return errorf(ErrUnauthorized, "replayed request")
+		}
+	}
+	return nil
+}
+
+func (srv *Server) rotateKeyHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 512)
+	args := new(rotateKeyArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	logger := srv.log.WithFields(log.Fields{"username": args.Username, "loginKey": base32.EncodeToString(args.NewLoginKey)})
+	err = srv.rotateKey(args)
+	if err != nil {
+		logFailure(logger.WithFields(log.Fields{"code": errorCode(err).String()}), "Login key rotation failed", err)
+		httpError(w, err)
+		return
+	}
+	logger.Info("Login key rotated")
+
+	w.Write([]byte("\"OK\""))
+}
+
+func (srv *Server) rotateKey(args *rotateKeyArgs) error {
+	if len(args.NewLoginKey) != ed25519.PublicKeySize {
+		return errorf(ErrInvalidLoginKey, "got %d bytes, want %d bytes", len(args.NewLoginKey), ed25519.PublicKeySize)
+	}
+
+	tx := srv.db.NewTransaction(true)
+	defer tx.Discard()
+
+	user, id, err := srv.getUser(tx, args.Username)
+	if err != nil {
+		return err
+	}
+	msg := args.msg()
+	if !ed25519.Verify(user.LoginKey, msg, args.Signature) {
+		return errorf(ErrInvalidSignature, "current login key")
+	}
+	if !ed25519.Verify(args.NewLoginKey, msg, args.NewKeySignature) {
+		return errorf(ErrInvalidSignature, "new login key")
+	}
+	if err := srv.checkRequestTime(tx, id, args.Time); err != nil {
+		return err
+	}
+
+	return srv.setLoginKey(tx, id, args.NewLoginKey, EventLoginKeyRotated, args.Time)
+}
+
+func (srv *Server) resetKeyHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 512)
+	args := new(resetKeyArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	logger := srv.log.WithFields(log.Fields{"username": args.Username, "loginKey": base32.EncodeToString(args.NewLoginKey)})
+	err = srv.resetKey(args)
+	if err != nil {
+		logFailure(logger.WithFields(log.Fields{"code": errorCode(err).String()}), "Login key reset failed", err)
+		httpError(w, err)
+		return
+	}
+	logger.Info("Login key reset")
+
+	w.Write([]byte("\"OK\""))
+}
+
+func (srv *Server) resetKey(args *resetKeyArgs) error {
+	if v, ok := srv.verifier.(OwnershipVerifier); !ok || !v.ProvesOwnership() {
+		return errorf(ErrUnauthorized, "login key resets are disabled: registration verifier does not prove ownership")
+	}
+	if len(args.NewLoginKey) != ed25519.PublicKeySize {
+		return errorf(ErrInvalidLoginKey, "got %d bytes, want %d bytes", len(args.NewLoginKey), ed25519.PublicKeySize)
+	}
+	if !ed25519.Verify(args.NewLoginKey, args.msg(), args.NewKeySignature) {
+		return errorf(ErrInvalidSignature, "new login key")
+	}
+
+	// Check that the user exists and that the request is fresh
+	// before spending the token.
+	_, id, err := srv.getUser(nil, args.Username)
+	if err != nil {
+		return err
+	}
+	if err := srv.checkRequestTime(nil, id, args.Time); err != nil {
+		return err
+	}
+	if err := srv.verifier.VerifyRegistration(args.Username, args.RegistrationToken); err != nil {
+		return err
+	}
+
+	tx := srv.db.NewTransaction(true)
+	defer tx.Discard()
+
+	_, id, err = srv.getUser(tx, args.Username)
+	if err != nil {
+		return err
+	}
+	if err := srv.checkRequestTime(tx, id, args.Time); err != nil {
+		return err
+	}
+	return srv.setLoginKey(tx, id, args.NewLoginKey, EventLoginKeyReset, args.Time)
+}
+
+// setLoginKey replaces the user's login key, records the change
+// in the user's log, and commits the transaction.
+func (srv *Server) setLoginKey(tx *badger.Txn, id *[64]byte, loginKey ed25519.PublicKey, eventType UserEventType, requestTime time.Time) error {
+	user := userState{
+		LoginKey: loginKey,
+	}
+	err := tx.Set(dbUserKey(id, registrationSuffix), user.Marshal())
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+
+	err = appendLog(tx, id, UserEvent{
+		Time:     time.Now(),
+		Type:     eventType,
+		LoginKey: loginKey,
+
+		RequestTime: requestTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
+
+func logFailure(logger *log.Logger, msg string, err error) {
+	if isInternalError(err) {
+		logger.Errorf("%s: %s", msg, err)
+	} else {
+		// Avoid polluting stderr for user-caused errors.
+		logger.Infof("%s: %s", msg, err)
+	}
+}
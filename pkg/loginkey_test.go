@@ -0,0 +1,120 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+func newTestServer(t *testing.T, verifier RegistrationVerifier) (*Server, func()) {
+	_, serverPriv, _ := ed25519.GenerateKey(rand.Reader)
+	dbPath, err := ioutil.TempDir("", "alpenhorn_pkg_db_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(&Config{
+		DBPath: dbPath,
+		Logger: &log.Logger{
+			Level:        log.ErrorLevel,
+			EntryHandler: &log.OutputText{Out: log.Stderr},
+		},
+		SigningKey: serverPriv,
+		Verifier:   verifier,
+	})
+	if err != nil {
+		os.RemoveAll(dbPath)
+		t.Fatal(err)
+	}
+	return srv, func() {
+		srv.Close()
+		os.RemoveAll(dbPath)
+	}
+}
+
+// postResetKey sends a signed reset request through the server's
+// HTTP handler and returns the error code, or 0 on success.
+func postResetKey(srv *Server, username string, newKey ed25519.PrivateKey, token string, when time.Time) ErrorCode {
+	args := &resetKeyArgs{
+		Username:          username,
+		NewLoginKey:       newKey.Public().(ed25519.PublicKey),
+		RegistrationToken: token,
+		Time:              when,
+		ServerSigningKey:  srv.publicKey,
+	}
+	args.NewKeySignature = ed25519.Sign(newKey, args.msg())
+	body, _ := json.Marshal(args)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "/resetkey", bytes.NewReader(body)))
+	if w.Code == 200 {
+		return 0
+	}
+	var pkgErr Error
+	if err := json.Unmarshal(w.Body.Bytes(), &pkgErr); err != nil {
+		return ErrUnknown
+	}
+	return pkgErr.Code
+}
+
+func TestResetLoginKey(t *testing.T) {
+	v := &HMACVerifier{Key: []byte("test key")}
+	srv, cleanup := newTestServer(t, v)
+	defer cleanup()
+
+	username := "alice@example.org"
+	token := v.NewToken(username, time.Now().Add(time.Hour))
+	alicePub, _, _ := ed25519.GenerateKey(rand.Reader)
+	err := srv.register(&registerArgs{
+		Username:          username,
+		LoginKey:          alicePub,
+		RegistrationToken: token,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resetPub, resetPriv, _ := ed25519.GenerateKey(rand.Reader)
+	if code := postResetKey(srv, username, resetPriv, "wrong token", time.Now()); code != ErrInvalidToken {
+		t.Fatalf("reset with wrong token: got %s", code)
+	}
+	if code := postResetKey(srv, username, resetPriv, token, time.Now().Add(-time.Hour)); code != ErrUnauthorized {
+		t.Fatalf("reset with stale time: got %s", code)
+	}
+
+	when := time.Now()
+	if code := postResetKey(srv, username, resetPriv, token, when); code != 0 {
+		t.Fatalf("reset: got %s", code)
+	}
+	// Replaying the same request fails even though the token is valid.
+	if code := postResetKey(srv, username, resetPriv, token, when); code != ErrUnauthorized {
+		t.Fatalf("replayed reset: got %s", code)
+	}
+
+	user, _, err := srv.getUser(nil, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(user.LoginKey, resetPub) {
+		t.Fatal("login key was not reset")
+	}
+	userLog, err := srv.GetUserLog(ValidUsernameToIdentity(username))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userLog) != 2 || userLog[1].Type != EventLoginKeyReset || !userLog[1].RequestTime.Equal(when) {
+		t.Fatalf("unexpected user log: %#v", userLog)
+	}
+}
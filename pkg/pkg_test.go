@@ -6,6 +6,7 @@ package pkg_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding"
@@ -104,7 +105,7 @@ func TestSingleClient(t *testing.T) {
 	}
 
 	pkgs := []pkg.PublicServerConfig{testpkg.PublicServerConfig}
-	pkgSettings, err := coordinatorClient.NewRound(pkgs, 42)
+	pkgSettings, err := coordinatorClient.NewRound(context.Background(), pkgs, 42)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -197,7 +198,7 @@ func TestManyClients(t *testing.T) {
 	}
 
 	pkgs := []pkg.PublicServerConfig{testpkg.PublicServerConfig}
-	_, err = coordinatorClient.NewRound(pkgs, 42)
+	_, err = coordinatorClient.NewRound(context.Background(), pkgs, 42)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -231,3 +232,249 @@ func marshal(v encoding.BinaryMarshaler) []byte {
 	}
 	return data
 }
+
+func TestLoginKeyRotation(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		if token == "valid token" {
+			return nil
+		}
+		return pkg.Error{Code: pkg.ErrInvalidToken}
+	})
+	defer testpkg.Close()
+
+	aliceUsername := "alice@example.org"
+	alicePub, alicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        aliceUsername,
+		LoginKey:        alicePriv,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	if err := client.Register(testpkg.PublicServerConfig, "valid token"); err != nil {
+		t.Fatal(err)
+	}
+
+	newPub, newPriv, _ := ed25519.GenerateKey(rand.Reader)
+	_, evePriv, _ := ed25519.GenerateKey(rand.Reader)
+	eve := &pkg.Client{
+		Username:   aliceUsername,
+		LoginKey:   evePriv,
+		HTTPClient: new(edhttp.Client),
+	}
+	err := eve.RotateLoginKey(testpkg.PublicServerConfig, evePriv)
+	if err.(pkg.Error).Code != pkg.ErrInvalidSignature {
+		t.Fatal(err)
+	}
+
+	if err := client.RotateLoginKey(testpkg.PublicServerConfig, newPriv); err != nil {
+		t.Fatal(err)
+	}
+	err = client.CheckStatus(testpkg.PublicServerConfig)
+	if err.(pkg.Error).Code != pkg.ErrInvalidSignature {
+		t.Fatalf("old login key still works: %v", err)
+	}
+	client.LoginKey = newPriv
+	if err := client.CheckStatus(testpkg.PublicServerConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// A RegTokenHandler doesn't prove ownership of the username, so the
+	// PKG refuses login key resets (see TestResetLoginKey).
+	_, resetPriv, _ := ed25519.GenerateKey(rand.Reader)
+	err = client.ResetLoginKey(testpkg.PublicServerConfig, resetPriv, "valid token")
+	if err.(pkg.Error).Code != pkg.ErrUnauthorized {
+		t.Fatal(err)
+	}
+	if err := client.CheckStatus(testpkg.PublicServerConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	aliceLog, err := testpkg.PKGServer.GetUserLog(pkg.ValidUsernameToIdentity(aliceUsername))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		typ pkg.UserEventType
+		key ed25519.PublicKey
+	}{
+		{pkg.EventRegistered, alicePriv.Public().(ed25519.PublicKey)},
+		{pkg.EventLoginKeyRotated, newPub},
+	}
+	if len(aliceLog) != len(expected) {
+		t.Fatalf("unexpected user log: %#v", aliceLog)
+	}
+	for i, e := range expected {
+		if aliceLog[i].Type != e.typ || !bytes.Equal(aliceLog[i].LoginKey, e.key) {
+			t.Fatalf("unexpected user log entry %d: %#v", i, aliceLog[i])
+		}
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	aliceUsername := "alice@example.org"
+	aliceID := pkg.ValidUsernameToIdentity(aliceUsername)
+	alicePub, alicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        aliceUsername,
+		LoginKey:        alicePriv,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	if err := client.Register(testpkg.PublicServerConfig, "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, evePriv, _ := ed25519.GenerateKey(rand.Reader)
+	eve := &pkg.Client{
+		Username:   aliceUsername,
+		LoginKey:   evePriv,
+		HTTPClient: new(edhttp.Client),
+	}
+	err := eve.Deregister(testpkg.PublicServerConfig)
+	if err.(pkg.Error).Code != pkg.ErrInvalidSignature {
+		t.Fatal(err)
+	}
+
+	if err := client.Deregister(testpkg.PublicServerConfig); err != nil {
+		t.Fatal(err)
+	}
+	err = client.CheckStatus(testpkg.PublicServerConfig)
+	if err.(pkg.Error).Code != pkg.ErrNotRegistered {
+		t.Fatal(err)
+	}
+	usernames, err := testpkg.PKGServer.RegisteredUsernames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usernames) != 0 {
+		t.Fatalf("unexpected registered usernames: %v", usernames)
+	}
+
+	// The username can be registered again.
+	if err := client.Register(testpkg.PublicServerConfig, "token"); err != nil {
+		t.Fatal(err)
+	}
+	aliceLog, err := testpkg.PKGServer.GetUserLog(aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliceLog) != 3 || aliceLog[1].Type != pkg.EventDeregistered || aliceLog[2].Type != pkg.EventRegistered {
+		t.Fatalf("unexpected user log: %#v", aliceLog)
+	}
+
+	if err := testpkg.PKGServer.PurgeUser(aliceUsername); err != nil {
+		t.Fatal(err)
+	}
+	_, err = testpkg.PKGServer.GetUserLog(aliceID)
+	if err != badger.ErrKeyNotFound {
+		t.Fatal(err)
+	}
+	err = client.CheckStatus(testpkg.PublicServerConfig)
+	if err.(pkg.Error).Code != pkg.ErrNotRegistered {
+		t.Fatal(err)
+	}
+}
+
+func TestQuorumRound(t *testing.T) {
+	coordinatorPub, coordinatorPriv, _ := ed25519.GenerateKey(rand.Reader)
+	coordinatorClient := &pkg.CoordinatorClient{
+		CoordinatorKey: coordinatorPriv,
+		PKGTimeout:     time.Second,
+		MaxAttempts:    2,
+	}
+
+	var pkgs []pkg.PublicServerConfig
+	var keys []ed25519.PublicKey
+	for i := 0; i < 2; i++ {
+		testpkg, err := mock.LaunchPKG(coordinatorPub, func(string, string) error { return nil })
+		if err != nil {
+			t.Fatalf("error launching PKG: %s", err)
+		}
+		defer testpkg.Close()
+		pkgs = append(pkgs, testpkg.PublicServerConfig)
+		keys = append(keys, testpkg.Key)
+	}
+
+	aliceUsername := "alice@example.org"
+	alicePub, alicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        aliceUsername,
+		LoginKey:        alicePriv,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	for _, srv := range pkgs {
+		if err := client.Register(srv, "token"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Add a PKG that is down.
+	downPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	pkgs = append(pkgs, pkg.PublicServerConfig{Key: downPub, Address: "127.0.0.1:1"})
+	keys = append(keys, downPub)
+
+	_, err := coordinatorClient.NewRound(context.Background(), pkgs, 42)
+	roundErr, ok := err.(*pkg.RoundError)
+	if !ok {
+		t.Fatalf("expected a RoundError with a PKG down, got %v", err)
+	}
+	if roundErr.Phase != "commit" || len(roundErr.Errors) != 1 {
+		t.Fatalf("unexpected round error: %s", roundErr)
+	}
+	if e := roundErr.Errors[0]; !bytes.Equal(e.Server.Key, downPub) || e.Attempts != 2 {
+		t.Fatalf("unexpected server error: %s", e)
+	}
+
+	// Errors reported by a PKG are not retried.
+	_, wrongKey, _ := ed25519.GenerateKey(rand.Reader)
+	wrongClient := &pkg.CoordinatorClient{CoordinatorKey: wrongKey}
+	_, err = wrongClient.NewRound(context.Background(), pkgs[:1], 42)
+	roundErr, ok = err.(*pkg.RoundError)
+	if !ok || roundErr.Errors[0].Attempts != 1 {
+		t.Fatalf("unexpected error from unauthorized coordinator: %v", err)
+	}
+
+	settings, err := coordinatorClient.NewQuorumRound(context.Background(), pkgs, 2, 43)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !settings.VerifyQuorum(43, keys, 2) {
+		t.Fatal("failed to verify quorum settings")
+	}
+	if settings.VerifyQuorum(43, keys, 3) {
+		t.Fatal("quorum settings verified with a threshold that was not met")
+	}
+	if settings.VerifyQuorum(43, keys[1:], 1) {
+		t.Fatal("quorum settings verified with settings from an unknown PKG")
+	}
+	quorum := settings.Quorum(pkgs)
+	if len(quorum) != 2 || !bytes.Equal(quorum[0].Key, keys[0]) || !bytes.Equal(quorum[1].Key, keys[1]) {
+		t.Fatalf("unexpected quorum: %v", quorum)
+	}
+
+	masterKeys := make([]*ibe.MasterPublicKey, len(quorum))
+	privateKeys := make([]*ibe.IdentityPrivateKey, len(quorum))
+	for i, srv := range quorum {
+		masterKeys[i] = settings[hex.EncodeToString(srv.Key)].MasterPublicKey
+		result, err := client.Extract(srv, 43)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privateKeys[i] = result.PrivateKey
+	}
+
+	masterKey := new(ibe.MasterPublicKey).Aggregate(masterKeys...)
+	privateKey := new(ibe.IdentityPrivateKey).Aggregate(privateKeys...)
+	aliceID := pkg.ValidUsernameToIdentity(aliceUsername)
+	ctxt := ibe.Encrypt(rand.Reader, masterKey, aliceID[:], []byte("Hello Alice!"))
+	msg, ok := ibe.Decrypt(privateKey, ctxt)
+	if !ok || !bytes.Equal(msg, []byte("Hello Alice!")) {
+		t.Fatal("failed to decrypt with quorum keys")
+	}
+}
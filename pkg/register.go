@@ -8,7 +8,6 @@ import (
 	"crypto/ed25519"
 	"encoding/json"
 	"net/http"
-	"net/url"
 	"time"
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
@@ -39,13 +38,7 @@ func (srv *Server) registerHandler(w http.ResponseWriter, req *http.Request) {
 	logger := srv.log.WithFields(log.Fields{"username": args.Username, "loginKey": base32.EncodeToString(args.LoginKey)})
 	err = srv.register(args)
 	if err != nil {
-		logger = logger.WithFields(log.Fields{"code": errorCode(err).String()})
-		if isInternalError(err) {
-			logger.Errorf("Registration failed: %s", err)
-		} else {
-			// Avoid polluting stderr for user-caused errors.
-			logger.Infof("Registration failed: %s", err)
-		}
+		logFailure(logger.WithFields(log.Fields{"code": errorCode(err).String()}), "Registration failed", err)
 		httpError(w, err)
 		return
 	}
@@ -64,7 +57,7 @@ func (srv *Server) register(args *registerArgs) error {
 		return errorf(ErrInvalidLoginKey, "got %d bytes, want %d bytes", len(args.LoginKey), ed25519.PublicKeySize)
 	}
 
-	err = srv.regTokenHandler(args.Username, args.RegistrationToken)
+	err = srv.verifier.VerifyRegistration(args.Username, args.RegistrationToken)
 	if err != nil {
 		return err
 	}
@@ -106,21 +99,3 @@ func (srv *Server) register(args *registerArgs) error {
 
 	return nil
 }
-
-func ExternalVerifier(verifyURL string) RegTokenHandler {
-	return func(username string, token string) error {
-		vals := url.Values{
-			"username": []string{username},
-			"token":    []string{token},
-		}
-		resp, err := http.PostForm(verifyURL, vals)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode == http.StatusOK {
-			return nil
-		}
-		return errorf(ErrInvalidToken, "")
-	}
-}
@@ -30,6 +30,7 @@ func BenchmarkRegister(b *testing.B) {
 			EntryHandler: &log.OutputText{Out: log.Stderr},
 		},
 		SigningKey: serverPriv,
+		Verifier:   FirstComeFirstServe(),
 	}
 
 	srv, err := NewServer(conf)
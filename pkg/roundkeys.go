@@ -0,0 +1,431 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/crypto/bls"
+	"vuvuzela.io/crypto/ibe"
+)
+
+// Round keys are persisted so that a PKG that restarts in the middle of a
+// round can keep serving extractions for it. Instead of the keys themselves,
+// the PKG stores the random seed that the round's IBE and BLS keys are
+// generated from, along with the commitment to the public keys (to detect
+// a seed that no longer produces the same keys) and the reveal signature.
+//
+// Each record is encrypted with a random key for that round. The record
+// keys live in a small file outside the database (see roundKeyFile), which
+// is overwritten in place whenever a round is added or pruned. Records are
+// deleted when the round falls out of the retention window, but Badger only
+// removes deleted values from disk during compaction, so a stale copy of a
+// record can linger in the database files. Erasing the record's key from
+// the key file makes that copy useless. The key file itself is overwritten
+// rather than replaced, which erases old keys on filesystems that update
+// files in place; on copy-on-write filesystems and flash storage, old keys
+// may survive until the underlying blocks are reused.
+
+// DefaultRoundRetention is the number of rounds a PKG keeps
+// when Config.RoundRetention is zero.
+const DefaultRoundRetention = 2
+
+var dbRoundPrefix = []byte("round:")
+
+func dbRoundKey(round uint32) []byte {
+	key := make([]byte, len(dbRoundPrefix)+4)
+	copy(key, dbRoundPrefix)
+	binary.BigEndian.PutUint32(key[len(dbRoundPrefix):], round)
+	return key
+}
+
+const roundRecordBinaryVersion byte = 1
+
+type roundRecord struct {
+	Seed            [32]byte
+	Commitment      [32]byte
+	RevealSignature []byte
+}
+
+func (r *roundRecord) Marshal() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(roundRecordBinaryVersion)
+	buf.Write(r.Seed[:])
+	buf.Write(r.Commitment[:])
+	buf.Write(r.RevealSignature)
+	return buf.Bytes()
+}
+
+func (r *roundRecord) Unmarshal(data []byte) error {
+	if len(data) < 1+32+32 {
+		return errors.New("short data: got %d bytes", len(data))
+	}
+	if data[0] != roundRecordBinaryVersion {
+		return errors.New("roundRecordBinaryVersion mismatch: got %v, want %v", data[0], roundRecordBinaryVersion)
+	}
+	copy(r.Seed[:], data[1:33])
+	copy(r.Commitment[:], data[33:65])
+	if len(data) > 65 {
+		r.RevealSignature = append([]byte(nil), data[65:]...)
+	}
+	return nil
+}
+
+// seedReader returns a deterministic stream of random bytes derived from seed.
+func seedReader(seed *[32]byte) io.Reader {
+	block, err := aes.NewCipher(seed[:])
+	if err != nil {
+		panic(err)
+	}
+	stream := cipher.NewCTR(block, make([]byte, aes.BlockSize))
+	return cipher.StreamReader{S: stream, R: zeroReader{}}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// newRoundState generates the keys for a round from a fresh seed.
+func newRoundState() (*roundState, *roundRecord) {
+	rec := new(roundRecord)
+	if _, err := io.ReadFull(rand.Reader, rec.Seed[:]); err != nil {
+		panic(err)
+	}
+	st := roundStateFromSeed(&rec.Seed)
+	st.record = rec
+	copy(rec.Commitment[:], commitTo(st.masterPublicKey, st.blsPublicKey))
+	return st, rec
+}
+
+func roundStateFromSeed(seed *[32]byte) *roundState {
+	r := seedReader(seed)
+	ibePub, ibePriv := ibe.Setup(r)
+	blsPub, blsPriv, err := bls.GenerateKey(r)
+	if err != nil {
+		panic(err)
+	}
+	return &roundState{
+		masterPublicKey:  ibePub,
+		masterPrivateKey: ibePriv,
+		blsPublicKey:     blsPub,
+		blsPrivateKey:    blsPriv,
+	}
+}
+
+// roundKeyFile holds the keys that encrypt the persisted round records.
+type roundKeyFile struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[uint32]*[32]byte
+	// size is the size of the file on disk, so that rewrites
+	// overwrite all of the previous contents.
+	size int
+}
+
+const roundKeyFileVersion byte = 1
+
+func loadRoundKeyFile(path string) (*roundKeyFile, error) {
+	f := &roundKeyFile{
+		path: path,
+		keys: make(map[uint32]*[32]byte),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer zero(data)
+	f.size = len(data)
+
+	if len(data) < 5 {
+		return nil, errors.New("round key file %q: short data", path)
+	}
+	if data[0] != roundKeyFileVersion {
+		return nil, errors.New("round key file %q: version mismatch: got %v, want %v", path, data[0], roundKeyFileVersion)
+	}
+	n := int(binary.BigEndian.Uint32(data[1:5]))
+	entries := data[5:]
+	if len(entries) < n*(4+32) {
+		return nil, errors.New("round key file %q: truncated", path)
+	}
+	for i := 0; i < n; i++ {
+		entry := entries[i*(4+32) : (i+1)*(4+32)]
+		key := new([32]byte)
+		copy(key[:], entry[4:])
+		f.keys[binary.BigEndian.Uint32(entry[:4])] = key
+	}
+	return f, nil
+}
+
+// writeLocked overwrites the key file with the current keys, padding
+// the file with zeros so no part of the previous contents survives.
+func (f *roundKeyFile) writeLocked() error {
+	data := make([]byte, 5, 5+len(f.keys)*(4+32))
+	data[0] = roundKeyFileVersion
+	binary.BigEndian.PutUint32(data[1:5], uint32(len(f.keys)))
+	for round, key := range f.keys {
+		var r [4]byte
+		binary.BigEndian.PutUint32(r[:], round)
+		data = append(data, r[:]...)
+		data = append(data, key[:]...)
+	}
+	if len(data) < f.size {
+		data = append(data, make([]byte, f.size-len(data))...)
+	}
+	defer zero(data)
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, 0); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	f.size = len(data)
+	return nil
+}
+
+// newKey creates and saves a fresh key for round, replacing any
+// existing key for the round.
+func (f *roundKeyFile) newKey(round uint32) (*[32]byte, error) {
+	key := new([32]byte)
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if old := f.keys[round]; old != nil {
+		zero(old[:])
+	}
+	f.keys[round] = key
+	if err := f.writeLocked(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (f *roundKeyFile) key(round uint32) *[32]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.keys[round]
+}
+
+// prune erases the keys for rounds before oldest.
+func (f *roundKeyFile) prune(oldest uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pruned := false
+	for round, key := range f.keys {
+		if round < oldest {
+			zero(key[:])
+			delete(f.keys, round)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	return f.writeLocked()
+}
+
+func (srv *Server) sealRound(round uint32, rec *roundRecord) ([]byte, error) {
+	nonce := new([24]byte)
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+	key, err := srv.roundKeys.newKey(round)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := rec.Marshal()
+	defer zero(msg)
+	// Bind the record to its round so records can't be swapped.
+	var ad [4]byte
+	binary.BigEndian.PutUint32(ad[:], round)
+	return secretbox.Seal(nonce[:], append(ad[:], msg...), nonce, key), nil
+}
+
+func (srv *Server) openRound(round uint32, ctxt []byte) (*roundRecord, error) {
+	if len(ctxt) < 24 {
+		return nil, errors.New("short ciphertext")
+	}
+	nonce := new([24]byte)
+	copy(nonce[:], ctxt[:24])
+	key := srv.roundKeys.key(round)
+	if key == nil {
+		return nil, errors.New("no key for round record")
+	}
+
+	msg, ok := secretbox.Open(nil, ctxt[24:], nonce, key)
+	if !ok {
+		return nil, errors.New("failed to decrypt round record")
+	}
+	defer zero(msg)
+	if len(msg) < 4 || binary.BigEndian.Uint32(msg[:4]) != round {
+		return nil, errors.New("round record is for a different round")
+	}
+
+	rec := new(roundRecord)
+	if err := rec.Unmarshal(msg[4:]); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (srv *Server) persistRound(round uint32, rec *roundRecord) error {
+	data, err := srv.sealRound(round, rec)
+	if err != nil {
+		return errorf(ErrDatabaseError, "saving round key: %s", err)
+	}
+	err = srv.db.Update(func(tx *badger.Txn) error {
+		return tx.Set(dbRoundKey(round), data)
+	})
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
+
+// loadRounds loads the persisted round keys into srv.rounds.
+func (srv *Server) loadRounds() error {
+	type sealedRound struct {
+		round uint32
+		data  []byte
+	}
+	var sealed []sealedRound
+	err := srv.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(dbRoundPrefix); it.ValidForPrefix(dbRoundPrefix); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			if len(key) != len(dbRoundPrefix)+4 {
+				continue
+			}
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			sealed = append(sealed, sealedRound{
+				round: binary.BigEndian.Uint32(key[len(dbRoundPrefix):]),
+				data:  data,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var latest uint32
+	for _, s := range sealed {
+		rec, err := srv.openRound(s.round, s.data)
+		if err != nil {
+			srv.log.WithFields(log.Fields{"round": s.round}).Errorf("Discarding persisted round: %s", err)
+			continue
+		}
+		st := roundStateFromSeed(&rec.Seed)
+		if !bytes.Equal(commitTo(st.masterPublicKey, st.blsPublicKey), rec.Commitment[:]) {
+			srv.log.WithFields(log.Fields{"round": s.round}).Errorf("Discarding persisted round: keys do not match commitment")
+			continue
+		}
+		st.record = rec
+		st.revealSignature = rec.RevealSignature
+		srv.rounds[s.round] = st
+		if s.round > latest {
+			latest = s.round
+		}
+	}
+	if len(sealed) > 0 {
+		srv.log.WithFields(log.Fields{"rounds": len(srv.rounds), "latest": latest}).Info("Loaded persisted rounds")
+	}
+
+	return srv.pruneRounds(latest)
+}
+
+// pruneRounds deletes the rounds that are too old to keep given that
+// latest is the newest round.
+func (srv *Server) pruneRounds(latest uint32) error {
+	if latest < srv.roundRetention {
+		return nil
+	}
+	oldest := latest - srv.roundRetention + 1
+
+	srv.mu.Lock()
+	for r, st := range srv.rounds {
+		if r < oldest {
+			zero(st.record.Seed[:])
+			delete(srv.rounds, r)
+		}
+	}
+	srv.mu.Unlock()
+
+	// Erasing the keys is what makes the old records unreadable,
+	// so do it even if deleting the records fails.
+	keyErr := srv.roundKeys.prune(oldest)
+
+	// This also deletes persisted rounds that were never
+	// loaded (e.g., because they failed to decrypt).
+	err := srv.db.Update(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.IteratorOptions{})
+		var keys [][]byte
+		for it.Seek(dbRoundPrefix); it.ValidForPrefix(dbRoundPrefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if len(key) == len(dbRoundPrefix)+4 && binary.BigEndian.Uint32(key[len(dbRoundPrefix):]) >= oldest {
+				break
+			}
+			keys = append(keys, key)
+		}
+		it.Close()
+		for _, key := range keys {
+			if err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return keyErr
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+func TestPersistedRounds(t *testing.T) {
+	_, serverPriv, _ := ed25519.GenerateKey(rand.Reader)
+	dbPath, err := ioutil.TempDir("", "alpenhorn_pkg_db_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	conf := &Config{
+		DBPath: dbPath,
+		Logger: &log.Logger{
+			Level:        log.ErrorLevel,
+			EntryHandler: &log.OutputText{Out: log.Stderr},
+		},
+		SigningKey:      serverPriv,
+		RegTokenHandler: func(string, string) error { return nil },
+		RoundRetention:  2,
+	}
+
+	srv, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitments := make(map[uint32][]byte)
+	for round := uint32(1); round <= 4; round++ {
+		st, rec := newRoundState()
+		rec.RevealSignature = []byte{byte(round)}
+		if err := srv.persistRound(round, rec); err != nil {
+			t.Fatal(err)
+		}
+		commitments[round] = commitTo(st.masterPublicKey, st.blsPublicKey)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err = NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(srv.rounds) != 2 {
+		t.Fatalf("expected 2 rounds after reload, got %d", len(srv.rounds))
+	}
+	for round := uint32(3); round <= 4; round++ {
+		st, ok := srv.rounds[round]
+		if !ok {
+			t.Fatalf("round %d not reloaded", round)
+		}
+		if !bytes.Equal(commitTo(st.masterPublicKey, st.blsPublicKey), commitments[round]) {
+			t.Fatalf("round %d: reloaded keys differ", round)
+		}
+		if !bytes.Equal(st.revealSignature, []byte{byte(round)}) {
+			t.Fatalf("round %d: unexpected reveal signature: %v", round, st.revealSignature)
+		}
+	}
+
+	err = srv.db.View(func(tx *badger.Txn) error {
+		_, err := tx.Get(dbRoundKey(2))
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		t.Fatalf("expired round still in database: %v", err)
+	}
+
+	// The key file no longer has keys for the pruned rounds.
+	keys, err := loadRoundKeyFile(filepath.Join(dbPath, "roundkeys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.keys) != 2 || keys.key(2) != nil || keys.key(3) == nil {
+		t.Fatalf("unexpected keys in round key file: %v", keys.keys)
+	}
+
+	// Without the key file, the rounds can't be decrypted.
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dbPath, "roundkeys")); err != nil {
+		t.Fatal(err)
+	}
+	srv, err = NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if len(srv.rounds) != 0 {
+		t.Fatalf("loaded rounds without their keys")
+	}
+}
+
+func TestRoundKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_pkg_roundkeys_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roundkeys")
+
+	f, err := loadRoundKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []*[32]byte
+	for round := uint32(1); round <= 3; round++ {
+		key, err := f.newKey(round)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	key1 := *keys[0]
+	if err := f.prune(3); err != nil {
+		t.Fatal(err)
+	}
+	if *keys[0] != [32]byte{} {
+		t.Fatal("pruned key was not zeroed in memory")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 5+3*(4+32) {
+		t.Fatalf("key file shrank instead of being overwritten: %d bytes", len(data))
+	}
+	if bytes.Contains(data, key1[:]) {
+		t.Fatal("pruned key still in key file")
+	}
+
+	f, err = loadRoundKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.keys) != 1 || *f.key(3) != *keys[2] {
+		t.Fatalf("unexpected keys after reload: %v", f.keys)
+	}
+}
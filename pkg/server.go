@@ -9,19 +9,18 @@ package pkg
 import (
 	"bytes"
 	"crypto/ed25519"
-	"crypto/rand"
 	"crypto/sha512"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"net/http"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 
 	"github.com/dgraph-io/badger"
 
-	"vuvuzela.io/alpenhorn/edhttp"
 	"vuvuzela.io/alpenhorn/errors"
 	"vuvuzela.io/alpenhorn/log"
 	"vuvuzela.io/crypto/bls"
@@ -39,14 +38,21 @@ type Server struct {
 	mu     sync.Mutex
 	rounds map[uint32]*roundState
 
+	// commitMu serializes the creation of new rounds, so a round is
+	// only visible once its keys are persisted.
+	commitMu sync.Mutex
+
 	privateKey     ed25519.PrivateKey
 	publicKey      ed25519.PublicKey
 	coordinatorKey ed25519.PublicKey
 	registrarKey   ed25519.PublicKey
+	roundRetention uint32
+	roundKeys      *roundKeyFile
 
-	regTokenHandler RegTokenHandler
+	verifier RegistrationVerifier
 }
 
+// A RegTokenHandler is a function that verifies registration tokens.
 type RegTokenHandler func(username string, token string) error
 
 type roundState struct {
@@ -55,6 +61,9 @@ type roundState struct {
 	blsPublicKey     *bls.PublicKey
 	blsPrivateKey    *bls.PrivateKey
 	revealSignature  []byte
+
+	// record is the persisted form of the round state.
+	record *roundRecord
 }
 
 // A Config is used to configure a PKG server.
@@ -75,13 +84,30 @@ type Config struct {
 	// is used if Logger is nil.
 	Logger *log.Logger
 
-	// RegTokenHandler is the function used to verify registration tokens.
+	// Verifier is used to verify registration tokens.
+	Verifier RegistrationVerifier
+
+	// RegTokenHandler is used to verify registration tokens
+	// if Verifier is nil.
 	RegTokenHandler RegTokenHandler
+
+	// RoundRetention is the number of most recent rounds whose keys the
+	// PKG keeps, in memory and in the database, so it can keep serving
+	// extractions after a restart. If zero, DefaultRoundRetention is used.
+	RoundRetention uint32
+
+	// RoundKeyPath is the path to the file with the keys that encrypt
+	// the persisted rounds. If empty, the file is "roundkeys" in DBPath.
+	RoundKeyPath string
 }
 
 func NewServer(conf *Config) (*Server, error) {
-	if conf.RegTokenHandler == nil {
-		return nil, errors.New("nil RegTokenHandler")
+	verifier := conf.Verifier
+	if verifier == nil && conf.RegTokenHandler != nil {
+		verifier = conf.RegTokenHandler
+	}
+	if verifier == nil {
+		return nil, errors.New("no registration verifier")
 	}
 
 	db, err := badger.Open(badger.DefaultOptions(conf.DBPath).WithSyncWrites(true))
@@ -94,6 +120,21 @@ func NewServer(conf *Config) (*Server, error) {
 		logger = log.StdLogger
 	}
 
+	retention := conf.RoundRetention
+	if retention == 0 {
+		retention = DefaultRoundRetention
+	}
+
+	roundKeyPath := conf.RoundKeyPath
+	if roundKeyPath == "" {
+		roundKeyPath = filepath.Join(conf.DBPath, "roundkeys")
+	}
+	roundKeys, err := loadRoundKeyFile(roundKeyPath)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	s := &Server{
 		db:  db,
 		log: logger,
@@ -104,8 +145,14 @@ func NewServer(conf *Config) (*Server, error) {
 		publicKey:      conf.SigningKey.Public().(ed25519.PublicKey),
 		coordinatorKey: conf.CoordinatorKey,
 		registrarKey:   conf.RegistrarKey,
+		roundRetention: retention,
+		roundKeys:      roundKeys,
 
-		regTokenHandler: conf.RegTokenHandler,
+		verifier: verifier,
+	}
+	if err := s.loadRounds(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "loading persisted rounds")
 	}
 	return s, nil
 }
@@ -123,6 +170,12 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		srv.statusHandler(w, r)
 	case "/register":
 		srv.registerHandler(w, r)
+	case "/rotatekey":
+		srv.rotateKeyHandler(w, r)
+	case "/resetkey":
+		srv.resetKeyHandler(w, r)
+	case "/deregister":
+		srv.deregisterHandler(w, r)
 	case "/commit":
 		srv.commitHandler(w, r)
 	case "/reveal":
@@ -173,43 +226,33 @@ func (srv *Server) commitHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	round := args.Round
 
+	srv.commitMu.Lock()
 	srv.mu.Lock()
 	st, ok := srv.rounds[round]
 	srv.mu.Unlock()
 	if !ok {
-		ibePub, ibePriv := ibe.Setup(rand.Reader)
-
-		blsPub, blsPriv, err := bls.GenerateKey(rand.Reader)
-		if err != nil {
-			panic(err)
-		}
-
-		st = &roundState{
-			masterPublicKey:  ibePub,
-			masterPrivateKey: ibePriv,
-			blsPublicKey:     blsPub,
-			blsPrivateKey:    blsPriv,
+		var rec *roundRecord
+		st, rec = newRoundState()
+
+		// Persist the keys before committing to them.
+		if err := srv.persistRound(round, rec); err != nil {
+			srv.commitMu.Unlock()
+			srv.log.WithFields(log.Fields{"round": round}).Errorf("Failed to persist round: %s", err)
+			httpError(w, err)
+			return
 		}
 
 		srv.mu.Lock()
-		cst, ok := srv.rounds[round]
-		if !ok {
-			srv.rounds[round] = st
-		} else {
-			st = cst
-		}
+		srv.rounds[round] = st
 		srv.mu.Unlock()
 	}
+	srv.commitMu.Unlock()
 
 	srv.log.WithFields(log.Fields{"round": args.Round}).Info("Commit")
 
-	srv.mu.Lock()
-	for r, _ := range srv.rounds {
-		if r < round-1 {
-			delete(srv.rounds, r)
-		}
+	if err := srv.pruneRounds(round); err != nil {
+		srv.log.WithFields(log.Fields{"round": round}).Errorf("Failed to prune rounds: %s", err)
 	}
-	srv.mu.Unlock()
 
 	reply := &commitReply{
 		Commitment: commitTo(st.masterPublicKey, st.blsPublicKey),
@@ -299,7 +342,14 @@ func (srv *Server) revealHandler(w http.ResponseWriter, req *http.Request) {
 			buf.WriteString(hexkey)
 			buf.Write(commitment)
 		}
-		st.revealSignature = ed25519.Sign(srv.privateKey, buf.Bytes())
+		sig := ed25519.Sign(srv.privateKey, buf.Bytes())
+		st.record.RevealSignature = sig
+		if err := srv.persistRound(args.Round, st.record); err != nil {
+			srv.log.WithFields(log.Fields{"round": args.Round}).Errorf("Failed to persist round: %s", err)
+			httpError(w, err)
+			return
+		}
+		st.revealSignature = sig
 	}
 
 	srv.log.WithFields(log.Fields{"round": args.Round}).Info("Reveal")
@@ -351,82 +401,49 @@ func (s RoundSettings) Verify(round uint32, keys []ed25519.PublicKey) bool {
 	return true
 }
 
-//easyjson:readable
-type PublicServerConfig struct {
-	Key     ed25519.PublicKey
-	Address string
-}
-
-type CoordinatorClient struct {
-	CoordinatorKey ed25519.PrivateKey
-
-	initOnce sync.Once
-	client   *edhttp.Client
-}
-
-func (c *CoordinatorClient) init() {
-	c.initOnce.Do(func() {
-		c.client = &edhttp.Client{
-			Key: c.CoordinatorKey,
-		}
-	})
-}
-
-func (c *CoordinatorClient) NewRound(pkgs []PublicServerConfig, round uint32) (RoundSettings, error) {
-	c.init()
-
-	commitments := make(map[string][]byte)
-	commitArgs := &commitArgs{
-		Round: round,
-	}
-	for _, pkg := range pkgs {
-		commitReply := new(commitReply)
-		req := &pkgRequest{
-			PublicServerConfig: pkg,
-
-			Path:   "commit",
-			Args:   commitArgs,
-			Reply:  commitReply,
-			Client: c.client,
-		}
-		err := req.Do()
-		if err != nil {
-			return nil, err
-		}
-		commitments[hex.EncodeToString(pkg.Key)] = commitReply.Commitment
+// VerifyQuorum is like Verify, but accepts settings from any subset of
+// at least threshold of the given keys. Use Quorum to find the subset.
+func (s RoundSettings) VerifyQuorum(round uint32, keys []ed25519.PublicKey, threshold int) bool {
+	quorum := s.quorumKeys(keys)
+	// Reject settings from PKGs that are not in keys.
+	if len(quorum) != len(s) {
+		return false
 	}
-
-	settings := make(RoundSettings)
-	revealArgs := &revealArgs{
-		Round:       round,
-		Commitments: commitments,
+	if len(quorum) == 0 || len(quorum) < threshold {
+		return false
 	}
-	for _, pkg := range pkgs {
-		var reply RevealReply
-		req := &pkgRequest{
-			PublicServerConfig: pkg,
+	return s.Verify(round, quorum)
+}
 
-			Path:   "reveal",
-			Args:   revealArgs,
-			Reply:  &reply,
-			Client: c.client,
+// Quorum returns the servers that have settings in s,
+// in the order they appear in servers.
+func (s RoundSettings) Quorum(servers []PublicServerConfig) []PublicServerConfig {
+	quorum := make([]PublicServerConfig, 0, len(s))
+	for _, srv := range servers {
+		if _, ok := s[hex.EncodeToString(srv.Key)]; ok {
+			quorum = append(quorum, srv)
 		}
-		err := req.Do()
-		if err != nil {
-			return nil, err
-		}
-		settings[hex.EncodeToString(pkg.Key)] = reply
 	}
+	return quorum
+}
 
-	keys := make([]ed25519.PublicKey, len(pkgs))
-	for i := range pkgs {
-		keys[i] = pkgs[i].Key
-	}
-	if !settings.Verify(round, keys) {
-		return nil, errors.New("could not verify round settings")
+func (s RoundSettings) quorumKeys(keys []ed25519.PublicKey) []ed25519.PublicKey {
+	quorum := make([]ed25519.PublicKey, 0, len(s))
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		hexkey := hex.EncodeToString(key)
+		if _, ok := s[hexkey]; ok && !seen[hexkey] {
+			seen[hexkey] = true
+			quorum = append(quorum, key)
+		}
 	}
+	return quorum
+}
 
-	return settings, nil
+//easyjson:readable
+type PublicServerConfig struct {
+	Key     ed25519.PublicKey
+	Address string
 }
 
 // ValidateUsername returns nil if username is a valid username,
@@ -0,0 +1,247 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// A RegistrationVerifier decides whether a registration token proves
+// ownership of a username. It is consulted when a user registers and
+// when a user resets their login key. VerifyRegistration should return
+// a pkg.Error (such as ErrInvalidToken or ErrExpiredToken) if the token
+// is rejected; other errors are treated as internal errors.
+type RegistrationVerifier interface {
+	VerifyRegistration(username string, token string) error
+}
+
+// An OwnershipVerifier is a RegistrationVerifier that can report whether
+// its tokens prove that the holder controls the username, as opposed to
+// merely being allowed to register it. The PKG only allows login key
+// resets (which bypass the current login key) if ProvesOwnership is true.
+type OwnershipVerifier interface {
+	RegistrationVerifier
+	ProvesOwnership() bool
+}
+
+// VerifyRegistration calls f(username, token).
+func (f RegTokenHandler) VerifyRegistration(username string, token string) error {
+	return f(username, token)
+}
+
+// FirstComeFirstServe returns a verifier that accepts every registration,
+// so usernames belong to whoever registers them first. Since it doesn't
+// prove ownership, the PKG refuses login key resets.
+func FirstComeFirstServe() RegistrationVerifier {
+	return RegTokenHandler(func(username string, token string) error {
+		return nil
+	})
+}
+
+// An AllowList is a verifier that only accepts registrations for a fixed
+// set of usernames. The token is ignored, so an allow list doesn't prove
+// ownership of a username and the PKG refuses login key resets. A user
+// who loses their login key must be purged by the administrator (see
+// Server.PurgeUser) and register again.
+type AllowList struct {
+	usernames map[string]bool
+}
+
+// LoadAllowList reads an allow-list file. The file has one username per
+// line; blank lines and lines starting with # are ignored.
+func LoadAllowList(path string) (*AllowList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadAllowList(f)
+}
+
+// ReadAllowList reads an allow list in the format used by LoadAllowList.
+func ReadAllowList(r io.Reader) (*AllowList, error) {
+	list := &AllowList{
+		usernames: make(map[string]bool),
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := ValidateUsername(line); err != nil {
+			return nil, errors.New("line %d: %s", lineno, err)
+		}
+		list.usernames[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (l *AllowList) VerifyRegistration(username string, token string) error {
+	if !l.usernames[username] {
+		return errorf(ErrInvalidToken, "username not in allow list")
+	}
+	return nil
+}
+
+// An HMACVerifier accepts tokens created by NewToken with the same key.
+// Tokens are bound to a username and expire at a fixed time, so they
+// can be handed out (e.g., by email) without contacting the PKG.
+type HMACVerifier struct {
+	Key []byte
+}
+
+const hmacTokenSize = 8 + sha256.Size
+
+// NewToken returns a registration token for username that expires
+// at the given time.
+func (v *HMACVerifier) NewToken(username string, expires time.Time) string {
+	token := make([]byte, 8, hmacTokenSize)
+	binary.BigEndian.PutUint64(token, uint64(expires.Unix()))
+	token = append(token, v.mac(username, token[:8])...)
+	return base32.EncodeToString(token)
+}
+
+func (v *HMACVerifier) VerifyRegistration(username string, token string) error {
+	data, err := base32.DecodeString(token)
+	if err != nil || len(data) != hmacTokenSize {
+		return errorf(ErrInvalidToken, "malformed token")
+	}
+	if !hmac.Equal(data[8:], v.mac(username, data[:8])) {
+		return errorf(ErrInvalidToken, "")
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0)
+	if time.Now().After(expires) {
+		return errorf(ErrExpiredToken, "expired %s", expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ProvesOwnership returns true since tokens are bound to the username
+// and are only handed out to whoever controls it.
+func (v *HMACVerifier) ProvesOwnership() bool {
+	return true
+}
+
+func (v *HMACVerifier) mac(username string, expires []byte) []byte {
+	h := hmac.New(sha256.New, v.Key)
+	h.Write([]byte("RegistrationToken"))
+	h.Write(expires)
+	id := ValidUsernameToIdentity(username)
+	h.Write(id[:])
+	return h.Sum(nil)
+}
+
+// A RegistrarVerifier asks the registrar whether a token is valid. The
+// registrar is authenticated with its edtls key, and the PKG identifies
+// itself to the registrar with the key in Client.
+type RegistrarVerifier struct {
+	// Address and Key are the registrar's address and edtls key,
+	// usually from AddFriendConfig.Registrar.
+	Address string
+	Key     ed25519.PublicKey
+
+	Client *edhttp.Client
+
+	// Timeout bounds each request to the registrar.
+	// If zero, DefaultRegistrarTimeout is used.
+	Timeout time.Duration
+}
+
+const DefaultRegistrarTimeout = 10 * time.Second
+
+func (v *RegistrarVerifier) VerifyRegistration(username string, token string) error {
+	vals := url.Values{
+		"username": []string{username},
+		"token":    []string{token},
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/verify", v.Address), strings.NewReader(vals.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	timeout := v.Timeout
+	if timeout == 0 {
+		timeout = DefaultRegistrarTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := v.Client.Do(v.Key, req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "contacting registrar")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	// The registrar can explain why it rejected the token
+	// (e.g., ErrExpiredToken) using a pkg.Error.
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	var regErr Error
+	if err := json.Unmarshal(body, &regErr); err == nil && regErr.Code != 0 {
+		return regErr
+	}
+	if resp.StatusCode >= 500 {
+		return errors.New("registrar error: %s", resp.Status)
+	}
+	return errorf(ErrInvalidToken, "")
+}
+
+// ProvesOwnership returns true since the registrar only issues tokens
+// to whoever controls the username.
+func (v *RegistrarVerifier) ProvesOwnership() bool {
+	return true
+}
+
+// ExternalVerifier returns a verifier that checks tokens by posting them
+// to verifyURL over plain HTTPS.
+//
+// Deprecated: the request is not authenticated and the registrar is not
+// pinned to a key. Use RegistrarVerifier instead.
+func ExternalVerifier(verifyURL string) RegTokenHandler {
+	return func(username string, token string) error {
+		vals := url.Values{
+			"username": []string{username},
+			"token":    []string{token},
+		}
+		resp, err := http.PostForm(verifyURL, vals)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		return errorf(ErrInvalidToken, "")
+	}
+}
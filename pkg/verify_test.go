@@ -0,0 +1,102 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACVerifier(t *testing.T) {
+	v := &HMACVerifier{Key: []byte("test key")}
+
+	token := v.NewToken("alice@example.org", time.Now().Add(time.Hour))
+	if err := v.VerifyRegistration("alice@example.org", token); err != nil {
+		t.Fatal(err)
+	}
+
+	err := v.VerifyRegistration("bob@example.org", token)
+	if errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for wrong username, got %v", err)
+	}
+
+	other := &HMACVerifier{Key: []byte("other key")}
+	err = other.VerifyRegistration("alice@example.org", token)
+	if errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for wrong key, got %v", err)
+	}
+
+	err = v.VerifyRegistration("alice@example.org", "garbage")
+	if errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for malformed token, got %v", err)
+	}
+
+	expired := v.NewToken("alice@example.org", time.Now().Add(-time.Minute))
+	err = v.VerifyRegistration("alice@example.org", expired)
+	if errorCode(err) != ErrExpiredToken {
+		t.Fatalf("expected ErrExpiredToken, got %v", err)
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	list, err := ReadAllowList(strings.NewReader(`
+# test users
+alice@example.org
+
+bob@example.org
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := list.VerifyRegistration("alice@example.org", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.VerifyRegistration("bob@example.org", "anything"); err != nil {
+		t.Fatal(err)
+	}
+	err = list.VerifyRegistration("eve@example.org", "")
+	if errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+
+	_, err = ReadAllowList(strings.NewReader("Not A Username\n"))
+	if err == nil {
+		t.Fatal("expected error for invalid username")
+	}
+}
+
+func TestResetRequiresOwnership(t *testing.T) {
+	allowList, err := ReadAllowList(strings.NewReader("alice@example.org\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifiers := map[string]RegistrationVerifier{
+		"fcfs":      FirstComeFirstServe(),
+		"allowlist": allowList,
+	}
+	for name, verifier := range verifiers {
+		srv, cleanup := newTestServer(t, verifier)
+
+		alicePub, _, _ := ed25519.GenerateKey(rand.Reader)
+		err := srv.register(&registerArgs{
+			Username: "alice@example.org",
+			LoginKey: alicePub,
+		})
+		if err != nil {
+			cleanup()
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		_, evePriv, _ := ed25519.GenerateKey(rand.Reader)
+		code := postResetKey(srv, "alice@example.org", evePriv, "", time.Now())
+		cleanup()
+		if code != ErrUnauthorized {
+			t.Fatalf("%s: expected reset to be refused, got %s", name, code)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package registrar
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A Mailer delivers registration tokens to users.
+type Mailer interface {
+	SendToken(username string, token string) error
+}
+
+func tokenMessage(from, username, token string) []byte {
+	buf := new(bytes.Buffer)
+	if from != "" {
+		fmt.Fprintf(buf, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(buf, "To: %s\r\n", username)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Subject: Alpenhorn registration token\r\n")
+	fmt.Fprintf(buf, "\r\n")
+	fmt.Fprintf(buf, "Your Alpenhorn registration token for %s is:\r\n\r\n", username)
+	fmt.Fprintf(buf, "    %s\r\n\r\n", token)
+	fmt.Fprintf(buf, "If you did not request this token, you can ignore this message.\r\n")
+	return buf.Bytes()
+}
+
+// A SpoolMailer writes each message to a file in Dir instead of
+// sending it. It is meant for testing and local deployments.
+type SpoolMailer struct {
+	Dir string
+}
+
+func (m *SpoolMailer) SendToken(username string, token string) error {
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+	// Usernames are validated email addresses, but be careful anyway.
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == filepath.Separator {
+			return '_'
+		}
+		return r
+	}, username)
+	path := filepath.Join(m.Dir, fmt.Sprintf("%s.%d.eml", name, time.Now().UnixNano()))
+	return ioutil.WriteFile(path, tokenMessage("", username, token), 0600)
+}
+
+// An SMTPMailer sends tokens through an SMTP server.
+type SMTPMailer struct {
+	// Addr is the SMTP server's address, including the port.
+	Addr string
+	From string
+
+	// Auth is optional.
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) SendToken(username string, token string) error {
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{username}, tokenMessage(m.From, username, token))
+}
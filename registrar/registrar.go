@@ -0,0 +1,390 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package registrar implements a registrar that proves ownership of
+// email-style usernames. Users request a registration token, which the
+// registrar mails to the username. The user then registers with each PKG
+// using the token, and the PKGs ask the registrar to verify the token
+// (see pkg.RegistrarVerifier).
+package registrar
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/bloom"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+const (
+	// DefaultTokenTTL is the token lifetime used when Config.TokenTTL is zero.
+	DefaultTokenTTL = 24 * time.Hour
+
+	// DefaultRateLimit and DefaultRateWindow are used when
+	// Config.RateLimit and Config.RateWindow are zero.
+	DefaultRateLimit  = 5
+	DefaultRateWindow = time.Hour
+
+	// DefaultFilterRefresh is how often the PKG user filters are
+	// fetched when Config.FilterRefresh is zero.
+	DefaultFilterRefresh = 10 * time.Minute
+)
+
+// A Config is used to configure a registrar.
+type Config struct {
+	// SigningKey is the registrar's long-term signing key. The PKGs
+	// expect it to match AddFriendConfig.Registrar.Key.
+	SigningKey ed25519.PrivateKey
+
+	// TokenKey is the secret key used to create registration tokens.
+	TokenKey []byte
+
+	// TokenTTL is how long a registration token is valid.
+	TokenTTL time.Duration
+
+	// Mailer delivers registration tokens to users.
+	Mailer Mailer
+
+	// PKGServers are the PKGs that are allowed to verify tokens and
+	// whose user filters are used to reject usernames that are taken.
+	PKGServers []pkg.PublicServerConfig
+
+	// RateLimit is the number of tokens that can be requested from an
+	// IP address in each RateWindow. Tokens are not rate limited per
+	// username, since anyone can request a token for any username and
+	// would otherwise be able to lock the owner out.
+	RateLimit  int
+	RateWindow time.Duration
+
+	// FilterRefresh is how often the PKG user filters are fetched.
+	FilterRefresh time.Duration
+
+	// Logger is the logger used to write log messages. The standard logger
+	// is used if Logger is nil.
+	Logger *log.Logger
+}
+
+type Server struct {
+	log      *log.Logger
+	tokens   *pkg.HMACVerifier
+	tokenTTL time.Duration
+	mailer   Mailer
+	pkgs     []pkg.PublicServerConfig
+	client   *edhttp.Client
+
+	addressLimiter *rateLimiter
+
+	mu sync.Mutex
+	// filters maps hex(pkgKey) to the PKG's user filter.
+	filters map[string]*bloom.Filter
+	// verified holds usernames that were verified since the filters
+	// were last refreshed.
+	verified map[string]bool
+
+	done chan struct{}
+}
+
+func New(conf *Config) (*Server, error) {
+	if len(conf.TokenKey) < 16 {
+		return nil, errors.New("token key must be at least 16 bytes")
+	}
+	if conf.Mailer == nil {
+		return nil, errors.New("nil Mailer")
+	}
+
+	logger := conf.Logger
+	if logger == nil {
+		logger = log.StdLogger
+	}
+	ttl := conf.TokenTTL
+	if ttl == 0 {
+		ttl = DefaultTokenTTL
+	}
+	limit := conf.RateLimit
+	if limit == 0 {
+		limit = DefaultRateLimit
+	}
+	window := conf.RateWindow
+	if window == 0 {
+		window = DefaultRateWindow
+	}
+	refresh := conf.FilterRefresh
+	if refresh == 0 {
+		refresh = DefaultFilterRefresh
+	}
+
+	srv := &Server{
+		log:      logger,
+		tokens:   &pkg.HMACVerifier{Key: conf.TokenKey},
+		tokenTTL: ttl,
+		mailer:   conf.Mailer,
+		pkgs:     conf.PKGServers,
+		client: &edhttp.Client{
+			Key: conf.SigningKey,
+		},
+
+		addressLimiter: newRateLimiter(limit, window),
+
+		filters:  make(map[string]*bloom.Filter),
+		verified: make(map[string]bool),
+
+		done: make(chan struct{}),
+	}
+
+	go srv.refreshLoop(refresh)
+
+	return srv, nil
+}
+
+func (srv *Server) Close() error {
+	close(srv.done)
+	return nil
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/register":
+		srv.tokenHandler(w, r, false)
+	case "/reset":
+		srv.tokenHandler(w, r, true)
+	case "/verify":
+		srv.verifyHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// tokenHandler mails a registration token to the requested username.
+// Tokens for new registrations are only sent if the username is free.
+// Tokens for login key resets (see pkg.Client.ResetLoginKey) are sent
+// regardless, since they only reach whoever controls the username.
+func (srv *Server) tokenHandler(w http.ResponseWriter, req *http.Request, reset bool) {
+	if req.Method != "POST" {
+		http.Error(w, "expecting POST", http.StatusMethodNotAllowed)
+		return
+	}
+	username := req.PostFormValue("username")
+	logger := srv.log.WithFields(log.Fields{"username": username})
+
+	if err := pkg.ValidateUsername(username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !srv.addressLimiter.Allow(host) {
+		logger.WithFields(log.Fields{"addr": host}).Info("Rate limited")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	if !reset && srv.Taken(username) {
+		http.Error(w, "username already registered", http.StatusConflict)
+		return
+	}
+
+	token := srv.tokens.NewToken(username, time.Now().Add(srv.tokenTTL))
+	if err := srv.mailer.SendToken(username, token); err != nil {
+		logger.Errorf("Failed to send token: %s", err)
+		http.Error(w, "failed to send token", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Sent registration token")
+
+	w.Write([]byte("\"OK\""))
+}
+
+func (srv *Server) verifyHandler(w http.ResponseWriter, req *http.Request) {
+	if !srv.authorizedPKG(req) {
+		writeError(w, http.StatusUnauthorized, pkg.Error{Code: pkg.ErrUnauthorized})
+		return
+	}
+	username := req.PostFormValue("username")
+	token := req.PostFormValue("token")
+
+	err := srv.tokens.VerifyRegistration(username, token)
+	if err != nil {
+		srv.log.WithFields(log.Fields{"username": username}).Infof("Verification failed: %s", err)
+		pkgErr, ok := err.(pkg.Error)
+		if !ok {
+			pkgErr = pkg.Error{Code: pkg.ErrInvalidToken}
+		}
+		writeError(w, http.StatusBadRequest, pkgErr)
+		return
+	}
+
+	srv.mu.Lock()
+	srv.verified[username] = true
+	srv.mu.Unlock()
+
+	w.Write([]byte("\"OK\""))
+}
+
+func (srv *Server) authorizedPKG(req *http.Request) bool {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	peerKey, ok := req.TLS.PeerCertificates[0].PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return false
+	}
+	for _, p := range srv.pkgs {
+		if bytes.Equal(peerKey, p.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w http.ResponseWriter, code int, err pkg.Error) {
+	data, _ := json.Marshal(err)
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// Taken reports whether username is registered with any of the PKGs,
+// according to the most recent user filters. Bloom filters have false
+// positives, so a small fraction of free usernames are reported as taken.
+// The PKGs reject duplicate registrations on their own, so a stale
+// filter is harmless.
+func (srv *Server) Taken(username string) bool {
+	id := pkg.ValidUsernameToIdentity(username)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.verified[username] {
+		return true
+	}
+	for _, f := range srv.filters {
+		if f.Test(id[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) refreshLoop(interval time.Duration) {
+	for {
+		srv.RefreshUserFilters()
+
+		select {
+		case <-srv.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// RefreshUserFilters fetches the user filter from each PKG. A PKG whose
+// filter can't be fetched keeps its previous filter.
+func (srv *Server) RefreshUserFilters() {
+	filters := make(map[string]*bloom.Filter)
+	for _, p := range srv.pkgs {
+		f, err := srv.fetchUserFilter(p)
+		if err != nil {
+			srv.log.WithFields(log.Fields{"pkg": p.Address}).Errorf("Failed to fetch user filter: %s", err)
+			continue
+		}
+		filters[hex.EncodeToString(p.Key)] = f
+	}
+
+	srv.mu.Lock()
+	for k, f := range filters {
+		srv.filters[k] = f
+	}
+	if len(filters) == len(srv.pkgs) {
+		srv.verified = make(map[string]bool)
+	}
+	srv.mu.Unlock()
+}
+
+func (srv *Server) fetchUserFilter(p pkg.PublicServerConfig) (*bloom.Filter, error) {
+	resp, err := srv.client.Get(p.Key, (&url.URL{Scheme: "https", Host: p.Address, Path: "/registrar/userfilter"}).String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status: %s", resp.Status)
+	}
+
+	f := new(bloom.Filter)
+	if err := json.NewDecoder(resp.Body).Decode(f); err != nil {
+		return nil, errors.Wrap(err, "decoding user filter")
+	}
+	return f, nil
+}
+
+// RequestToken asks the registrar to send a registration token to username.
+// If reset is true, the token is for resetting the login key of a username
+// that is already registered.
+func RequestToken(client *edhttp.Client, reg config.RegistrarConfig, username string, reset bool) error {
+	vals := url.Values{
+		"username": []string{username},
+	}
+	path := "/register"
+	if reset {
+		path = "/reset"
+	}
+	u := (&url.URL{Scheme: "https", Host: reg.Address, Path: path}).String()
+	resp, err := client.Post(reg.Key, u, "application/x-www-form-urlencoded", bytes.NewBufferString(vals.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg := new(bytes.Buffer)
+		msg.ReadFrom(resp.Body)
+		return errors.New("registrar: %s: %s", resp.Status, bytes.TrimSpace(msg.Bytes()))
+	}
+	return nil
+}
+
+// rateLimiter allows at most limit events per key in each window.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		counts: make(map[string]int),
+	}
+}
+
+func (l *rateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.windowStart) >= l.window {
+		l.windowStart = now
+		l.counts = make(map[string]int)
+	}
+	if l.counts[key] >= l.limit {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package registrar
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/bloom"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+type memMailer struct {
+	tokens map[string]string
+}
+
+func (m *memMailer) SendToken(username string, token string) error {
+	m.tokens[username] = token
+	return nil
+}
+
+func post(srv *Server, path string, vals url.Values, peerKey ed25519.PublicKey) *httptest.ResponseRecorder {
+	return postFrom(srv, "192.0.2.1:1234", path, vals, peerKey)
+}
+
+func postFrom(srv *Server, remoteAddr string, path string, vals url.Values, peerKey ed25519.PublicKey) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(vals.Encode()))
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if peerKey != nil {
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: peerKey}},
+		}
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	return w
+}
+
+func TestRegistrar(t *testing.T) {
+	pkgPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	mailer := &memMailer{tokens: make(map[string]string)}
+	srv, err := New(&Config{
+		TokenKey:   []byte("0123456789abcdef"),
+		Mailer:     mailer,
+		PKGServers: []pkg.PublicServerConfig{{Key: pkgPub, Address: "localhost:0"}},
+		RateLimit:  3,
+		Logger: &log.Logger{
+			Level:        log.ErrorLevel,
+			EntryHandler: &log.OutputText{Out: log.Stderr},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	w := post(srv, "/register", url.Values{"username": {"alice@example.org"}}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+	token := mailer.tokens["alice@example.org"]
+	if token == "" {
+		t.Fatal("no token sent")
+	}
+
+	vals := url.Values{"username": {"alice@example.org"}, "token": {token}}
+	w = post(srv, "/verify", vals, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("verify without PKG key: %d %s", w.Code, w.Body)
+	}
+	w = post(srv, "/verify", vals, pkgPub)
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify: %d %s", w.Code, w.Body)
+	}
+	w = post(srv, "/verify", url.Values{"username": {"bob@example.org"}, "token": {token}}, pkgPub)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Code") {
+		t.Fatalf("verify with wrong username: %d %s", w.Code, w.Body)
+	}
+
+	// alice is now taken.
+	w = post(srv, "/register", url.Values{"username": {"alice@example.org"}}, nil)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("register taken username: %d %s", w.Code, w.Body)
+	}
+
+	// Reset tokens are sent for taken usernames.
+	delete(mailer.tokens, "alice@example.org")
+	w = post(srv, "/reset", url.Values{"username": {"alice@example.org"}}, nil)
+	if w.Code != http.StatusOK || mailer.tokens["alice@example.org"] == "" {
+		t.Fatalf("reset: %d %s", w.Code, w.Body)
+	}
+
+	// The rate limit is per address: this is the fourth request.
+	w = post(srv, "/register", url.Values{"username": {"bob@example.org"}}, nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected rate limit: %d %s", w.Code, w.Body)
+	}
+
+	// Requests for bob from other addresses don't lock bob out.
+	for i := 0; i < 4; i++ {
+		w = postFrom(srv, "192.0.2.2:1234", "/register", url.Values{"username": {"bob@example.org"}}, nil)
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected rate limit: %d %s", w.Code, w.Body)
+	}
+	delete(mailer.tokens, "bob@example.org")
+	w = postFrom(srv, "192.0.2.3:1234", "/register", url.Values{"username": {"bob@example.org"}}, nil)
+	if w.Code != http.StatusOK || mailer.tokens["bob@example.org"] == "" {
+		t.Fatalf("register from another address: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestTakenFilter(t *testing.T) {
+	pkgPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := New(&Config{
+		TokenKey: []byte("0123456789abcdef"),
+		Mailer:   &memMailer{tokens: make(map[string]string)},
+		Logger: &log.Logger{
+			Level:        log.ErrorLevel,
+			EntryHandler: &log.OutputText{Out: log.Stderr},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	f := bloom.New(bloom.Optimal(100, 0.0001))
+	f.Set(pkg.ValidUsernameToIdentity("carol@example.org")[:])
+	srv.mu.Lock()
+	srv.filters[hex.EncodeToString(pkgPub)] = f
+	srv.mu.Unlock()
+
+	if !srv.Taken("carol@example.org") {
+		t.Fatal("expected carol to be taken")
+	}
+	if srv.Taken("dave@example.org") {
+		t.Fatal("expected dave to be free")
+	}
+}
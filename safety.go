@@ -0,0 +1,86 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const safetyNumberVersion = 1
+
+// SafetyNumberSize is the size of a safety number in bytes.
+const SafetyNumberSize = 30
+
+// A SafetyNumber is a fingerprint of the long-term keys of two friends.
+// Both friends compute the same safety number, so they can verify each
+// other's keys by comparing safety numbers out-of-band.
+type SafetyNumber [SafetyNumberSize]byte
+
+// SafetyNumber returns the safety number for the user and the friend.
+func (f *Friend) SafetyNumber() SafetyNumber {
+	c := f.client
+	return computeSafetyNumber(c.Username, c.LongTermPublicKey, f.Username, f.LongTermKey)
+}
+
+func computeSafetyNumber(username1 string, key1 ed25519.PublicKey, username2 string, key2 ed25519.PublicKey) SafetyNumber {
+	a := safetyNumberInput(username1, key1)
+	b := safetyNumberInput(username2, key2)
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+
+	h := sha512.New()
+	h.Write([]byte("alpenhorn safety number"))
+	h.Write([]byte{safetyNumberVersion})
+	h.Write(a)
+	h.Write(b)
+
+	var sn SafetyNumber
+	copy(sn[:], h.Sum(nil))
+	return sn
+}
+
+func safetyNumberInput(username string, key ed25519.PublicKey) []byte {
+	buf := make([]byte, 2+len(username)+len(key))
+	binary.BigEndian.PutUint16(buf, uint16(len(username)))
+	copy(buf[2:], username)
+	copy(buf[2+len(username):], key)
+	return buf
+}
+
+// Digits returns the safety number as 30 decimal digits in groups of 5,
+// suitable for reading aloud.
+func (sn SafetyNumber) Digits() string {
+	groups := make([]string, 0, SafetyNumberSize/5)
+	for i := 0; i < SafetyNumberSize; i += 5 {
+		var n uint64
+		for _, b := range sn[i : i+5] {
+			n = n<<8 | uint64(b)
+		}
+		groups = append(groups, fmt.Sprintf("%05d", n%100000))
+	}
+	return strings.Join(groups, " ")
+}
+
+func (sn SafetyNumber) String() string {
+	return sn.Digits()
+}
+
+// Bytes returns a compact encoding of the safety number that is
+// suitable for QR codes.
+func (sn SafetyNumber) Bytes() []byte {
+	return append([]byte{safetyNumberVersion}, sn[:]...)
+}
+
+// Matches reports whether data, as returned by Bytes (e.g., scanned
+// from the friend's QR code), encodes the same safety number.
+func (sn SafetyNumber) Matches(data []byte) bool {
+	return bytes.Equal(sn.Bytes(), data)
+}
@@ -0,0 +1,40 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"crypto/ed25519"
+	"regexp"
+	"testing"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	alicePub, _, _ := ed25519.GenerateKey(rand.Reader)
+	bobPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	evePub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	ab := computeSafetyNumber("alice@example.org", alicePub, "bob@example.org", bobPub)
+	ba := computeSafetyNumber("bob@example.org", bobPub, "alice@example.org", alicePub)
+	if ab != ba {
+		t.Fatalf("safety number depends on order: %s != %s", ab, ba)
+	}
+	if !ab.Matches(ba.Bytes()) {
+		t.Fatalf("safety number does not match its own bytes")
+	}
+
+	ae := computeSafetyNumber("alice@example.org", alicePub, "bob@example.org", evePub)
+	if ab == ae {
+		t.Fatalf("safety number does not depend on keys")
+	}
+	if ab.Matches(ae.Bytes()) {
+		t.Fatalf("different safety numbers match")
+	}
+
+	if !regexp.MustCompile(`^\d{5}( \d{5}){5}$`).MatchString(ab.Digits()) {
+		t.Fatalf("unexpected digits format: %q", ab.Digits())
+	}
+}
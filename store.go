@@ -0,0 +1,105 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"vuvuzela.io/internal/ioutil2"
+)
+
+// A ClientStore stores the client's state and keywheel. The two are
+// stored separately because they need different guarantees: the client
+// state is long-term and should be backed up, whereas old versions of the
+// keywheel must be erased for forward secrecy and should never be backed up.
+type ClientStore interface {
+	// LoadState returns the most recently saved client state.
+	LoadState() ([]byte, error)
+
+	// SaveState durably replaces the client state.
+	SaveState(data []byte) error
+
+	// LoadKeywheel returns the most recently saved keywheel.
+	LoadKeywheel() ([]byte, error)
+
+	// SaveKeywheel replaces the keywheel. Implementations should make a
+	// best effort to erase the previous keywheel.
+	SaveKeywheel(data []byte) error
+}
+
+// FileStore is the default ClientStore. It stores the client state
+// and keywheel in separate files. Saving to an empty path is a no-op.
+type FileStore struct {
+	ClientPath   string
+	KeywheelPath string
+}
+
+func (s *FileStore) LoadState() ([]byte, error) {
+	return ioutil.ReadFile(s.ClientPath)
+}
+
+func (s *FileStore) SaveState(data []byte) error {
+	if s.ClientPath == "" {
+		return nil
+	}
+	return ioutil2.WriteFileAtomic(s.ClientPath, data, 0600)
+}
+
+func (s *FileStore) LoadKeywheel() ([]byte, error) {
+	return ioutil.ReadFile(s.KeywheelPath)
+}
+
+func (s *FileStore) SaveKeywheel(data []byte) error {
+	if s.KeywheelPath == "" {
+		return nil
+	}
+	return ioutil2.WriteFileAtomic(s.KeywheelPath, data, 0600)
+}
+
+// MemoryStore is a ClientStore that keeps everything in memory.
+// It is useful for tests and for applications that manage
+// persistence themselves.
+type MemoryStore struct {
+	mu       sync.Mutex
+	state    []byte
+	keywheel []byte
+}
+
+func (s *MemoryStore) LoadState() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == nil {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte(nil), s.state...), nil
+}
+
+func (s *MemoryStore) SaveState(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *MemoryStore) LoadKeywheel() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keywheel == nil {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte(nil), s.keywheel...), nil
+}
+
+func (s *MemoryStore) SaveKeywheel(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.keywheel {
+		s.keywheel[i] = 0
+	}
+	s.keywheel = append([]byte(nil), data...)
+	return nil
+}